@@ -424,12 +424,35 @@ else
     GPU_NOTE="CUDA not enabled in iyokan; using CPU"
 fi
 
-RUN_GPU_ARGS=()
-RESUME_GPU_ARGS=()
-if ((GPU_COUNT > 0)); then
-    RUN_GPU_ARGS=(-iyokan-args --enable-gpu -iyokan-args --num-gpu -iyokan-args "$GPU_COUNT")
-    RESUME_GPU_ARGS=(-iyokan-args --num-gpu -iyokan-args "$GPU_COUNT")
-fi
+config_source() {
+    cat <<EOF
+[defaults]
+cpu = "$CPU"
+keys = "demo"
+
+[keys.demo]
+secret = "secret.key"
+bootstrapping = "bootstrapping.key"
+EOF
+    if ((GPU_COUNT > 0)); then
+        cat <<EOF
+
+[commands.run]
+g = $GPU_COUNT
+
+[commands.resume]
+iyokan-args = ["--enable-gpu", "--gpu_num", "$GPU_COUNT"]
+EOF
+    fi
+}
+
+write_config() {
+    pause
+    printf '$ cd %q && cat > kvsp.toml <<'\''EOF'\''\n' "$DEMO_DIR"
+    config_source
+    printf 'EOF\n'
+    config_source > "$DEMO_DIR/kvsp.toml"
+}
 
 printf 'KVSP demo using RISC-V/Alexandrite\n'
 printf '  kvsp:      %s\n' "$KVSP_BIN"
@@ -505,7 +528,10 @@ printf 'The ELF file size includes headers, alignment, and symbol/string tables;
 run_in_demo "$SIZE_TOOL" -A fib
 show_sizes fib
 
-capture_all_in_demo emu.txt "$KVSP_BIN" emu --cpu "$CPU" fib "$ARGUMENT"
+printf 'kvsp.toml gives the CPU, the keys, and the GPU options to the kvsp commands below.\n'
+write_config
+
+capture_all_in_demo emu.txt "$KVSP_BIN" emu fib "$ARGUMENT"
 run_in_demo awk '/^#cycle|^f0|^x10/' emu.txt
 EMU_CYCLES=$(awk -F '\t' '$1 == "#cycle" { print $2; exit }' "$DEMO_DIR/emu.txt")
 [[ "$EMU_CYCLES" =~ ^[0-9]+$ ]] || fail "could not read cycle count from $DEMO_DIR/emu.txt"
@@ -519,27 +545,27 @@ printf 'Plain RISC-V run finished in %d cycles; encrypted resume will run %d mor
 
 run_in_demo "$KVSP_BIN" version
 
-run_in_demo "$KVSP_BIN" genkey -o secret.key
+run_in_demo "$KVSP_BIN" genkey
 show_sizes secret.key
 
-run_in_demo "$KVSP_BIN" genbkey -i secret.key -o bootstrapping.key
+run_in_demo "$KVSP_BIN" genbkey
 show_sizes secret.key bootstrapping.key
 
-run_in_demo "$KVSP_BIN" enc --cpu "$CPU" -k secret.key -i fib -o fib.enc "$ARGUMENT"
+run_in_demo "$KVSP_BIN" enc -i fib -o fib.enc "$ARGUMENT"
 show_sizes secret.key bootstrapping.key fib.enc
 
 printf 'The encrypted run below prints cycle progress as #N and per-cycle elapsed time as done. (... us).\n'
-run_in_demo "$KVSP_BIN" run --cpu "$CPU" "${RUN_GPU_ARGS[@]}" -bkey bootstrapping.key -i fib.enc -o result-30.enc -c "$FIRST_CYCLES" -snapshot run-30.snapshot
+run_in_demo "$KVSP_BIN" run -i fib.enc -o result-30.enc -c "$FIRST_CYCLES" -snapshot run-30.snapshot
 show_sizes fib.enc result-30.enc run-30.snapshot
 
-capture_in_demo decrypt-30.txt "$KVSP_BIN" dec --cpu "$CPU" -k secret.key -i result-30.enc
+capture_in_demo decrypt-30.txt "$KVSP_BIN" dec -i result-30.enc
 run_in_demo awk '/^#cycle|^f0|^x10/' decrypt-30.txt
 
 printf 'The resume step also prints cycle progress and per-cycle elapsed time.\n'
-run_in_demo "$KVSP_BIN" resume "${RESUME_GPU_ARGS[@]}" -bkey bootstrapping.key -i run-30.snapshot -o result.enc -c "$RESUME_CYCLES" -snapshot run-final.snapshot
+run_in_demo "$KVSP_BIN" resume -i run-30.snapshot -o result.enc -c "$RESUME_CYCLES" -snapshot run-final.snapshot
 show_sizes result.enc run-final.snapshot
 
-capture_in_demo decrypt-final.txt "$KVSP_BIN" dec --cpu "$CPU" -k secret.key -i result.enc
+capture_in_demo decrypt-final.txt "$KVSP_BIN" dec -i result.enc
 run_in_demo awk '/^#cycle|^f0|^x10/' decrypt-final.txt
 
 printf '\nDone. For RISC-V, x10 is the return-value register; fib(%s) should decrypt to x10 = 5.\n' "$ARGUMENT"
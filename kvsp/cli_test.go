@@ -0,0 +1,619 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/kvsp/kvsp/pkg/kvsp"
+)
+
+// setupProgram makes the keys and fib.enc, the encrypted fib with argument
+// 5, in the directory of e.
+func setupProgram(e *cliEnv) {
+	e.t.Helper()
+	e.writeProgram("fib")
+	e.mustRun("genkey", "-o", "secret.key")
+	e.mustRun("genbkey", "-i", "secret.key", "-o", "bootstrapping.key")
+	e.mustRun("enc", "--cpu", "ruby", "-k", "secret.key", "-i", "fib", "-o", "fib.enc", "5")
+	e.calls()
+}
+
+func checkCalls(t *testing.T, e *cliEnv, want ...string) {
+	t.Helper()
+	if got := e.calls(); !reflect.DeepEqual(got, want) {
+		t.Errorf("calls:\n\t%s\nwant:\n\t%s", strings.Join(got, "\n\t"), strings.Join(want, "\n\t"))
+	}
+}
+
+func TestCLIKeysAndEnc(t *testing.T) {
+	e := newCLIEnv(t)
+	e.writeProgram("fib")
+
+	e.mustRun("genkey", "-o", "secret.key")
+	checkCalls(t, e, "iyokan-packet genkey --type tfhepp --out secret.key")
+	e.mustRun("genbkey", "-i", "secret.key", "-o", "bootstrapping.key")
+	checkCalls(t, e, "iyokan-packet genevalkey --in secret.key --out bootstrapping.key")
+	e.mustRun("enc", "--cpu", "ruby", "-k", "secret.key", "-i", "fib", "-o", "fib.enc", "5")
+	checkCalls(t, e, "iyokan-packet enc --key secret.key --in $TMP --out fib.enc")
+	e.mustRun("plainpacket", "--cpu", "ruby", "-i", "fib", "-o", "fib.plain", "5")
+	checkCalls(t, e)
+
+	// A protected key is unwrapped into the private working directory.
+	e.setenv("KVSP_KEY_PASSPHRASE", "passphrase")
+	e.mustRun("genkey", "-protect", "-o", "protected.key")
+	checkCalls(t, e, "iyokan-packet genkey --type tfhepp --out $TMP")
+	e.mustRun("genbkey", "-i", "protected.key", "-o", "protected-bootstrapping.key")
+	checkCalls(t, e, "iyokan-packet genevalkey --in $TMP --out protected-bootstrapping.key")
+	e.mustRun("enc", "--cpu", "ruby", "-k", "protected.key", "-i", "fib", "-o", "protected.enc")
+	checkCalls(t, e, "iyokan-packet enc --key $TMP --in $TMP --out protected.enc")
+}
+
+func TestCLIEncBatch(t *testing.T) {
+	e := newCLIEnv(t)
+	setupProgram(e)
+	if err := os.WriteFile(e.path("args.txt"), []byte("# n\n5\n'1 2' 3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := e.mustRun("enc-batch", "--cpu", "ruby", "-k", "secret.key", "-i", "fib", "--args-file", "args.txt", "-o", "batch", "-j", "1")
+	if want := "batch/0001.enc\t5\nbatch/0002.enc\t1 2 3\n"; out != want {
+		t.Errorf("stdout = %q, want %q", out, want)
+	}
+	checkCalls(t, e,
+		"iyokan-packet enc --key secret.key --in $TMP --out batch/0001.enc",
+		"iyokan-packet enc --key secret.key --in $TMP --out batch/0002.enc")
+
+	if err := os.WriteFile(e.path("empty.txt"), []byte("# n\n\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, stderr, code := e.run("enc-batch", "--cpu", "ruby", "-k", "secret.key", "-i", "fib", "--args-file", "empty.txt", "-o", "empty")
+	if code == 0 || !strings.Contains(stderr, "empty.txt: no sets of arguments") {
+		t.Errorf("enc-batch with no arguments: exit %d, stderr %q", code, stderr)
+	}
+	checkCalls(t, e)
+}
+
+func TestCLIRunResumeDec(t *testing.T) {
+	e := newCLIEnv(t)
+	setupProgram(e)
+
+	out := e.mustRun("run", "--cpu", "ruby", "-bkey", "bootstrapping.key", "-i", "fib.enc", "-o", "result.enc",
+		"-c", "10", "-snapshot", "fib.snapshot", "-g", "2", "--iyokan-args", "--foo")
+	checkCalls(t, e, "iyokan tfhe --evalkey bootstrapping.key -o result.enc -c 10 --snapshot fib.snapshot "+
+		"-i fib.enc --blueprint $SHARE/cahp-ruby.toml --enable-gpu --gpu_num 2 --foo")
+	if want := "resume -c 10 -i fib.snapshot -o result.enc -bkey bootstrapping.key\n"; !strings.HasSuffix(out, want) {
+		t.Errorf("stdout = %q, want the resume hint %q", out, want)
+	}
+
+	// The bootstrapping key and the output come from the snapshot.
+	e.mustRun("resume", "-i", "fib.snapshot", "-c", "5", "-snapshot", "fib2.snapshot", "-quiet")
+	checkCalls(t, e, "iyokan tfhe --evalkey $DIR/bootstrapping.key -o $DIR/result.enc -c 5 --snapshot fib2.snapshot "+
+		"--quiet --resume fib.snapshot")
+
+	// ruby returns in reg_x8, which the fake sets to 8.
+	out = e.mustRun("dec", "--cpu", "ruby", "-k", "secret.key", "-i", "result.enc", "-format", "json")
+	checkCalls(t, e, "iyokan-packet dec --key secret.key --in result.enc --out $TMP")
+	var result struct {
+		Cycles    int   `json:"cycles"`
+		Finflag   bool  `json:"finflag"`
+		ExitValue int   `json:"exit_value"`
+		Ram       []int `json:"ram"`
+	}
+	if err := json.Unmarshal([]byte(out), &result); err != nil {
+		t.Fatalf("dec -format json = %q: %v", out, err)
+	}
+	if result.Cycles != 15 || !result.Finflag || result.ExitValue != 8 || len(result.Ram) != 512 || result.Ram[1] != 6 {
+		t.Errorf("dec = %+v", result)
+	}
+
+	if _, _, code := e.run("dec", "--cpu", "ruby", "-k", "secret.key", "-i", "result.enc", "-exit-code"); code != 8 {
+		t.Errorf("dec -exit-code exited with %d, want 8", code)
+	}
+
+	// An unfinished run exits as a program returning 125 does, but says so.
+	e.setenv("KVSP_FAKE_HALT_AT", "100")
+	e.mustRun("run", "--cpu", "ruby", "-bkey", "bootstrapping.key", "-i", "fib.enc", "-o", "unfinished.enc", "-c", "10")
+	_, stderr, code := e.run("dec", "--cpu", "ruby", "-k", "secret.key", "-i", "unfinished.enc", "-exit-code")
+	if code != exitCodeNotFinished || stderr != "The program has not finished in 10 cycles.\n" {
+		t.Errorf("dec -exit-code of an unfinished run exited with %d: %q", code, stderr)
+	}
+}
+
+func TestCLIRunUntilDone(t *testing.T) {
+	e := newCLIEnv(t)
+	setupProgram(e)
+	e.setenv("KVSP_FAKE_HALT_AT", "25")
+
+	out := e.mustRun("run-until-done", "--cpu", "ruby", "-k", "secret.key", "-bkey", "bootstrapping.key",
+		"-i", "fib.enc", "-o", "result.enc", "-chunk", "10", "-max", "100", "-snapshot", "fib.snapshot")
+	checkCalls(t, e,
+		"iyokan tfhe --evalkey bootstrapping.key -o result.enc.next -c 10 --snapshot fib.snapshot.next "+
+			"-i fib.enc --blueprint $SHARE/cahp-ruby.toml",
+		"iyokan-packet dec --key secret.key --in result.enc --out $TMP",
+		"iyokan tfhe --evalkey bootstrapping.key -o result.enc.next -c 10 --snapshot fib.snapshot.next "+
+			"--resume fib.snapshot",
+		"iyokan-packet dec --key secret.key --in result.enc --out $TMP",
+		"iyokan tfhe --evalkey bootstrapping.key -o result.enc.next -c 10 --snapshot fib.snapshot.next "+
+			"--resume fib.snapshot",
+		"iyokan-packet dec --key secret.key --in result.enc --out $TMP")
+	if !strings.Contains(out, "Finished within 30 cycles.") {
+		t.Errorf("stdout = %q", out)
+	}
+
+	_, stderr, code := e.run("run-until-done", "--cpu", "ruby", "-k", "secret.key", "-bkey", "bootstrapping.key",
+		"-i", "fib.enc", "-o", "result.enc", "-chunk", "10", "-max", "20", "-snapshot", "fib.snapshot")
+	if code == 0 || !strings.Contains(stderr, "The program did not finish in 20 cycles") {
+		t.Errorf("run-until-done -max 20 exited with %d: %s", code, stderr)
+	}
+}
+
+// readProgress reads the progress file name in the directory of e.
+func readProgress(e *cliEnv, name string) (p struct {
+	State   string `json:"state"`
+	Cycles  int    `json:"cycles"`
+	Total   int    `json:"total"`
+	Warning string `json:"warning"`
+}) {
+	e.t.Helper()
+	data, err := os.ReadFile(e.path(name))
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &p); err != nil {
+		e.t.Fatalf("%s = %q: %v", name, data, err)
+	}
+	return p
+}
+
+func TestCLIProgress(t *testing.T) {
+	e := newCLIEnv(t)
+	setupProgram(e)
+
+	// -quiet still runs Iyokan with --quiet, so that only the end is known.
+	out := e.mustRun("run", "--cpu", "ruby", "-bkey", "bootstrapping.key", "-i", "fib.enc", "-o", "result.enc",
+		"-c", "10", "-snapshot", "fib.snapshot", "-quiet", "--progress-file", "progress.json")
+	checkCalls(t, e, "iyokan tfhe --evalkey bootstrapping.key -o result.enc -c 10 --snapshot fib.snapshot "+
+		"--quiet -i fib.enc --blueprint $SHARE/cahp-ruby.toml")
+	if out != "" {
+		t.Errorf("stdout = %q, want nothing", out)
+	}
+	if p := readProgress(e, "progress.json"); p.State != "done" || p.Cycles != 10 || p.Total != 10 || p.Warning != "" {
+		t.Errorf("progress of run = %+v", p)
+	}
+
+	// Without a terminal to show the progress on, the lines of the clocks
+	// are passed through with the others.
+	out = e.mustRun("resume", "-i", "fib.snapshot", "-c", "5", "-snapshot", "fib2.snapshot",
+		"--progress-file", "progress.json")
+	if !strings.Contains(out, "Iyokan starts.\n#11\tdone. (1 us)\n") || !strings.Contains(out, "#15\tdone.") {
+		t.Errorf("stdout = %q", out)
+	}
+	if p := readProgress(e, "progress.json"); p.State != "done" || p.Cycles != 5 || p.Total != 5 {
+		t.Errorf("progress of resume = %+v", p)
+	}
+
+	// Lines of the clocks in an unknown format are warned about.
+	e.setenv("KVSP_FAKE_CYCLE_LINE", "cycle %d finished")
+	out, stderr, code := e.run("resume", "-i", "fib.snapshot", "-c", "5", "-snapshot", "fib2.snapshot",
+		"--progress-file", "progress.json")
+	if code != 0 || !strings.Contains(out, "cycle 15 finished") || !strings.Contains(stderr, `printed no "#N done" lines`) {
+		t.Errorf("resume exited with %d\nstdout: %s\nstderr: %s", code, out, stderr)
+	}
+	if p := readProgress(e, "progress.json"); p.State != "done" || p.Cycles != 5 || p.Warning == "" {
+		t.Errorf("progress of resume = %+v", p)
+	}
+	e.setenv("KVSP_FAKE_CYCLE_LINE", "")
+
+	e.setenv("KVSP_FAKE_HALT_AT", "25")
+	e.mustRun("run-until-done", "--cpu", "ruby", "-k", "secret.key", "-bkey", "bootstrapping.key",
+		"-i", "fib.enc", "-o", "result.enc", "-chunk", "10", "-max", "100", "-quiet", "--progress-file", "progress.json")
+	if p := readProgress(e, "progress.json"); p.State != "done" || p.Cycles != 30 || p.Total != 100 {
+		t.Errorf("progress of run-until-done = %+v", p)
+	}
+
+	e.setenv("KVSP_FAKE_FAIL", "tfhe")
+	_, stderr, code = e.run("run", "--cpu", "ruby", "-bkey", "bootstrapping.key", "-i", "fib.enc", "-o", "result.enc",
+		"-c", "10", "--progress-file", "progress.json", "--progress-addr", "127.0.0.1:0")
+	if code == 0 || !strings.Contains(stderr, "Serving the progress on http://127.0.0.1:") {
+		t.Errorf("run exited with %d: %s", code, stderr)
+	}
+	if p := readProgress(e, "progress.json"); p.State != "failed" || p.Cycles != 0 {
+		t.Errorf("progress of the failed run = %+v", p)
+	}
+}
+
+// waitForHang waits for the fake evaluator which kvsp, started by e.start as
+// proc, runs to hang, and returns its PID.
+func waitForHang(e *cliEnv, proc *os.Process, wait func() (string, string, int)) int {
+	e.t.Helper()
+	for i := 0; i < 500; i++ {
+		time.Sleep(10 * time.Millisecond)
+		if data, err := os.ReadFile(e.path("iyokan.pid")); err == nil {
+			if pid, err := strconv.Atoi(string(data)); err == nil {
+				os.Remove(e.path("iyokan.pid"))
+				return pid
+			}
+		}
+	}
+	proc.Kill()
+	wait()
+	e.t.Fatal("the fake evaluator did not hang")
+	return 0
+}
+
+// interrupt sends SIGTERM to kvsp once the fake evaluator hangs, and
+// returns the PID of the evaluator and what run does.
+func interrupt(e *cliEnv, args ...string) (int, string, int) {
+	e.t.Helper()
+	proc, wait := e.start(args...)
+	pid := waitForHang(e, proc, wait)
+	if err := proc.Signal(syscall.SIGTERM); err != nil {
+		e.t.Fatal(err)
+	}
+	_, stderr, code := wait()
+	return pid, stderr, code
+}
+
+// processGone reports whether the process pid has exited, even if nobody
+// has reaped it.
+func processGone(pid int) bool {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return true
+	}
+	// The state follows the command name in parentheses.
+	_, rest, _ := strings.Cut(string(data), ") ")
+	return strings.HasPrefix(rest, "Z")
+}
+
+func TestCLIInterrupt(t *testing.T) {
+	e := newCLIEnv(t)
+	setupProgram(e)
+	e.setenv("KVSP_FAKE_HANG_AT", "10")
+
+	// The third chunk is interrupted, and the snapshot of the second is kept.
+	pid, stderr, code := interrupt(e, "run", "--cpu", "ruby", "-bkey", "bootstrapping.key", "-i", "fib.enc",
+		"-o", "result.enc", "-c", "20", "-snapshot", "fib.snapshot", "-checkpoint-every", "5", "-quiet")
+	checkCalls(t, e,
+		"iyokan tfhe --evalkey bootstrapping.key -o result.enc.next -c 5 --snapshot fib.snapshot.next "+
+			"--quiet -i fib.enc --blueprint $SHARE/cahp-ruby.toml",
+		"iyokan tfhe --evalkey bootstrapping.key -o result.enc.next -c 5 --snapshot fib.snapshot.next "+
+			"--quiet --resume fib.snapshot",
+		"iyokan tfhe --evalkey bootstrapping.key -o result.enc.next -c 5 --snapshot fib.snapshot.next "+
+			"--quiet --resume fib.snapshot")
+	if code != 128+int(syscall.SIGTERM) || !strings.Contains(stderr, "Interrupted by terminated.\n") {
+		t.Errorf("run exited with %d: %s", code, stderr)
+	}
+	want := "resume -c 10 -i fib.snapshot -o result.enc -bkey bootstrapping.key -checkpoint-every 5\n"
+	if !strings.Contains(stderr, "The last checkpoint 'fib.snapshot' is kept, 10 of 20 cycles in;") || !strings.HasSuffix(stderr, want) {
+		t.Errorf("stderr = %q, want the resume command %q", stderr, want)
+	}
+	// The evaluator is stopped and reaped, not left behind.
+	if err := syscall.Kill(pid, 0); !errors.Is(err, syscall.ESRCH) {
+		t.Errorf("the evaluator %d is still there: %v", pid, err)
+	}
+	if info, err := kvsp.ReadSnapshotInfo(e.path("fib.snapshot")); err != nil || info.Cycles != 10 {
+		t.Errorf("snapshot info = %+v, %v", info, err)
+	}
+	if _, err := os.Stat(e.path("fib.snapshot.next")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the snapshot of the interrupted chunk is left: %v", err)
+	}
+
+	// Without checkpoints, a run has no snapshot to keep, but a resumed run
+	// keeps the one it resumes from.
+	_, stderr, _ = interrupt(e, "resume", "-i", "fib.snapshot", "-c", "10", "-snapshot", "fib2.snapshot")
+	want = "resume -c 10 -i fib.snapshot -o " + e.path("result.enc") + " -bkey " + e.path("bootstrapping.key") + "\n"
+	if !strings.Contains(stderr, "The last checkpoint 'fib.snapshot' is kept, 0 of 10 cycles in;") || !strings.HasSuffix(stderr, want) {
+		t.Errorf("resume was interrupted with %q", stderr)
+	}
+	e.setenv("KVSP_FAKE_HANG_AT", "0")
+	_, stderr, _ = interrupt(e, "run", "--cpu", "ruby", "-bkey", "bootstrapping.key", "-i", "fib.enc",
+		"-o", "result.enc", "-c", "20")
+	if !strings.Contains(stderr, "The run took no checkpoint, so that it is lost.") {
+		t.Errorf("run was interrupted with %q", stderr)
+	}
+	e.calls()
+
+	// Long runs take checkpoints by default.
+	e.setenv("KVSP_FAKE_HANG_AT", "1000")
+	_, stderr, _ = interrupt(e, "run", "--cpu", "ruby", "-bkey", "bootstrapping.key", "-i", "fib.enc",
+		"-o", "result.enc", "-c", "1500", "-snapshot", "long.snapshot", "-quiet")
+	want = "resume -c 500 -i long.snapshot -o result.enc -bkey bootstrapping.key\n"
+	if !strings.Contains(stderr, "The last checkpoint 'long.snapshot' is kept, 1000 of 1500 cycles in;") ||
+		!strings.HasSuffix(stderr, want) {
+		t.Errorf("run was interrupted with %q", stderr)
+	}
+	e.calls()
+	e.setenv("KVSP_FAKE_HANG_AT", "0")
+
+	// The evaluator dies with kvsp even if kvsp cannot stop it.
+	if runtime.GOOS == "linux" {
+		proc, wait := e.start("run", "--cpu", "ruby", "-bkey", "bootstrapping.key", "-i", "fib.enc",
+			"-o", "result.enc", "-c", "20")
+		pid := waitForHang(e, proc, wait)
+		proc.Kill()
+		// The evaluator holds the output of kvsp open, so wait for it first.
+		for i := 0; !processGone(pid); i++ {
+			if i == 500 {
+				syscall.Kill(pid, syscall.SIGKILL)
+				t.Errorf("the evaluator %d outlives kvsp", pid)
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		wait()
+		e.calls()
+	}
+
+	// The other commands stop the tools they run too, and remove their
+	// temporary files.
+	for _, tc := range []struct{ hang, command string }{
+		{"plain", "emu --cpu ruby fib"},
+		{"enc", "enc --cpu ruby -k secret.key -i fib -o fib2.enc"},
+		{"dec", "dec --cpu ruby -k secret.key -i result.enc"},
+	} {
+		e.setenv("KVSP_FAKE_HANG", tc.hang)
+		pid, stderr, code := interrupt(e, strings.Fields(tc.command)...)
+		if code != 128+int(syscall.SIGTERM) {
+			t.Errorf("%s exited with %d: %s", tc.command, code, stderr)
+		}
+		if err := syscall.Kill(pid, 0); !errors.Is(err, syscall.ESRCH) {
+			t.Errorf("%s: the %s tool %d is still there: %v", tc.command, tc.hang, pid, err)
+		}
+		if names, _ := filepath.Glob(e.path("tmp/*")); len(names) > 0 {
+			t.Errorf("%s left %q", tc.command, names)
+		}
+		e.calls()
+	}
+	e.setenv("KVSP_FAKE_HANG", "")
+
+	e.setenv("KVSP_FAKE_HANG_AT", "100")
+	e.mustRun("resume", "-c", "10", "-i", "fib.snapshot", "-o", "result.enc", "-bkey", "bootstrapping.key",
+		"-checkpoint-every", "5")
+	out := e.mustRun("dec", "--cpu", "ruby", "-k", "secret.key", "-i", "result.enc", "-format", "json")
+	if !strings.Contains(out, `"cycles": 20,`) {
+		t.Errorf("dec = %q, want 20 cycles", out)
+	}
+}
+
+func TestCLIEmuEstimate(t *testing.T) {
+	e := newCLIEnv(t)
+	e.writeProgram("fib")
+
+	_, _, code := e.run("emu", "--cpu", "ruby", "--iyokan-args", "--foo", "-exit-code", "fib", "5")
+	if code != 8 {
+		t.Errorf("emu -exit-code exited with %d, want 8", code)
+	}
+	checkCalls(t, e, "iyokan plain -i $TMP -o $TMP --blueprint $SHARE/cahp-ruby.toml --foo")
+
+	out := e.mustRun("estimate", "--cpu", "ruby", "--print-command", "fib", "5")
+	checkCalls(t, e, "iyokan plain -i $TMP -o $TMP --blueprint $SHARE/cahp-ruby.toml")
+	if !strings.HasSuffix(out, " run --cpu ruby --backend tangor -bkey bootstrapping.key -i fib.enc -o result.enc -c 47\n") {
+		t.Errorf("estimate --print-command = %q", out)
+	}
+}
+
+func TestCLICompilerAndDebugger(t *testing.T) {
+	e := newCLIEnv(t)
+	if err := os.Mkdir(e.path("rt"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	profile := "name = \"mini\"\nisa = \"rv32i\"\nblueprint = \"" + e.share + "/alexandrite.toml\"\nruntime = \"rt\"\n" +
+		"linker_script = \"mini.lds\"\nrom_size = 4096\nram_size = 1024\npointer_width = 4\nstack_align = 4\n" +
+		"stack_pointer_offset = 8\nreg_count = 32\nreg_width = 32\nreturn_register = 10\n"
+	if err := os.WriteFile(e.path("mini.toml"), []byte(profile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	e.mustRun("cc", "--cpu-profile", "mini.toml", "-o", "fib", "fib.c")
+	checkCalls(t, e, "clang -target riscv32-unknown-elf -march=rv32i -mabi=ilp32 -Oz -ffreestanding -fno-builtin "+
+		"-fno-unwind-tables -fno-asynchronous-unwind-tables -isystem rt -fuse-ld=lld -nostdlib rt/crt0.o "+
+		"-o fib fib.c -Wl,-T,rt/mini.lds -L rt -lc")
+	e.mustRun("cc", "--cpu-profile=mini.toml", "-c", "fib.c")
+	checkCalls(t, e, "clang -target riscv32-unknown-elf -march=rv32i -mabi=ilp32 -Oz -ffreestanding -fno-builtin "+
+		"-fno-unwind-tables -fno-asynchronous-unwind-tables -isystem rt -c fib.c")
+
+	e.mustRun("debug", "-t", "fib", "5")
+	checkCalls(t, e, "cahp-sim -t fib 5")
+}
+
+func TestCLIQueue(t *testing.T) {
+	e := newCLIEnv(t)
+	setupProgram(e)
+
+	e.mustRun("queue", "add", "-dir", "queue", "--cpu", "ruby", "-bkey", "bootstrapping.key", "-c", "10", "fib.enc")
+	e.mustRun("queue", "run", "-dir", "queue", "-j", "1", "-gpus", "0")
+	calls := e.calls()
+	if len(calls) != 1 || !strings.HasPrefix(calls[0], "iyokan tfhe --evalkey $DIR/bootstrapping.key -o $DIR/fib.result.enc -c 10 ") {
+		t.Errorf("calls = %q", calls)
+	}
+	if _, err := os.Stat(e.path("fib.result.enc")); err != nil {
+		t.Error(err)
+	}
+
+	// Canceling a running job stops its evaluator too.
+	e.setenv("KVSP_FAKE_HANG_AT", "0")
+	id := strings.TrimSpace(e.mustRun("queue", "add", "-dir", "queue", "--cpu", "ruby", "-bkey", "bootstrapping.key",
+		"-c", "10", "-i", "fib.enc", "-o", "canceled.enc"))
+	proc, wait := e.start("queue", "run", "-dir", "queue", "-j", "1", "-gpus", "0")
+	pid := waitForHang(e, proc, wait)
+	e.mustRun("queue", "cancel", "-dir", "queue", id)
+	if _, stderr, code := wait(); code != 0 {
+		t.Errorf("queue run exited with %d: %s", code, stderr)
+	}
+	if err := syscall.Kill(pid, 0); !errors.Is(err, syscall.ESRCH) {
+		t.Errorf("the evaluator %d of the canceled job is still there: %v", pid, err)
+	}
+
+	// Interrupting the queue stops the evaluator, and queues the job again.
+	e.mustRun("queue", "add", "-dir", "queue", "--cpu", "ruby", "-bkey", "bootstrapping.key",
+		"-c", "10", "-i", "fib.enc", "-o", "stopped.enc")
+	proc, wait = e.start("queue", "run", "-dir", "queue", "-j", "1", "-gpus", "0")
+	pid = waitForHang(e, proc, wait)
+	if err := proc.Signal(syscall.SIGINT); err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr, code := wait()
+	if code != 128+int(syscall.SIGINT) || !strings.Contains(stdout, "1 jobs were stopped and queued again") {
+		t.Errorf("queue run exited with %d:\n%s%s", code, stdout, stderr)
+	}
+	if err := syscall.Kill(pid, 0); !errors.Is(err, syscall.ESRCH) {
+		t.Errorf("the evaluator %d of the stopped job is still there: %v", pid, err)
+	}
+	e.setenv("KVSP_FAKE_HANG_AT", "100")
+	e.mustRun("queue", "run", "-dir", "queue", "-j", "1", "-gpus", "0")
+	if _, err := os.Stat(e.path("stopped.enc")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCLIDoctor(t *testing.T) {
+	e := newCLIEnv(t)
+	e.setenv("KVSP_FAKE_GPU", "1")
+
+	out, _, _ := e.run("doctor", "-format", "json")
+	checkCalls(t, e, "iyokan tfhe --help", "iyokan tfhe --help")
+	var d struct {
+		Backends []struct {
+			Name string          `json:"name"`
+			GPU  kvsp.GPUSupport `json:"gpu"`
+		} `json:"backends"`
+	}
+	if err := json.Unmarshal([]byte(out), &d); err != nil {
+		t.Fatalf("doctor -format json = %q: %v", out, err)
+	}
+	if len(d.Backends) != 2 || d.Backends[0].GPU != kvsp.GPUSupported || d.Backends[1].GPU != kvsp.GPUSupported {
+		t.Errorf("backends = %+v", d.Backends)
+	}
+}
+
+func TestCLIErrors(t *testing.T) {
+	e := newCLIEnv(t)
+	setupProgram(e)
+	e.mustRun("genkey", "-o", "other.key")
+	e.mustRun("genbkey", "-i", "other.key", "-o", "other-bootstrapping.key")
+	e.mustRun("run", "--cpu", "ruby", "-bkey", "bootstrapping.key", "-i", "fib.enc", "-o", "result.enc",
+		"-c", "10", "-snapshot", "fib.snapshot")
+	e.calls()
+
+	run := []string{"run", "--cpu", "ruby", "-bkey", "bootstrapping.key", "-i", "fib.enc", "-o", "failed.enc", "-c", "10"}
+	for _, tc := range []struct {
+		env   []string
+		args  []string
+		want  string
+		calls []string
+	}{
+		{nil, []string{"genkey"}, "Specify -o options properly", nil},
+		{nil, []string{"genbkey", "-o", "b.key"}, "Specify -i and -o options properly", nil},
+		{nil, []string{"enc", "-k", "secret.key", "-i", "fib"}, "Specify -k, -i, and -o options properly", nil},
+		{nil, []string{"dec", "-k", "secret.key"}, "Specify -k and -i options properly", nil},
+		{nil, []string{"run", "-bkey", "bootstrapping.key", "-i", "fib.enc", "-o", "r.enc"}, "Specify -c, -bkey, -i, and -o options properly", nil},
+		{nil, []string{"resume", "-i", "fib.snapshot"}, "Specify -c, -bkey, -i, and -o options properly", nil},
+		{nil, []string{"enc", "--backend", "nope", "-k", "secret.key", "-i", "fib", "-o", "x.enc"}, `unknown evaluator backend "nope"`, nil},
+		{nil, []string{"enc", "--cpu", "ruby", "--cahp-cpu", "pearl", "-k", "secret.key", "-i", "fib", "-o", "x.enc"}, "--cpu and --cahp-cpu specify different CPUs", nil},
+		{nil, []string{"enc", "--cpu", "alexandrite", "-k", "secret.key", "-i", "fib", "-o", "x.enc"}, "Invalid ELF", nil},
+		{nil, []string{"emu", "--cpu", "ruby", "-format", "yaml", "fib"}, `unknown output format "yaml"`, nil},
+		{nil, []string{"dec", "--cpu", "ruby", "-k", "other.key", "-i", "result.enc"}, "other.key", nil},
+		{nil, []string{"run", "--cpu", "ruby", "-bkey", "other-bootstrapping.key", "-i", "fib.enc", "-o", "r.enc", "-c", "10"}, "other-bootstrapping.key", nil},
+		{nil, []string{"resume", "-i", "fib.snapshot", "-c", "5", "-bkey", "other-bootstrapping.key"}, "Cannot resume from fib.snapshot", nil},
+		{
+			[]string{"KVSP_FAKE_FAIL=enc"},
+			[]string{"enc", "--cpu", "ruby", "-k", "secret.key", "-i", "fib", "-o", "x.enc"},
+			"exit status 1",
+			[]string{"iyokan-packet enc --key secret.key --in $TMP --out x.enc"},
+		},
+		{
+			[]string{"KVSP_FAKE_FAIL=plain"},
+			[]string{"emu", "--cpu", "ruby", "fib"},
+			"exit status 1",
+			[]string{"iyokan plain -i $TMP -o $TMP --blueprint $SHARE/cahp-ruby.toml"},
+		},
+		{
+			[]string{"KVSP_FAKE_FAIL=tfhe"},
+			append(run, "-snapshot", "failed.snapshot"),
+			"exit status 1",
+			[]string{"iyokan tfhe --evalkey bootstrapping.key -o failed.enc -c 10 --snapshot failed.snapshot " +
+				"-i fib.enc --blueprint $SHARE/cahp-ruby.toml"},
+		},
+	} {
+		sub := *e
+		sub.env = append(append([]string{}, e.env...), tc.env...)
+		_, stderr, code := sub.run(tc.args...)
+		if code == 0 || !strings.Contains(stderr, tc.want) {
+			t.Errorf("kvsp %s exited with %d: %q, want %q", strings.Join(tc.args, " "), code, stderr, tc.want)
+		}
+		checkCalls(t, e, tc.calls...)
+	}
+	for _, name := range []string{"x.enc", "failed.enc.kvsp.toml", "failed.snapshot.kvsp.toml"} {
+		if _, err := os.Stat(e.path(name)); err == nil {
+			t.Errorf("%s is left behind", name)
+		}
+	}
+}
+
+func TestCLILog(t *testing.T) {
+	e := newCLIEnv(t)
+	setupProgram(e)
+
+	e.mustRun("run", "--cpu", "ruby", "-bkey", "bootstrapping.key", "-i", "fib.enc", "-o", "result.enc",
+		"-c", "10", "-snapshot", "fib.snapshot", "-quiet", "--log-format", "json", "--log-file", "run.log")
+	e.setenv("KVSP_FAKE_FAIL", "dec")
+	e.run("dec", "--cpu", "ruby", "-k", "secret.key", "-i", "result.enc", "--log-format", "json", "--log-file", "run.log")
+
+	data, err := os.ReadFile(e.path("run.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	type record struct {
+		Level      string           `json:"level"`
+		Msg        string           `json:"msg"`
+		Command    string           `json:"command"`
+		Path       string           `json:"path"`
+		ExitStatus int              `json:"exit_status"`
+		Inputs     map[string]int64 `json:"inputs"`
+		Outputs    map[string]int64 `json:"outputs"`
+		Cycles     uint             `json:"cycles"`
+		PerSec     float64          `json:"cycles_per_sec"`
+		Seconds    *float64         `json:"seconds"`
+	}
+	var records []record
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var r record
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		if r.Seconds == nil {
+			t.Errorf("%q has no seconds", line)
+		}
+		records = append(records, r)
+	}
+	if len(records) != 4 {
+		t.Fatalf("log = %s", data)
+	}
+
+	exec, run := records[0], records[1]
+	if exec.Msg != "exec" || exec.Command != "run" || exec.Path != e.path("bin/iyokan") || exec.ExitStatus != 0 ||
+		exec.Inputs["fib.enc"] == 0 || exec.Outputs["result.enc"] == 0 || exec.Outputs["fib.snapshot"] == 0 {
+		t.Errorf("exec record = %+v", exec)
+	}
+	if run.Msg != "run" || run.Cycles != 10 || run.PerSec <= 0 {
+		t.Errorf("run record = %+v", run)
+	}
+	failed, decrypt := records[2], records[3]
+	if failed.Msg != "exec" || failed.Level != "ERROR" || failed.ExitStatus != 1 || failed.Path != e.path("bin/iyokan-packet") {
+		t.Errorf("failed exec record = %+v", failed)
+	}
+	if decrypt.Msg != "decrypt" || decrypt.Level != "ERROR" || decrypt.Command != "dec" {
+		t.Errorf("decrypt record = %+v", decrypt)
+	}
+}
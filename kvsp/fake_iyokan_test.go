@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kvsp/kvsp/pkg/kvsp"
+)
+
+/*
+	The CLI tests run this test binary as kvsp, and as fake iyokan,
+	iyokan-packet, clang and cahp-sim through symlinks named so, which the
+	KVSP_*_PATH variables point to. The fakes append their argv to
+	$KVSP_FAKE_LOG as a JSON array, and keep their "encrypted" files as plain
+	packets behind a header:
+
+		secret key         FAKE-SECRET-KEY and a random nonce
+		bootstrapping key  FAKE-EVAL-KEY and the nonce of the secret key
+		ciphertext         FAKE-CIPHERTEXT and a plain packet
+		snapshot           FAKE-SNAPSHOT and a plain packet
+
+	An encrypted run prints "#N" and then "\tdone. (1 us)" for each cycle
+	unless --quiet, or $KVSP_FAKE_CYCLE_LINE formatted with N if it is set.
+	One from $KVSP_FAKE_HANG_AT cycles or more writes its PID in iyokan.pid
+	and hangs until it is killed, as does the command named by
+	$KVSP_FAKE_HANG, e.g. "enc" or "plain".
+	A run ends with finflag set and reg_xN = N once $KVSP_FAKE_HALT_AT
+	cycles (default 0) have run, and the command named by $KVSP_FAKE_FAIL,
+	e.g. "enc" or "tfhe", fails.
+*/
+
+const (
+	fakeSecretKey  = "FAKE-SECRET-KEY\n"
+	fakeEvalKey    = "FAKE-EVAL-KEY\n"
+	fakeCiphertext = "FAKE-CIPHERTEXT\n"
+	fakeSnapshot   = "FAKE-SNAPSHOT\n"
+	// fakeEmuCycles is the number of cycles which plain mode takes.
+	fakeEmuCycles = 42
+)
+
+// fakeTools maps the fakes to the variables which point KVSP to them.
+var fakeTools = map[string][]string{
+	"iyokan":        {"KVSP_IYOKAN_PATH", "KVSP_TANGOR_IYOKAN_PATH"},
+	"iyokan-packet": {"KVSP_IYOKAN_PACKET_PATH", "KVSP_TANGOR_IYOKAN_PACKET_PATH"},
+	"clang":         {"KVSP_CLANG_PATH"},
+	"cahp-sim":      {"KVSP_CAHP_SIM_PATH"},
+}
+
+func TestMain(m *testing.M) {
+	if name := filepath.Base(os.Args[0]); len(fakeTools[name]) > 0 {
+		os.Exit(runFakeTool(name, os.Args[1:]))
+	}
+	if os.Getenv("KVSP_TEST_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func runFakeTool(name string, args []string) int {
+	if logFileName := os.Getenv("KVSP_FAKE_LOG"); logFileName != "" {
+		line, _ := json.Marshal(append([]string{name}, args...))
+		f, err := os.OpenFile(logFileName, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		f.Write(append(line, '\n'))
+		f.Close()
+	}
+
+	var err error
+	switch {
+	case len(args) > 0 && args[0] == os.Getenv("KVSP_FAKE_HANG"):
+		err = fakeHang()
+	case name == "iyokan":
+		err = fakeIyokan(args)
+	case name == "iyokan-packet":
+		err = fakeIyokanPacket(args)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fake %s: %v\n", name, err)
+		return 1
+	}
+	return 0
+}
+
+// fakeOptions parses --name value and --name pairs of args.
+func fakeOptions(args []string) map[string]string {
+	opts := map[string]string{}
+	for i := 0; i < len(args); i++ {
+		if !strings.HasPrefix(args[i], "-") {
+			continue
+		}
+		if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+			opts[args[i]] = args[i+1]
+			i++
+		} else {
+			opts[args[i]] = ""
+		}
+	}
+	return opts
+}
+
+func fakeIyokanPacket(args []string) error {
+	if len(args) == 0 {
+		return errors.New("no command")
+	}
+	if args[0] == os.Getenv("KVSP_FAKE_FAIL") {
+		return errors.New("injected failure")
+	}
+	opts := fakeOptions(args[1:])
+	switch args[0] {
+	case "genkey":
+		if opts["--type"] != "tfhepp" {
+			return fmt.Errorf("unknown key type %q", opts["--type"])
+		}
+		// Make every key differ so that kvsp can tell them apart.
+		nonce := make([]byte, 16)
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+		return os.WriteFile(opts["--out"], []byte(fmt.Sprintf("%s%x\n", fakeSecretKey, nonce)), 0600)
+	case "genevalkey":
+		key, err := readFakeFile(opts["--in"], fakeSecretKey)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(opts["--out"], append([]byte(fakeEvalKey), key...), 0644)
+	case "enc":
+		if _, err := readFakeFile(opts["--key"], fakeSecretKey); err != nil {
+			return err
+		}
+		pkt, err := kvsp.ReadPlainPacketFile(opts["--in"])
+		if err != nil {
+			return err
+		}
+		return writeFakePacket(opts["--out"], fakeCiphertext, pkt)
+	case "dec":
+		if _, err := readFakeFile(opts["--key"], fakeSecretKey); err != nil {
+			return err
+		}
+		pkt, err := readFakePacket(opts["--in"], fakeCiphertext)
+		if err != nil {
+			return err
+		}
+		return kvsp.WritePlainPacketFile(opts["--out"], pkt)
+	}
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+// fakeTFHEHelp is the help of iyokan tfhe in the layout of CLI11, which
+// Iyokan parses its options with, and fakeTFHEGPUHelp is the rest of it
+// printed by a build with GPU support.
+const (
+	fakeTFHEHelp = `Usage: iyokan tfhe [OPTIONS]
+
+Options:
+  -h,--help                   Print this help message and exit
+  --blueprint TEXT            
+  -i,--in TEXT                
+  -o,--out TEXT               
+  -c UINT                     
+  --evalkey TEXT              
+  --snapshot TEXT             
+  --resume TEXT               
+  --quiet                     
+`
+	fakeTFHEGPUHelp = `  --enable-gpu                
+  --gpu_num UINT              
+`
+)
+
+func fakeIyokan(args []string) error {
+	if len(args) == 0 {
+		return errors.New("no command")
+	}
+	if len(args) == 2 && args[0] == "tfhe" && args[1] == "--help" {
+		fmt.Print(fakeTFHEHelp)
+		if os.Getenv("KVSP_FAKE_GPU") == "1" {
+			fmt.Print(fakeTFHEGPUHelp)
+		}
+		return nil
+	}
+	if args[0] == os.Getenv("KVSP_FAKE_FAIL") {
+		return errors.New("injected failure")
+	}
+	opts := fakeOptions(args[1:])
+	switch args[0] {
+	case "plain":
+		pkt, err := kvsp.ReadPlainPacketFile(opts["-i"])
+		if err != nil {
+			return err
+		}
+		if err := fakeRun(pkt, opts["--blueprint"], fakeEmuCycles, 0); err != nil {
+			return err
+		}
+		return kvsp.WritePlainPacketFile(opts["-o"], pkt)
+	case "tfhe":
+		if _, err := readFakeFile(opts["--evalkey"], fakeEvalKey); err != nil {
+			return err
+		}
+		cycles, err := strconv.Atoi(opts["-c"])
+		if err != nil {
+			return fmt.Errorf("-c: %v", err)
+		}
+		haltAt, _ := strconv.Atoi(os.Getenv("KVSP_FAKE_HALT_AT"))
+		var pkt *kvsp.RawPlainPacket
+		if snapshot, ok := opts["--resume"]; ok {
+			pkt, err = readFakePacket(snapshot, fakeSnapshot)
+		} else {
+			pkt, err = readFakePacket(opts["-i"], fakeCiphertext)
+		}
+		if err != nil {
+			return err
+		}
+		done := 0
+		if pkt.NumCycles != nil {
+			done = *pkt.NumCycles
+		}
+		if hangAt, err := strconv.Atoi(os.Getenv("KVSP_FAKE_HANG_AT")); err == nil && done >= hangAt {
+			return fakeHang()
+		}
+		if _, quiet := opts["--quiet"]; !quiet {
+			// Iyokan counts the clocks of a resumed run on from the
+			// snapshot's.
+			fmt.Println("Iyokan starts.")
+			for i := 1; i <= cycles; i++ {
+				if format := os.Getenv("KVSP_FAKE_CYCLE_LINE"); format != "" {
+					fmt.Printf(format+"\n", done+i)
+					continue
+				}
+				// Iyokan flushes "#N" before it runs the clock.
+				fmt.Printf("#%d", done+i)
+				fmt.Printf("\tdone. (1 us)\n")
+			}
+		}
+		if err := fakeRun(pkt, opts["--blueprint"], cycles, haltAt); err != nil {
+			return err
+		}
+		if err := writeFakePacket(opts["-o"], fakeCiphertext, pkt); err != nil {
+			return err
+		}
+		return writeFakePacket(opts["--snapshot"], fakeSnapshot, pkt)
+	}
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+// fakeHang writes the PID of the fake in iyokan.pid and waits to be killed.
+func fakeHang() error {
+	if err := os.WriteFile("iyokan.pid", []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+		return err
+	}
+	time.Sleep(time.Minute)
+	return errors.New("not killed")
+}
+
+// fakeRun runs pkt for cycles more cycles. The registers are made from
+// blueprint, which only a run from the start has.
+func fakeRun(pkt *kvsp.RawPlainPacket, blueprint string, cycles, haltAt int) error {
+	if blueprint != "" {
+		bp, err := kvsp.LoadBlueprint(blueprint)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < bp.RegCount; i++ {
+			reg := make([]byte, bp.RegWidth/8)
+			reg[0] = byte(i)
+			pkt.Bits[fmt.Sprintf("reg_x%d", i)] = kvsp.PacketEntry{Size: bp.RegWidth, Bytes: reg}
+		}
+	}
+	total := cycles
+	if pkt.NumCycles != nil {
+		total += *pkt.NumCycles
+	}
+	pkt.NumCycles = &total
+	finflag := byte(0)
+	if total >= haltAt {
+		finflag = 1
+	}
+	pkt.Bits["finflag"] = kvsp.PacketEntry{Size: 1, Bytes: []byte{finflag}}
+	return nil
+}
+
+func readFakeFile(fileName, header string) ([]byte, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(data, []byte(header)) {
+		return nil, fmt.Errorf("%s is not a %q file", fileName, strings.TrimSpace(header))
+	}
+	return data[len(header):], nil
+}
+
+func readFakePacket(fileName, header string) (*kvsp.RawPlainPacket, error) {
+	data, err := readFakeFile(fileName, header)
+	if err != nil {
+		return nil, err
+	}
+	return kvsp.ReadPlainPacket(bytes.NewReader(data))
+}
+
+func writeFakePacket(fileName, header string, pkt *kvsp.RawPlainPacket) error {
+	var buf bytes.Buffer
+	buf.WriteString(header)
+	if err := kvsp.WritePlainPacket(&buf, pkt); err != nil {
+		return err
+	}
+	return os.WriteFile(fileName, buf.Bytes(), 0644)
+}
+
+// cliEnv runs kvsp commands in a temporary directory with the fake tools.
+type cliEnv struct {
+	t    *testing.T
+	self string
+	dir  string
+	env  []string
+	log  string
+	// share is the directory of the shipped CPU profiles and blueprints.
+	share string
+}
+
+func newCLIEnv(t *testing.T) *cliEnv {
+	t.Helper()
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	share, err := filepath.Abs("../share")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &cliEnv{t: t, self: self, dir: t.TempDir(), share: share}
+	e.log = filepath.Join(e.dir, "fake.log")
+
+	bin := filepath.Join(e.dir, "bin")
+	if err := os.Mkdir(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "KVSP_") {
+			e.env = append(e.env, kv)
+		}
+	}
+	for name, envNames := range fakeTools {
+		path := filepath.Join(bin, name)
+		if err := os.Symlink(self, path); err != nil {
+			t.Fatal(err)
+		}
+		for _, envName := range envNames {
+			e.env = append(e.env, envName+"="+path)
+		}
+	}
+	e.env = append(e.env,
+		"KVSP_TEST_MAIN=1",
+		"KVSP_FAKE_LOG="+e.log,
+		"KVSP_CPU_PROFILES_PATH="+filepath.Join(share, "cpus"),
+		"KVSP_TMPDIR="+filepath.Join(e.dir, "tmp"),
+	)
+	return e
+}
+
+// setenv sets the variable name of the later commands.
+func (e *cliEnv) setenv(name, value string) {
+	e.env = append(e.env, name+"="+value)
+}
+
+// path returns the absolute path of the file name in the directory.
+func (e *cliEnv) path(name string) string {
+	return filepath.Join(e.dir, name)
+}
+
+// run runs kvsp with args and returns its stdout, stderr, and exit status.
+func (e *cliEnv) run(args ...string) (string, string, int) {
+	e.t.Helper()
+	_, wait := e.start(args...)
+	return wait()
+}
+
+// start starts kvsp with args, and returns its process and the function
+// which waits for it and returns what run does.
+func (e *cliEnv) start(args ...string) (*os.Process, func() (string, string, int)) {
+	e.t.Helper()
+	cmd := exec.Command(e.self, args...)
+	cmd.Dir = e.dir
+	cmd.Env = e.env
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		e.t.Fatal(err)
+	}
+	return cmd.Process, func() (string, string, int) {
+		e.t.Helper()
+		err := cmd.Wait()
+		var exitErr *exec.ExitError
+		if err != nil && !errors.As(err, &exitErr) {
+			e.t.Fatal(err)
+		}
+		return stdout.String(), stderr.String(), cmd.ProcessState.ExitCode()
+	}
+}
+
+// mustRun runs kvsp with args, fails the test unless it succeeds, and
+// returns its stdout.
+func (e *cliEnv) mustRun(args ...string) string {
+	e.t.Helper()
+	stdout, stderr, code := e.run(args...)
+	if code != 0 {
+		e.t.Fatalf("kvsp %s exited with %d:\n%s%s", strings.Join(args, " "), code, stdout, stderr)
+	}
+	return stdout
+}
+
+var fakeTempFileRegexp = regexp.MustCompile(`\$DIR/tmp/kvsp-[^/ ]+/[^/ ]+`)
+
+// calls returns the commands the fake tools have run since the last call,
+// each joined by spaces. Paths in the directory start with $DIR, the
+// temporary files are $TMP, and the shipped files start with $SHARE.
+func (e *cliEnv) calls() []string {
+	e.t.Helper()
+	data, err := os.ReadFile(e.log)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		e.t.Fatal(err)
+	}
+	os.Remove(e.log)
+	var calls []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if line == "" {
+			continue
+		}
+		var argv []string
+		if err := json.Unmarshal([]byte(line), &argv); err != nil {
+			e.t.Fatal(err)
+		}
+		call := strings.Join(argv, " ")
+		call = strings.ReplaceAll(call, e.dir, "$DIR")
+		call = strings.ReplaceAll(call, e.share, "$SHARE")
+		calls = append(calls, fakeTempFileRegexp.ReplaceAllString(call, "$$TMP"))
+	}
+	return calls
+}
+
+// writeProgram writes a CAHP executable for ruby with ROM and RAM segments
+// into the directory as name.
+func (e *cliEnv) writeProgram(name string) {
+	e.t.Helper()
+	segs := []struct {
+		addr uint32
+		data []byte
+	}{
+		{0, []byte{0x01, 0x02, 0x03, 0x04}},
+		{kvsp.RAMBaseAddr, []byte{0x05, 0x06}},
+	}
+	var data bytes.Buffer
+	var progs []elf.Prog32
+	for _, seg := range segs {
+		progs = append(progs, elf.Prog32{
+			Type:   uint32(elf.PT_LOAD),
+			Off:    uint32(52 + 32*len(segs) + data.Len()),
+			Vaddr:  seg.addr,
+			Paddr:  seg.addr,
+			Filesz: uint32(len(seg.data)),
+			Memsz:  uint32(len(seg.data)),
+			Flags:  uint32(elf.PF_R),
+		})
+		data.Write(seg.data)
+	}
+	hdr := elf.Header32{
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(elf.EM_NONE),
+		Version:   uint32(elf.EV_CURRENT),
+		Phoff:     52,
+		Ehsize:    52,
+		Phentsize: 32,
+		Phnum:     uint16(len(segs)),
+		Shentsize: 40,
+	}
+	copy(hdr.Ident[:], elf.ELFMAG)
+	hdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS32)
+	hdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	hdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, hdr)
+	binary.Write(&buf, binary.LittleEndian, progs)
+	buf.Write(data.Bytes())
+	if err := os.WriteFile(e.path(name), buf.Bytes(), 0644); err != nil {
+		e.t.Fatal(err)
+	}
+}
@@ -1,79 +1,30 @@
 package main
 
 import (
-	"debug/elf"
+	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	"github.com/BurntSushi/toml"
+	"github.com/kvsp/kvsp/pkg/kvsp"
 )
 
-var flagVerbose bool
-var evaluatorBackend = "tangor"
-
 const defaultCPU = "ruby"
-const ramBaseAddr = 0x10000
-
-type cpuProfile struct {
-	Name               string
-	RuntimeName        string
-	BlueprintName      string
-	ROMSize            uint64
-	RAMSize            uint64
-	PointerWidth       int
-	StackAlign         int
-	StackPointerOffset uint64
-	RegCount           int
-	RegWidth           int
-}
-
-var cpuProfiles = map[string]cpuProfile{
-	"ruby": {
-		Name:               "ruby",
-		RuntimeName:        "CAHP_RT",
-		BlueprintName:      "IYOKAN-BLUEPRINT-RUBY",
-		ROMSize:            512,
-		RAMSize:            512,
-		PointerWidth:       2,
-		StackAlign:         2,
-		StackPointerOffset: 512 - 2,
-		RegCount:           16,
-		RegWidth:           16,
-	},
-	"pearl": {
-		Name:               "pearl",
-		RuntimeName:        "CAHP_RT",
-		BlueprintName:      "IYOKAN-BLUEPRINT-PEARL",
-		ROMSize:            512,
-		RAMSize:            512,
-		PointerWidth:       2,
-		StackAlign:         2,
-		StackPointerOffset: 512 - 2,
-		RegCount:           16,
-		RegWidth:           16,
-	},
-	"alexandrite": {
-		Name:               "alexandrite",
-		RuntimeName:        "ALEXANDRITE_RT",
-		BlueprintName:      "IYOKAN-BLUEPRINT-ALEXANDRITE",
-		ROMSize:            4 * 1024,
-		RAMSize:            1024,
-		PointerWidth:       4,
-		StackAlign:         4,
-		StackPointerOffset: 8,
-		RegCount:           32,
-		RegWidth:           32,
-	},
-}
 
 // Flag for a list of values
 // Thanks to: https://stackoverflow.com/a/28323276
@@ -88,59 +39,443 @@ func (i *arrayFlags) Set(value string) error {
 	return nil
 }
 
-func getCPUProfile(name string) (cpuProfile, error) {
-	name = strings.ToLower(name)
-	profile, ok := cpuProfiles[name]
-	if !ok {
-		return cpuProfile{}, fmt.Errorf("unknown CPU %q", name)
-	}
-	return profile, nil
+// cpuFlags holds the flags that select the CPU.
+type cpuFlags struct {
+	name, cahpName, profileFile *string
 }
 
-func resolveCPU(cpuName, cahpCPUName string) (cpuProfile, error) {
+func resolveCPU(cpuName, cahpCPUName, profileFileName string) (kvsp.CPUProfile, error) {
 	cpuName = strings.ToLower(cpuName)
 	cahpCPUName = strings.ToLower(cahpCPUName)
 
 	if cpuName != "" && cahpCPUName != "" && cpuName != cahpCPUName {
-		return cpuProfile{}, errors.New("--cpu and --cahp-cpu specify different CPUs")
+		return kvsp.CPUProfile{}, errors.New("--cpu and --cahp-cpu specify different CPUs")
 	}
 	if cpuName == "" {
 		cpuName = cahpCPUName
 	}
+
+	if cahpCPUName != "" && cahpCPUName != "ruby" && cahpCPUName != "pearl" {
+		return kvsp.CPUProfile{}, errors.New("--cahp-cpu accepts only ruby or pearl")
+	}
+
+	if profileFileName != "" {
+		profile, err := kvsp.LoadCPUProfile(profileFileName)
+		if err != nil {
+			return kvsp.CPUProfile{}, err
+		}
+		if cpuName != "" && cpuName != profile.Name {
+			return kvsp.CPUProfile{}, fmt.Errorf("--cpu %s does not match CPU %q of --cpu-profile", cpuName, profile.Name)
+		}
+		return profile, nil
+	}
+
 	if cpuName == "" {
 		cpuName = defaultCPU
 	}
+	return kvsp.GetCPUProfile(cpuName)
+}
 
-	if cahpCPUName != "" && cahpCPUName != "ruby" && cahpCPUName != "pearl" {
-		return cpuProfile{}, errors.New("--cahp-cpu accepts only ruby or pearl")
+func addCPUFlags(fs *flag.FlagSet) cpuFlags {
+	return cpuFlags{
+		name:        fs.String("cpu", "", "CPU target: ruby, pearl, alexandrite, or another profile in share/kvsp/cpus"),
+		cahpName:    fs.String("cahp-cpu", "", "Compatibility alias for --cpu ruby|pearl"),
+		profileFile: fs.String("cpu-profile", "", "CPU profile file to use instead of a named CPU"),
 	}
+}
 
-	return getCPUProfile(cpuName)
+func (f cpuFlags) resolve() (kvsp.CPUProfile, error) {
+	return resolveCPU(*f.name, *f.cahpName, *f.profileFile)
 }
 
-func addCPUFlags(fs *flag.FlagSet) (*string, *string) {
-	cpuName := fs.String("cpu", "", "CPU target: ruby, pearl, or alexandrite")
-	cahpCPUName := fs.String("cahp-cpu", "", "Compatibility alias for --cpu ruby|pearl")
-	return cpuName, cahpCPUName
+// cliFlags holds the names of the flags given on the command line of each
+// flag set parsed by parseFlags, as opposed to those set by the
+// configuration.
+var cliFlags = map[*flag.FlagSet]map[string]bool{}
+
+// flagWasSet reports whether the flag name was given on the command line.
+func flagWasSet(fs *flag.FlagSet, name string) bool {
+	if set, ok := cliFlags[fs]; ok {
+		return set[name]
+	}
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
 }
 
-func addBackendFlag(fs *flag.FlagSet) *string {
-	return fs.String("backend", "tangor", "Evaluator backend: tangor or iyokan")
+// keyFlags tells which flags of each command take the secret key or the
+// bootstrapping key of a key set.
+var keyFlags = map[string]map[string]string{
+	"dec":            {"k": "secret"},
+	"enc":            {"k": "secret"},
+	"enc-batch":      {"k": "secret"},
+	"estimate":       {"bkey": "bootstrapping"},
+	"genbkey":        {"i": "secret", "o": "bootstrapping"},
+	"genkey":         {"o": "secret"},
+	"key rewrap":     {"i": "secret"},
+	"queue add":      {"bkey": "bootstrapping"},
+	"resume":         {"bkey": "bootstrapping"},
+	"run":            {"bkey": "bootstrapping"},
+	"run-until-done": {"k": "secret", "bkey": "bootstrapping"},
+	"submit":         {"bkey": "bootstrapping"},
+}
+
+// programInputs tells which commands take their program by -i, and which by
+// the first argument.
+var programInputs = map[string]string{
+	"emu":            "arg",
+	"enc":            "i",
+	"enc-batch":      "i",
+	"estimate":       "arg",
+	"queue add":      "i",
+	"resume":         "snapshot",
+	"run":            "i",
+	"run-until-done": "i",
+	"submit":         "i",
 }
 
-func selectBackend(name string) error {
-	switch strings.ToLower(name) {
-	case "iyokan", "tangor":
-		evaluatorBackend = strings.ToLower(name)
+// parseFlags parses args by fs, and then sets the flags which are not given
+// from the configuration: --config, $KVSP_CONFIG, or ./kvsp.toml if it
+// exists. The more specific values win: those of the program, of the
+// command, of the key set, and the defaults. It also sets up the run log.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	var (
+		configFileName = fs.String("config", "", "Configuration file (default $KVSP_CONFIG or ./"+kvsp.ConfigFile+" if it exists)")
+		keySetName     = fs.String("keys", "", "Key set in the configuration to use")
+		programName    = fs.String("program", "", "Program whose settings in the configuration to use (default the name of the input)")
+		logFormat      = fs.String("log-format", "", "Format of the run log: text or json (default text if --log-file is given)")
+		logFileName    = fs.String("log-file", "", "File to append the run log to (- for the standard error)")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	cliFlags[fs] = set
+
+	if err := loadConfig(fs, *configFileName, *keySetName, *programName); err != nil {
+		return err
+	}
+	return setupLog(fs.Name(), *logFormat, *logFileName)
+}
+
+// loadConfig applies the configuration file fileName, or the default one,
+// to fs.
+func loadConfig(fs *flag.FlagSet, fileName, keySetName, programName string) error {
+	if fileName == "" {
+		fileName = os.Getenv("KVSP_CONFIG")
+	}
+	if fileName == "" {
+		if _, err := os.Stat(kvsp.ConfigFile); err != nil {
+			if keySetName != "" || programName != "" {
+				return errors.New("Specify --config to use --keys or --program")
+			}
+			return nil
+		}
+		fileName = kvsp.ConfigFile
+	}
+	config, err := kvsp.LoadConfig(fileName)
+	if err != nil {
+		return err
+	}
+	if err := applyConfig(fs, config, keySetName, programName); err != nil {
+		return fmt.Errorf("%s: %v", fileName, err)
+	}
+	return nil
+}
+
+// logArgs are the flags which give the run log of this kvsp to the kvsp
+// processes it runs.
+var logArgs []string
+
+// setupLog makes kvsp.Logger write the run log of command in format to the
+// file fileName. Nothing is logged if neither is given.
+func setupLog(command, format, fileName string) error {
+	if format == "" && fileName == "" {
 		return nil
+	}
+	var w io.Writer = os.Stderr
+	if fileName != "" && fileName != "-" {
+		var err error
+		if fileName, err = filepath.Abs(fileName); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		w = f
+	}
+	var handler slog.Handler
+	switch format {
+	case "", "text":
+		handler = slog.NewTextHandler(w, nil)
+	case "json":
+		handler = slog.NewJSONHandler(w, nil)
 	default:
-		return fmt.Errorf("unknown evaluator backend %q (expected iyokan or tangor)", name)
+		return fmt.Errorf("unknown log format %q (expected text or json)", format)
+	}
+	kvsp.Logger = slog.New(handler).With("kvsp", kvsp.Version, "command", command, "pid", os.Getpid())
+	logArgs = []string{"--log-format", format, "--log-file", fileName}
+	return nil
+}
+
+// applyConfig sets the flags of fs which are not given on the command line
+// from config.
+func applyConfig(fs *flag.FlagSet, config *kvsp.Config, keySetName, programName string) error {
+	command := fs.Name()
+	if _, ok := config.Commands[command]; !ok && strings.Contains(command, " ") {
+		// Allow [commands.queue.add] as well as [commands."queue add"].
+		parent := strings.SplitN(command, " ", 2)
+		if sub, ok := config.Commands[parent[0]][parent[1]].(map[string]interface{}); ok {
+			config.Commands[command] = sub
+		}
+	}
+	commandValues := config.Commands[command]
+
+	// Lower layers first; the later ones overwrite them.
+	values := map[string]interface{}{}
+	for name, value := range config.Defaults {
+		if fs.Lookup(name) != nil {
+			values[name] = value
+		}
+	}
+
+	if keySetName == "" {
+		keySetName, _ = config.Defaults["keys"].(string)
+		if name, ok := commandValues["keys"].(string); ok {
+			keySetName = name
+		}
+	}
+	if keySetName != "" {
+		keys, ok := config.Keys[keySetName]
+		if !ok {
+			return fmt.Errorf("no key set %q", keySetName)
+		}
+		for name, role := range keyFlags[command] {
+			path := keys.Secret
+			if role == "bootstrapping" {
+				path = keys.Bootstrapping
+			}
+			if path != "" && fs.Lookup(name) != nil {
+				values[name] = path
+			}
+		}
+	}
+
+	for name, value := range commandValues {
+		if _, isTable := value.(map[string]interface{}); isTable {
+			continue // A subcommand's.
+		}
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("%s has no flag -%s", command, name)
+		}
+		values[name] = value
+	}
+
+	if programName == "" {
+		programName = inputProgram(fs)
+	}
+	for name, value := range config.Programs[programName] {
+		// "cycles" is the cycle budget: -c, or -max of run-until-done.
+		if name == "cycles" {
+			if fs.Lookup("c") != nil {
+				name = "c"
+			} else {
+				name = "max"
+			}
+		}
+		if fs.Lookup(name) != nil {
+			values[name] = value
+		}
+	}
+
+	for name, value := range values {
+		if flagWasSet(fs, name) || name == "config" || name == "keys" || name == "program" {
+			continue
+		}
+		if group := exclusiveFlags[name]; group != nil && anyFlagWasSet(fs, group) {
+			continue
+		}
+		if err := setFlag(fs, name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exclusiveFlags maps each flag to the group of flags of which only one may
+// be given; the configuration does not set any of them if one is given.
+var exclusiveFlags = map[string][]string{
+	"cpu":         {"cpu", "cahp-cpu", "cpu-profile"},
+	"cahp-cpu":    {"cpu", "cahp-cpu", "cpu-profile"},
+	"cpu-profile": {"cpu", "cahp-cpu", "cpu-profile"},
+}
+
+func anyFlagWasSet(fs *flag.FlagSet, names []string) bool {
+	for _, name := range names {
+		if flagWasSet(fs, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// inputProgram returns the name of the program which fs is given, or "" if
+// unknown.
+func inputProgram(fs *flag.FlagSet) string {
+	input := ""
+	if f := fs.Lookup("i"); f != nil {
+		input = f.Value.String()
+	}
+	switch programInputs[fs.Name()] {
+	case "i":
+		if input != "" {
+			return kvsp.ProgramName(input)
+		}
+		if fs.NArg() > 0 { // queue add INPUT...
+			return kvsp.ProgramName(fs.Arg(0))
+		}
+	case "arg":
+		if fs.NArg() > 0 {
+			return kvsp.ProgramName(fs.Arg(0))
+		}
+	case "snapshot":
+		info, err := kvsp.ReadSnapshotInfo(input)
+		if err == nil && info.Input != "" {
+			return kvsp.ProgramName(info.Input)
+		}
+	}
+	return ""
+}
+
+// setFlag sets the flag name to value from the configuration. An array sets
+// a flag which may be repeated, such as --iyokan-args, once for each value.
+func setFlag(fs *flag.FlagSet, name string, value interface{}) error {
+	values, ok := value.([]interface{})
+	if !ok {
+		values = []interface{}{value}
+	}
+	for _, v := range values {
+		if err := fs.Set(name, fmt.Sprint(v)); err != nil {
+			return fmt.Errorf("invalid value %v for -%s: %v", v, name, err)
+		}
+	}
+	return nil
+}
+
+// addWorkDirFlags adds the flags for commands which write plaintext temporary
+// files.
+func addWorkDirFlags(fs *flag.FlagSet) {
+	fs.StringVar(&kvsp.WorkDir, "workdir", "", "Directory to make the private working directory in (default $KVSP_TMPDIR or the system's)")
+	fs.BoolVar(&kvsp.Shred, "shred", false, "Overwrite plaintext temporary files with zeros before removing them")
+}
+
+func addBackendFlag(fs *flag.FlagSet) *string {
+	return fs.String("backend", kvsp.DefaultBackend,
+		"Evaluator backend: "+strings.Join(kvsp.BackendNames(), " or "))
+}
+
+func selectBackend(name string) (kvsp.Backend, error) {
+	return kvsp.LookupBackend(name)
+}
+
+func addFormatFlag(fs *flag.FlagSet) *string {
+	return fs.String("format", "text", "Output format: text or json")
+}
+
+// varFlags holds the flags that select C globals to print.
+type varFlags struct {
+	elfFileName *string
+	vars        arrayFlags
+}
+
+func addVarFlags(fs *flag.FlagSet) *varFlags {
+	f := &varFlags{
+		elfFileName: fs.String("elf", "", "ELF file to read the symbols of --var from"),
 	}
+	fs.Var(&f.vars, "var", "C global to print as NAME[:COUNT][:TYPE] (TYPE: int, i8, u8, i16, u16, i32, u32, or str)")
+	return f
 }
 
-func stripCompilerCPUArgs(args []string) (cpuProfile, []string, error) {
+// read decodes the variables in f from pkt. defaultELF is used if --elf is
+// not specified.
+func (f *varFlags) read(pkt *kvsp.PlainPacket, defaultELF string, profile kvsp.CPUProfile) error {
+	if len(f.vars) == 0 {
+		return nil
+	}
+	elfFileName := *f.elfFileName
+	if elfFileName == "" {
+		elfFileName = defaultELF
+	}
+	if elfFileName == "" {
+		return errors.New("Specify --elf to use --var")
+	}
+	specs := make([]kvsp.VarSpec, 0, len(f.vars))
+	for _, src := range f.vars {
+		spec, err := kvsp.ParseVarSpec(src)
+		if err != nil {
+			return err
+		}
+		specs = append(specs, spec)
+	}
+	return pkt.ReadVariables(elfFileName, specs, profile)
+}
+
+// exitCodeNotFinished is kvsp's exit status under --exit-code when the
+// program has not finished, i.e. finflag is false. A program can return it
+// too, since every exit status is, so kvsp also says so on stderr.
+const exitCodeNotFinished = 125
+
+// exitCodeError makes main exit with code without printing anything.
+type exitCodeError struct {
+	code int
+}
+
+func (e *exitCodeError) Error() string {
+	return fmt.Sprintf("exit status %d", e.code)
+}
+
+func addExitCodeFlag(fs *flag.FlagSet) *bool {
+	return fs.Bool("exit-code", false, fmt.Sprintf(
+		"Exit with the program's return value, or %d if it has not finished, which is also said on stderr",
+		exitCodeNotFinished))
+}
+
+// programExit returns the error that makes kvsp exit as the program did.
+func programExit(pkt *kvsp.PlainPacket, profile kvsp.CPUProfile) error {
+	if !pkt.Flags["finflag"] {
+		fmt.Fprintf(os.Stderr, "The program has not finished in %d cycles.\n", pkt.NumCycles)
+		return &exitCodeError{exitCodeNotFinished}
+	}
+	if code := pkt.ExitValue(profile) & 0xff; code != 0 {
+		return &exitCodeError{code}
+	}
+	return nil
+}
+
+func checkFormat(format string) error {
+	if format != "text" && format != "json" {
+		return fmt.Errorf("unknown output format %q (expected text or json)", format)
+	}
+	return nil
+}
+
+func printPacket(pkt *kvsp.PlainPacket, profile kvsp.CPUProfile, format string) error {
+	if format == "json" {
+		return pkt.PrintJSON(os.Stdout, profile)
+	}
+	return pkt.Print(os.Stdout, profile)
+}
+
+func stripCompilerCPUArgs(args []string) (kvsp.CPUProfile, []string, error) {
 	cpuName := ""
 	cahpCPUName := ""
+	profileFileName := ""
 	out := make([]string, 0, len(args))
 
 	for i := 0; i < len(args); i++ {
@@ -148,7 +483,7 @@ func stripCompilerCPUArgs(args []string) (cpuProfile, []string, error) {
 		switch {
 		case arg == "--cpu":
 			if i+1 >= len(args) {
-				return cpuProfile{}, nil, errors.New("--cpu requires a value")
+				return kvsp.CPUProfile{}, nil, errors.New("--cpu requires a value")
 			}
 			i++
 			cpuName = args[i]
@@ -156,883 +491,1488 @@ func stripCompilerCPUArgs(args []string) (cpuProfile, []string, error) {
 			cpuName = strings.TrimPrefix(arg, "--cpu=")
 		case arg == "--cahp-cpu":
 			if i+1 >= len(args) {
-				return cpuProfile{}, nil, errors.New("--cahp-cpu requires a value")
+				return kvsp.CPUProfile{}, nil, errors.New("--cahp-cpu requires a value")
 			}
 			i++
 			cahpCPUName = args[i]
 		case strings.HasPrefix(arg, "--cahp-cpu="):
 			cahpCPUName = strings.TrimPrefix(arg, "--cahp-cpu=")
+		case arg == "--cpu-profile":
+			if i+1 >= len(args) {
+				return kvsp.CPUProfile{}, nil, errors.New("--cpu-profile requires a value")
+			}
+			i++
+			profileFileName = args[i]
+		case strings.HasPrefix(arg, "--cpu-profile="):
+			profileFileName = strings.TrimPrefix(arg, "--cpu-profile=")
 		default:
 			out = append(out, arg)
 		}
 	}
 
-	profile, err := resolveCPU(cpuName, cahpCPUName)
+	profile, err := resolveCPU(cpuName, cahpCPUName, profileFileName)
 	return profile, out, err
 }
 
-func isCompileOnly(args []string) bool {
-	for _, arg := range args {
-		if arg == "-c" || arg == "-S" || arg == "-E" {
-			return true
-		}
+func doCC() error {
+	profile, userArgs, err := stripCompilerCPUArgs(os.Args[2:])
+	if err != nil {
+		return err
 	}
-	return false
-}
 
-func writeLE(out []byte, val uint64) {
-	for i := range out {
-		out[i] = byte((val >> (8 * i)) & 0xff)
-	}
+	return kvsp.Compile(profile, userArgs)
 }
 
-func fileExists(path string) bool {
-	_, err := os.Stat(path)
-	return err == nil
+func doDebug() error {
+	return kvsp.Debug(os.Args[2:])
 }
 
-func getExecDir() (string, error) {
-	execPath, err := os.Executable()
+func doDoctor() error {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	format := addFormatFlag(fs)
+	err := parseFlags(fs, os.Args[2:])
 	if err != nil {
-		return "", err
+		return err
+	}
+	if err := checkFormat(*format); err != nil {
+		return err
 	}
-	return filepath.Dir(execPath), nil
-}
 
-func prefixExecDir(path string) (string, error) {
-	execPath, err := getExecDir()
+	d := kvsp.Diagnose()
+	if *format == "json" {
+		err = d.PrintJSON(os.Stdout)
+	} else {
+		err = d.Print(os.Stdout)
+	}
 	if err != nil {
-		return "", err
+		return err
+	}
+	if len(d.Problems) > 0 {
+		return &exitCodeError{1}
 	}
-	return filepath.Join(execPath, path), nil
+	return nil
 }
 
-func getPathOf(name string) (string, error) {
-	path := ""
-	relative := true
-
-	// Check if environment variable is set in KVSP_XXX.
-	if path = os.Getenv("KVSP_" + strings.Replace(name, "-", "_", -1) + "_PATH"); path != "" {
-		relative = false
-	} else {
-		/*
-			Do heuristic approach, which assumes binaries are in the current
-			(this executable's) directory, and others are in ../share/kvsp.
-		*/
-		switch name {
-		case "ALEXANDRITE_RT":
-			path = "../share/kvsp/alexandrite-rt"
-		case "CAHP_RT":
-			path = "../share/kvsp/cahp-rt"
-		case "CAHP_SIM":
-			path = "cahp-sim"
-		case "CLANG":
-			path = "clang"
-		case "IYOKAN":
-			if evaluatorBackend == "tangor" {
-				path = "tangor-iyokan"
-			} else {
-				path = "iyokan"
-			}
-		case "IYOKAN-BLUEPRINT-RUBY":
-			path = "../share/kvsp/cahp-ruby.toml"
-		case "IYOKAN-BLUEPRINT-PEARL":
-			path = "../share/kvsp/cahp-pearl.toml"
-		case "IYOKAN-BLUEPRINT-ALEXANDRITE":
-			path = "../share/kvsp/alexandrite.toml"
-		case "IYOKAN-PACKET":
-			if evaluatorBackend == "tangor" {
-				path = "tangor-iyokan-packet"
-			} else {
-				path = "iyokan-packet"
-			}
-		default:
-			return "", errors.New("Invalid name")
-		}
+func doEmu() error {
+	// Parse command-line arguments.
+	fs := flag.NewFlagSet("emu", flag.ExitOnError)
+	var (
+		iyokanArgs arrayFlags
+	)
+	cpu := addCPUFlags(fs)
+	backend := addBackendFlag(fs)
+	format := addFormatFlag(fs)
+	vars := addVarFlags(fs)
+	exitCode := addExitCodeFlag(fs)
+	fs.Var(&iyokanArgs, "iyokan-args", "Raw arguments for Iyokan")
+	addWorkDirFlags(fs)
+	err := parseFlags(fs, os.Args[2:])
+	if err != nil {
+		return err
 	}
-
-	if relative {
-		newPath, err := prefixExecDir(path)
-		if err != nil {
-			return "", err
-		}
-		path = newPath
-	}
-
-	if !fileExists(path) {
-		// The AVX2 Tangor build uses suffixed binary names. Prefer the
-		// release/AVX512 names above, then transparently use this portable build.
-		if relative && evaluatorBackend == "tangor" {
-			var fallback string
-			switch name {
-			case "IYOKAN":
-				fallback = "tangor-iyokan-avx2"
-			case "IYOKAN-PACKET":
-				fallback = "tangor-iyokan-packet-avx2"
-			}
-			if fallback != "" {
-				fallbackPath, err := prefixExecDir(fallback)
-				if err != nil {
-					return "", err
-				}
-				if fileExists(fallbackPath) {
-					return fallbackPath, nil
-				}
-			}
-		}
-		return "", fmt.Errorf("%s not found at %s", name, path)
+	b, err := selectBackend(*backend)
+	if err != nil {
+		return err
+	}
+	profile, err := cpu.resolve()
+	if err != nil {
+		return err
+	}
+	if err := checkFormat(*format); err != nil {
+		return err
 	}
 
-	return path, nil
+	pkt, err := kvsp.Emulate(signalCtx, b, fs.Args()[0], fs.Args()[1:], profile, iyokanArgs)
+	if err != nil {
+		return err
+	}
+	if err := vars.read(pkt, fs.Args()[0], profile); err != nil {
+		return err
+	}
+	if err := printPacket(pkt, profile, *format); err != nil {
+		return err
+	}
+	if *exitCode {
+		return programExit(pkt, profile)
+	}
+	return nil
 }
 
-// Parse the input as ELF and get ROM and RAM images.
-func parseELF(fileName string, romSize, ramSize uint64) ([]byte, []byte, error) {
-	input, err := elf.Open(fileName)
+func doEstimate() error {
+	// Parse command-line arguments.
+	fs := flag.NewFlagSet("estimate", flag.ExitOnError)
+	var (
+		margin         = fs.Float64("margin", 10, "Safety margin added to the number of cycles, in percent")
+		gatesPerSec    = fs.Float64("gates-per-sec", 0, "Gate throughput of the backend (Unspecify or set 0 to use share/kvsp/throughput.toml)")
+		printCommand   = fs.Bool("print-command", false, "Print only the kvsp run command line to use")
+		bkeyFileName   = fs.String("bkey", "bootstrapping.key", "Bootstrapping key file name for --print-command")
+		inputFileName  = fs.String("i", "", "Input file name (encrypted) for --print-command (default PROG.enc)")
+		outputFileName = fs.String("o", "result.enc", "Output file name (encrypted) for --print-command")
+		iyokanArgs     arrayFlags
+	)
+	cpu := addCPUFlags(fs)
+	backend := addBackendFlag(fs)
+	format := addFormatFlag(fs)
+	fs.Var(&iyokanArgs, "iyokan-args", "Raw arguments for Iyokan")
+	addWorkDirFlags(fs)
+	err := parseFlags(fs, os.Args[2:])
+	if err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("Specify the program to estimate")
+	}
+	b, err := selectBackend(*backend)
+	if err != nil {
+		return err
+	}
+	profile, err := cpu.resolve()
 	if err != nil {
-		return nil, nil, err
+		return err
+	}
+	if err := checkFormat(*format); err != nil {
+		return err
 	}
 
-	rom := make([]byte, romSize)
-	ram := make([]byte, ramSize)
+	pkt, err := kvsp.Emulate(signalCtx, b, fs.Args()[0], fs.Args()[1:], profile, iyokanArgs)
+	if err != nil {
+		return err
+	}
+	est, err := kvsp.NewEstimate(pkt, *margin)
+	if err != nil {
+		return err
+	}
 
-	for _, prog := range input.Progs {
-		if prog.ProgHeader.Type != elf.PT_LOAD {
-			continue
+	if *printCommand {
+		input := *inputFileName
+		if input == "" {
+			input = fs.Args()[0] + ".enc"
 		}
-		addr := prog.ProgHeader.Vaddr
-		size := prog.ProgHeader.Filesz
-		if size == 0 {
-			continue
+		cpuArgs := "--cpu " + profile.Name
+		if *cpu.profileFile != "" {
+			cpuArgs = "--cpu-profile " + *cpu.profileFile
 		}
+		fmt.Printf("%s run %s --backend %s -bkey %s -i %s -o %s -c %d\n",
+			os.Args[0], cpuArgs, b.Name(), *bkeyFileName, input, *outputFileName, est.RunCycles)
+		return nil
+	}
 
-		var mem []byte
-		if addr < ramBaseAddr { // ROM
-			if addr+size > romSize {
-				return nil, nil, errors.New("Invalid ROM size: too small")
-			}
-			mem = rom[addr : addr+size]
-		} else { // RAM
-			if addr-ramBaseAddr+size > ramSize {
-				return nil, nil, errors.New("Invalid RAM size: too small")
-			}
-			mem = ram[addr-ramBaseAddr : addr-ramBaseAddr+size]
-		}
+	// The time is a bonus; the cycle count is still worth printing without it.
+	if err := fillEstimateTime(&est, b, profile, *gatesPerSec); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: cannot estimate the time: %v\n", err)
+	}
+	return printEstimate(est, *format)
+}
 
-		reader := prog.Open()
-		if _, err := io.ReadFull(reader, mem); err != nil {
-			return nil, nil, err
+// fillEstimateTime sets the gate count of est, which calibrating the
+// throughput needs, and then its throughput, from the table unless given.
+func fillEstimateTime(est *kvsp.Estimate, b kvsp.Backend, profile kvsp.CPUProfile, gatesPerSec float64) error {
+	gates, err := kvsp.CountGates(profile)
+	if err != nil {
+		return err
+	}
+	est.Gates = gates
+	if gatesPerSec == 0 {
+		fileName, err := kvsp.ThroughputFile()
+		if err != nil {
+			return err
+		}
+		gatesPerSec, err = kvsp.LoadGateThroughput(fileName, b.Name())
+		if err != nil {
+			return err
 		}
 	}
-
-	return rom, ram, nil
+	est.GatesPerSec = gatesPerSec
+	return nil
 }
 
-func attachCommandLineOptions(ram []byte, cmdOptsSrc []string, profile cpuProfile) error {
-	// N1548 5.1.2.2.1 2
-	// the string pointed to by argv[0]
-	// represents the program name; argv[0][0] shall be the null character if the
-	// program name is not available from the host environment.
-	cmdOpts := []string{""}
-	cmdOpts = append(cmdOpts, cmdOptsSrc...)
-	argc := len(cmdOpts)
-
-	// Slice for *argv.
-	sargv := []int{
-		// N1548 5.1.2.2.1 2
-		// argv[argc] shall be a null pointer.
-		0,
+func printEstimate(est kvsp.Estimate, format string) error {
+	if format == "json" {
+		return est.PrintJSON(os.Stdout)
 	}
+	return est.Print(os.Stdout)
+}
 
-	ramSize := len(ram)
-	stackTop := ramSize
-	if profile.StackPointerOffset+uint64(profile.PointerWidth) == uint64(ramSize) {
-		stackTop = int(profile.StackPointerOffset)
+func doDec() error {
+	// Parse command-line arguments.
+	fs := flag.NewFlagSet("dec", flag.ExitOnError)
+	var (
+		keyFileName   = fs.String("k", "", "Key file name")
+		inputFileName = fs.String("i", "", "Input file name (encrypted)")
+	)
+	cpu := addCPUFlags(fs)
+	backend := addBackendFlag(fs)
+	format := addFormatFlag(fs)
+	vars := addVarFlags(fs)
+	exitCode := addExitCodeFlag(fs)
+	addWorkDirFlags(fs)
+	err := parseFlags(fs, os.Args[2:])
+	if err != nil {
+		return err
 	}
-	index := stackTop
-
-	// Set **argv to RAM
-	for i := len(cmdOpts) - 1; i >= 0; i-- {
-		opt := append([]byte(cmdOpts[i]), 0)
-		for j := len(opt) - 1; j >= 0; j-- {
-			index--
-			if index < 0 {
-				return errors.New("Invalid RAM size: command line arguments do not fit")
-			}
-			ram[index] = opt[j]
-		}
-		sargv = append(sargv, index)
-	}
-	// Align index
-	index -= index % profile.StackAlign
-	if index < 0 {
-		return errors.New("Invalid RAM size: command line arguments do not fit")
-	}
-	// Set *argv to RAM
-	for _, val := range sargv {
-		index -= profile.PointerWidth
-		if index < 0 {
-			return errors.New("Invalid RAM size: command line arguments do not fit")
-		}
-		writeLE(ram[index:index+profile.PointerWidth], uint64(val))
+	b, err := selectBackend(*backend)
+	if err != nil {
+		return err
 	}
-	// Save argc in RAM
-	index -= profile.PointerWidth
-	if index < 0 {
-		return errors.New("Invalid RAM size: command line arguments do not fit")
+	profile, err := cpu.resolve()
+	if err != nil {
+		return err
 	}
-	writeLE(ram[index:index+profile.PointerWidth], uint64(argc))
-	// Save initial stack pointer in RAM
-	initSP := index
-	if profile.StackPointerOffset+uint64(profile.PointerWidth) > uint64(len(ram)) {
-		return errors.New("Invalid CPU profile: stack pointer slot is outside RAM")
+	if err := checkFormat(*format); err != nil {
+		return err
+	}
+	if *keyFileName == "" || *inputFileName == "" {
+		return errors.New("Specify -k and -i options properly")
 	}
-	spOffset := int(profile.StackPointerOffset)
-	writeLE(ram[spOffset:spOffset+profile.PointerWidth], uint64(initSP))
 
+	pkt, err := kvsp.Decrypt(signalCtx, b, *keyFileName, *inputFileName, profile)
+	if err != nil {
+		return err
+	}
+	if err := vars.read(pkt, "", profile); err != nil {
+		return err
+	}
+	if err := printPacket(pkt, profile, *format); err != nil {
+		return err
+	}
+	if *exitCode {
+		return programExit(pkt, profile)
+	}
 	return nil
 }
 
-func execCmdImpl(name string, args []string) *exec.Cmd {
-	if flagVerbose {
-		fmtArgs := make([]string, len(args))
-		for i, arg := range args {
-			fmtArgs[i] = fmt.Sprintf("'%s'", arg)
-		}
-		fmt.Fprintf(os.Stderr, "exec: '%s' %s\n", name, strings.Join(fmtArgs, " "))
+func doEnc() error {
+	// Parse command-line arguments.
+	fs := flag.NewFlagSet("enc", flag.ExitOnError)
+	var (
+		keyFileName    = fs.String("k", "", "Secret key file name")
+		inputFileName  = fs.String("i", "", "Input file name (plain)")
+		outputFileName = fs.String("o", "", "Output file name (encrypted)")
+	)
+	cpu := addCPUFlags(fs)
+	backend := addBackendFlag(fs)
+	addWorkDirFlags(fs)
+	err := parseFlags(fs, os.Args[2:])
+	if err != nil {
+		return err
+	}
+	b, err := selectBackend(*backend)
+	if err != nil {
+		return err
+	}
+	profile, err := cpu.resolve()
+	if err != nil {
+		return err
+	}
+	if *keyFileName == "" || *inputFileName == "" || *outputFileName == "" {
+		return errors.New("Specify -k, -i, and -o options properly")
 	}
 
-	cmd := exec.Command(name, args...)
-	cmd.Stderr = os.Stderr
-	return cmd
-}
-
-func execCmd(name string, args []string) error {
-	cmd := execCmdImpl(name, args)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	return cmd.Run()
+	return kvsp.Encrypt(signalCtx, b, *keyFileName, *inputFileName, *outputFileName, fs.Args(), profile)
 }
 
-func outCmd(name string, args []string) (string, error) {
-	out, err := execCmdImpl(name, args).Output()
-	return string(out), err
-}
+func doEncBatch() error {
+	// Parse command-line arguments.
+	fs := flag.NewFlagSet("enc-batch", flag.ExitOnError)
+	var (
+		keyFileName   = fs.String("k", "", "Secret key file name")
+		inputFileName = fs.String("i", "", "Input file name (plain)")
+		argsFileName  = fs.String("args-file", "", "File of the command-line arguments, one set in each line (- for the standard input)")
+		outputDirName = fs.String("o", "", "Output directory of the encrypted packets")
+		numWorkers    = fs.Int("j", runtime.NumCPU(), "Number of packets to encrypt at once")
+	)
+	cpu := addCPUFlags(fs)
+	backend := addBackendFlag(fs)
+	addWorkDirFlags(fs)
+	err := parseFlags(fs, os.Args[2:])
+	if err != nil {
+		return err
+	}
+	b, err := selectBackend(*backend)
+	if err != nil {
+		return err
+	}
+	profile, err := cpu.resolve()
+	if err != nil {
+		return err
+	}
+	if *keyFileName == "" || *inputFileName == "" || *argsFileName == "" || *outputDirName == "" {
+		return errors.New("Specify -k, -i, --args-file, and -o options properly")
+	}
 
-func runIyokanPacket(args ...string) (string, error) {
-	// Get the path of iyokan-packet
-	path, err := getPathOf("IYOKAN-PACKET")
+	argsFile := os.Stdin
+	if *argsFileName != "-" {
+		if argsFile, err = os.Open(*argsFileName); err != nil {
+			return err
+		}
+		defer argsFile.Close()
+	}
+	argSets, err := kvsp.ReadArgsLines(argsFile)
 	if err != nil {
-		return "", err
+		return fmt.Errorf("%s: %v", *argsFileName, err)
+	}
+	if err := os.MkdirAll(*outputDirName, 0755); err != nil {
+		return err
 	}
 
-	// Run
-	return outCmd(path, args)
+	// Name the packets 0001.enc, 0002.enc, ... in the order of the lines.
+	digits := len(fmt.Sprint(len(argSets)))
+	if digits < 4 {
+		digits = 4
+	}
+	items := make([]kvsp.EncryptBatchItem, len(argSets))
+	for i, args := range argSets {
+		items[i] = kvsp.EncryptBatchItem{
+			Args:   args,
+			Output: filepath.Join(*outputDirName, fmt.Sprintf("%0*d.enc", digits, i+1)),
+		}
+	}
+	err = kvsp.EncryptBatch(signalCtx, b, *keyFileName, *inputFileName, items, profile, *numWorkers)
+	for _, item := range items {
+		fmt.Printf("%s\t%s\n", item.Output, strings.Join(item.Args, " "))
+	}
+	return err
 }
 
-func runIyokan(args0 []string, args1 []string) error {
-	iyokanPath, err := getPathOf("IYOKAN")
+func doGenkey() error {
+	// Parse command-line arguments.
+	fs := flag.NewFlagSet("genkey", flag.ExitOnError)
+	var (
+		outputFileName = fs.String("o", "", "Output file name")
+		protect        = fs.Bool("protect", false, "Protect the key with a passphrase (from $KVSP_KEY_PASSPHRASE or the terminal)")
+	)
+	backend := addBackendFlag(fs)
+	addWorkDirFlags(fs)
+	err := parseFlags(fs, os.Args[2:])
 	if err != nil {
 		return err
 	}
+	b, err := selectBackend(*backend)
+	if err != nil {
+		return err
+	}
+	if *outputFileName == "" {
+		return errors.New("Specify -o options properly")
+	}
 
-	// Run iyokan
-	args := append(args0, args1...)
-	return execCmd(iyokanPath, args)
+	if *protect {
+		return kvsp.GenProtectedKey(signalCtx, b, *outputFileName)
+	}
+	return kvsp.GenKey(signalCtx, b, *outputFileName)
 }
 
-func packELF(
-	inputFileName, outputFileName string,
-	cmdOpts []string,
-	profile cpuProfile,
-) error {
-	if !fileExists(inputFileName) {
-		return errors.New("File not found")
+func doKey() error {
+	if len(os.Args) < 3 || os.Args[2] != "rewrap" {
+		return errors.New("Usage: kvsp key rewrap [OPTIONS]...")
 	}
-	rom, ram, err := parseELF(inputFileName, profile.ROMSize, profile.RAMSize)
+
+	fs := flag.NewFlagSet("key rewrap", flag.ExitOnError)
+	var (
+		inputFileName  = fs.String("i", "", "Secret key file name")
+		outputFileName = fs.String("o", "", "Output file name (Unspecify to overwrite the input)")
+		remove         = fs.Bool("remove", false, "Remove the passphrase instead of setting a new one")
+	)
+	addWorkDirFlags(fs)
+	err := parseFlags(fs, os.Args[3:])
 	if err != nil {
 		return err
 	}
-	if err = attachCommandLineOptions(ram, cmdOpts, profile); err != nil {
-		return err
+	if *inputFileName == "" {
+		return errors.New("Specify -i options properly")
 	}
-
-	args := []string{
-		"pack",
-		"--out", outputFileName,
+	if *outputFileName == "" {
+		*outputFileName = *inputFileName
 	}
 
-	// Write ROM data
-	romTmpFile, err := ioutil.TempFile("", "")
+	return kvsp.RewrapKey(signalCtx, *inputFileName, *outputFileName, !*remove)
+}
+
+func doGenbkey() error {
+	// Parse command-line arguments.
+	fs := flag.NewFlagSet("genbkey", flag.ExitOnError)
+	var (
+		inputFileName  = fs.String("i", "", "Input file name (secret key)")
+		outputFileName = fs.String("o", "", "Output file name (bootstrapping key)")
+	)
+	backend := addBackendFlag(fs)
+	addWorkDirFlags(fs)
+	err := parseFlags(fs, os.Args[2:])
 	if err != nil {
 		return err
 	}
-	defer os.Remove(romTmpFile.Name())
-	if _, err = romTmpFile.Write(rom); err != nil {
+	b, err := selectBackend(*backend)
+	if err != nil {
 		return err
 	}
-	args = append(args, "--rom", "rom:"+romTmpFile.Name())
+	if *inputFileName == "" || *outputFileName == "" {
+		return errors.New("Specify -i and -o options properly")
+	}
+
+	return kvsp.GenBootstrappingKey(signalCtx, b, *inputFileName, *outputFileName)
+}
 
-	// Write RAM data
-	ramTmpFile, err := ioutil.TempFile("", "")
+func doPlainpacket() error {
+	// Parse command-line arguments.
+	fs := flag.NewFlagSet("plainpacket", flag.ExitOnError)
+	var (
+		inputFileName  = fs.String("i", "", "Input file name (plain)")
+		outputFileName = fs.String("o", "", "Output file name (encrypted)")
+	)
+	cpu := addCPUFlags(fs)
+	backend := addBackendFlag(fs)
+	err := parseFlags(fs, os.Args[2:])
 	if err != nil {
 		return err
 	}
-	defer os.Remove(ramTmpFile.Name())
-	if _, err = ramTmpFile.Write(ram); err != nil {
+	// Packing does not need the evaluator, but keep accepting --backend.
+	if _, err := selectBackend(*backend); err != nil {
 		return err
 	}
-	args = append(args, "--ram", "ram:"+ramTmpFile.Name())
-
-	// Pack
-	if _, err = runIyokanPacket(args...); err != nil {
+	profile, err := cpu.resolve()
+	if err != nil {
 		return err
 	}
+	if *inputFileName == "" || *outputFileName == "" {
+		return errors.New("Specify -i, and -o options properly")
+	}
 
-	return nil
+	return kvsp.Pack(*inputFileName, *outputFileName, fs.Args(), profile)
 }
 
-type plainPacketTOML struct {
-	NumCycles int                    `toml:"cycles"`
-	Ram       []plainPacketEntryTOML `toml:"ram"`
-	Bits      []plainPacketEntryTOML `toml:"bits"`
+// runFlags holds the flags shared by run and resume.
+type runFlags struct {
+	nClocks          *uint
+	bkeyFileName     *string
+	inputFileName    *string
+	outputFileName   *string
+	numGPU           *uint
+	snapshotFileName *string
+	quiet            *bool
+	iyokanArgs       arrayFlags
+	checkpointEvery  *uint
 }
-type plainPacketEntryTOML struct {
-	Name  string `toml:"name"`
-	Size  int    `toml:"size"`
-	Bytes []int  `toml:"bytes"`
+
+// addRunFlags adds the flags of run, or those of resume if resume.
+func addRunFlags(fs *flag.FlagSet, resume bool) *runFlags {
+	f := &runFlags{}
+	f.nClocks = fs.Uint("c", 0, "Number of clocks to run")
+	f.bkeyFileName = fs.String("bkey", "", "Bootstrapping key file name")
+	if resume {
+		f.inputFileName = fs.String("i", "", "Snapshot file to resume from")
+	} else {
+		f.inputFileName = fs.String("i", "", "Input file name (encrypted)")
+	}
+	f.outputFileName = fs.String("o", "", "Output file name (encrypted)")
+	if !resume {
+		f.numGPU = fs.Uint("g", 0, "Number of GPUs (Unspecify or set 0 for CPU mode)")
+	}
+	f.snapshotFileName = fs.String("snapshot", "", "Snapshot file name to write in")
+	f.quiet = fs.Bool("quiet", false, "Be quiet")
+	fs.Var(&f.iyokanArgs, "iyokan-args", "Raw arguments for Iyokan")
+	f.checkpointEvery = fs.Uint("checkpoint-every", defaultCheckpointEvery, "Number of clocks to run between snapshots, which an interrupted run resumes from (Set 0 to run at once)")
+	return f
 }
-type plainPacket struct {
-	NumCycles int
-	Flags     map[string]bool
-	Regs      map[string]int
-	Ram       []int
+
+// options returns the run options given by the flags. The snapshot file
+// name is left empty if not given.
+func (f *runFlags) options() kvsp.RunOptions {
+	opts := kvsp.RunOptions{
+		Cycles:           *f.nClocks,
+		BootstrappingKey: *f.bkeyFileName,
+		Input:            *f.inputFileName,
+		Output:           *f.outputFileName,
+		Snapshot:         *f.snapshotFileName,
+		Quiet:            *f.quiet,
+		IyokanArgs:       f.iyokanArgs,
+		CheckpointEvery:  *f.checkpointEvery,
+	}
+	if f.numGPU != nil {
+		opts.NumGPU = *f.numGPU
+	}
+	return opts
 }
 
-func bytesToLE(bytes []int, bitWidth int) (int, error) {
-	byteWidth := bitWidth / 8
-	if bitWidth%8 != 0 || len(bytes) < byteWidth {
-		return 0, errors.New("Invalid TOML for result packet")
+// defaultCheckpointEvery is the default of -checkpoint-every. Each
+// checkpoint restarts the evaluator, which reads the bootstrapping key again,
+// so that it costs some seconds; an interruption loses at most this many
+// clocks.
+const defaultCheckpointEvery = 1000
+
+// runArgs returns the arguments of kvsp run, or kvsp resume if resume, which
+// give opts. It is the reverse of addRunFlags and options.
+func runArgs(opts kvsp.RunOptions, resume bool) []string {
+	args := []string{"-c", fmt.Sprint(opts.Cycles)}
+	for _, arg := range []struct{ name, value string }{
+		{"-i", opts.Input},
+		{"-o", opts.Output},
+		{"-bkey", opts.BootstrappingKey},
+		{"-snapshot", opts.Snapshot},
+	} {
+		if arg.value != "" {
+			args = append(args, arg.name, arg.value)
+		}
+	}
+	if !resume && opts.NumGPU > 0 {
+		args = append(args, "-g", fmt.Sprint(opts.NumGPU))
 	}
-	val := 0
-	for i := 0; i < byteWidth; i++ {
-		val |= bytes[i] << (8 * i)
+	if opts.Quiet {
+		args = append(args, "-quiet")
 	}
-	return val, nil
+	if opts.CheckpointEvery != defaultCheckpointEvery {
+		args = append(args, "-checkpoint-every", fmt.Sprint(opts.CheckpointEvery))
+	}
+	for _, arg := range opts.IyokanArgs {
+		args = append(args, "--iyokan-args", arg)
+	}
+	return args
 }
 
-func (pkt *plainPacket) loadTOML(src string, profile cpuProfile) error {
-	var pktTOML plainPacketTOML
-	if _, err := toml.Decode(src, &pktTOML); err != nil {
-		return err
+// progressFlags holds the flags which report the progress of an encrypted
+// run elsewhere than on the terminal.
+type progressFlags struct {
+	fileName *string
+	addr     *string
+}
+
+func addProgressFlags(fs *flag.FlagSet) *progressFlags {
+	return &progressFlags{
+		fileName: fs.String("progress-file", "", "File to keep the progress of the run in, as JSON"),
+		addr:     fs.String("progress-addr", "", "Address to serve the progress of the run on over HTTP, as JSON, e.g. localhost:8081"),
 	}
+}
 
-	pkt.NumCycles = pktTOML.NumCycles
+// progressReporter shows the progress of an encrypted run on the terminal,
+// keeps it in a file and serves it over HTTP.
+type progressReporter struct {
+	mu       sync.Mutex
+	progress kvsp.Progress
+	fileName string
+	// tty is whether to show the progress on stderr.
+	tty    bool
+	stopCh chan struct{}
+	server *http.Server
+}
 
-	// Load flags and registers
-	pkt.Flags = make(map[string]bool)
-	pkt.Regs = make(map[string]int)
-	for _, entry := range pktTOML.Bits {
-		if entry.Size == 1 { // flag
-			if len(entry.Bytes) < 1 {
-				return errors.New("Invalid TOML for result packet")
-			}
-			if entry.Bytes[0] != 0 {
-				pkt.Flags[entry.Name] = true
-			} else {
-				pkt.Flags[entry.Name] = false
-			}
-		} else if entry.Size == profile.RegWidth { // register
-			val, err := bytesToLE(entry.Bytes, entry.Size)
-			if err != nil {
-				return err
-			}
-			pkt.Regs[entry.Name] = val
-		} else {
-			return errors.New("Invalid TOML for result packet")
-		}
+// start sets opts.Progress to report the progress as the flags tell. The
+// progress is shown on stderr too if it is a terminal, unless opts.Quiet.
+// Call the returned function with the result of the run when it ends.
+func (f *progressFlags) start(opts *kvsp.RunOptions) (func(error), error) {
+	r := &progressReporter{
+		fileName: *f.fileName,
+		tty:      !opts.Quiet && isTerminal(os.Stderr),
+		stopCh:   make(chan struct{}),
 	}
-
-	// Load ram
-	mapRam := make(map[string]plainPacketEntryTOML)
-	for _, entry := range pktTOML.Ram {
-		if _, exists := mapRam[entry.Name]; exists {
-			return errors.New("Invalid TOML data: same entry name in ram")
+	if !r.tty && r.fileName == "" && *f.addr == "" {
+		return func(error) {}, nil
+	}
+	if r.fileName != "" {
+		fileName, err := filepath.Abs(r.fileName)
+		if err != nil {
+			return nil, err
 		}
-		mapRam[entry.Name] = entry
+		r.fileName = fileName
 	}
-	pkt.Ram = nil
-	if entry, ok := mapRam["ram"]; ok {
-		if entry.Size%8 != 0 {
-			return errors.New("Invalid RAM data: size is not multiple of 8")
+	if *f.addr != "" {
+		ln, err := net.Listen("tcp", *f.addr)
+		if err != nil {
+			return nil, err
 		}
-		pkt.Ram = make([]int, entry.Size/8)
-		for addr := range entry.Bytes {
-			pkt.Ram[addr] = entry.Bytes[addr]
+		r.server = &http.Server{Handler: r}
+		go r.server.Serve(ln)
+		if !opts.Quiet {
+			fmt.Fprintf(os.Stderr, "Serving the progress on http://%s/\n", ln.Addr())
 		}
-	} else {
-		return errors.New("Invalid TOML for result packet")
 	}
+	if r.tty {
+		go r.redraw()
+	}
+	opts.Progress = r.update
+	opts.Stdout = r
+	// The progress shown replaces the lines of the clocks.
+	opts.HideCycleLines = r.tty
+	return r.stop, nil
+}
 
-	// Check if the packet is correct
-	if _, ok := pkt.Flags["finflag"]; !ok {
-		return errors.New("Invalid TOML for result packet: 'finflag' not found")
+// Write writes the output of the evaluator to stdout above the progress.
+func (r *progressReporter) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.tty {
+		fmt.Fprint(os.Stderr, "\r\033[K")
 	}
-	for i := 0; i < profile.RegCount; i++ {
-		name := fmt.Sprintf("reg_x%d", i)
-		if _, ok := pkt.Regs[name]; !ok {
-			return errors.New("Invalid TOML for result packet: '" + name + "' not found")
+	n, err := os.Stdout.Write(p)
+	r.draw()
+	return n, err
+}
+
+func (r *progressReporter) update(p kvsp.Progress) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if p.Warning != "" && r.progress.Warning == "" {
+		if r.tty {
+			fmt.Fprint(os.Stderr, "\r\033[K")
 		}
+		fmt.Fprintf(os.Stderr, "Warning: %s.\n", p.Warning)
 	}
+	// Keep the warning of a chunk for the rest of the run.
+	if p.Warning == "" {
+		p.Warning = r.progress.Warning
+	}
+	r.progress = p
+	r.save()
+	r.draw()
+}
 
-	return nil
+// redraw draws the progress every second, so that the elapsed time and the
+// ETA go on between the clocks.
+func (r *progressReporter) redraw() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stopCh:
+			return
+		case <-ticker.C:
+			r.mu.Lock()
+			r.draw()
+			r.mu.Unlock()
+		}
+	}
 }
-func (pkt *plainPacket) print(w io.Writer, profile cpuProfile) error {
-	fmt.Fprintf(w, "#cycle\t%d\n", pkt.NumCycles)
-	fmt.Fprintf(w, "\n")
-	fmt.Fprintf(w, "f0\t%t\n", pkt.Flags["finflag"])
-	fmt.Fprintf(w, "\n")
-	for i := 0; i < profile.RegCount; i++ {
-		name := fmt.Sprintf("reg_x%d", i)
-		fmt.Fprintf(w, "x%d\t%d\n", i, pkt.Regs[name])
-	}
-	fmt.Fprintf(w, "\n")
-	fmt.Fprintf(w, "      \t 0  1  2  3  4  5  6  7  8  9  a  b  c  d  e  f")
-	for addr := 0; addr < len(pkt.Ram); addr++ {
-		if addr%16 == 0 {
-			fmt.Fprintf(w, "\n%06x\t", addr)
+
+func (r *progressReporter) draw() {
+	if !r.tty || r.progress.Start.IsZero() {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "\r\033[K%s", r.progress.Line(time.Now()))
+}
+
+// save writes the progress in the file atomically, so that readers never
+// see it half written.
+func (r *progressReporter) save() {
+	if r.fileName == "" {
+		return
+	}
+	data, err := json.Marshal(r.progress)
+	if err != nil {
+		return
+	}
+	tmpFileName := r.fileName + ".tmp"
+	if err := os.WriteFile(tmpFileName, append(data, '\n'), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not write the progress: %v\n", err)
+		return
+	}
+	os.Rename(tmpFileName, r.fileName)
+}
+
+func (r *progressReporter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.progress)
+}
+
+// stop reports the end of the run with err. Run and Resume report it by
+// themselves, but RunUntilDone does not.
+func (r *progressReporter) stop(err error) {
+	close(r.stopCh)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.progress.State == kvsp.JobRunning || r.progress.Start.IsZero() {
+		r.progress.Last = time.Now()
+		if r.progress.Start.IsZero() {
+			r.progress.Start = r.progress.Last
+		}
+		if err != nil {
+			r.progress.State = kvsp.JobFailed
+		} else {
+			r.progress.State = kvsp.JobDone
 		}
-		fmt.Fprintf(w, "%02x ", pkt.Ram[addr])
+		r.save()
+		r.draw()
+	}
+	if r.tty {
+		fmt.Fprintln(os.Stderr)
+	}
+	if r.server != nil {
+		r.server.Close()
+	}
+}
+
+// isTerminal returns whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	st, err := f.Stat()
+	return err == nil && st.Mode()&os.ModeCharDevice != 0
+}
+
+func doRun() error {
+	// Parse command-line arguments.
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	run := addRunFlags(fs, false)
+	progress := addProgressFlags(fs)
+	cpu := addCPUFlags(fs)
+	backend := addBackendFlag(fs)
+	err := parseFlags(fs, os.Args[2:])
+	if err != nil {
+		return err
+	}
+	b, err := selectBackend(*backend)
+	if err != nil {
+		return err
+	}
+	profile, err := cpu.resolve()
+	if err != nil {
+		return err
 	}
-	fmt.Fprintf(w, "\n")
 
+	opts := run.options()
+	if opts.Snapshot == "" {
+		opts.Snapshot = kvsp.DefaultSnapshotName()
+	}
+	stop, err := progress.start(&opts)
+	if err != nil {
+		return err
+	}
+	err = kvsp.Run(signalCtx, b, opts, profile)
+	stop(err)
+	if err != nil {
+		return checkInterrupted(opts, err)
+	}
+	printResumeHint(opts)
 	return nil
 }
 
-func doCC() error {
-	profile, userArgs, err := stripCompilerCPUArgs(os.Args[2:])
+func doResume() error {
+	// Parse command-line arguments.
+	fs := flag.NewFlagSet("resume", flag.ExitOnError)
+	run := addRunFlags(fs, true)
+	progress := addProgressFlags(fs)
+	backend := addBackendFlag(fs)
+	err := parseFlags(fs, os.Args[2:])
 	if err != nil {
 		return err
 	}
 
-	// Get the path of clang
-	path, err := getPathOf("CLANG")
-	if err != nil {
+	// Fill in what the snapshot's metadata knows. kvsp.Resume refuses a
+	// mismatched backend or bootstrapping key.
+	if info, err := kvsp.ReadSnapshotInfo(*run.inputFileName); err == nil {
+		if *run.bkeyFileName == "" {
+			*run.bkeyFileName = info.BootstrappingKey
+		}
+		if *run.outputFileName == "" {
+			*run.outputFileName = info.Output
+		}
+		if !flagWasSet(fs, "backend") {
+			*backend = info.Backend
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
 		return err
 	}
-
-	rtPath, err := getPathOf(profile.RuntimeName)
+	b, err := selectBackend(*backend)
 	if err != nil {
 		return err
 	}
 
-	var args []string
-	switch profile.Name {
-	case "ruby", "pearl":
-		args = []string{"-target", "cahp", "-mcpu=generic", "-Oz", "--sysroot", rtPath}
-		args = append(args, userArgs...)
-	case "alexandrite":
-		args = []string{
-			"-target", "riscv32-unknown-elf",
-			"-march=rv32i",
-			"-mabi=ilp32",
-			"-Oz",
-			"-ffreestanding",
-			"-fno-builtin",
-			"-fno-unwind-tables",
-			"-fno-asynchronous-unwind-tables",
-			"-isystem", rtPath,
-		}
-		if isCompileOnly(userArgs) {
-			args = append(args, userArgs...)
-		} else {
-			args = append(args,
-				"-fuse-ld=lld",
-				"-nostdlib",
-				filepath.Join(rtPath, "crt0.o"),
-			)
-			args = append(args, userArgs...)
-			args = append(args,
-				"-Wl,-T,"+filepath.Join(rtPath, "alexandrite.lds"),
-				"-L", rtPath,
-				"-lc",
-			)
-		}
-	default:
-		return errors.New("unreachable")
+	opts := run.options()
+	if opts.Snapshot == "" {
+		opts.Snapshot = kvsp.DefaultSnapshotName()
 	}
-	return execCmd(path, args)
-}
-
-func doDebug() error {
-	// Get the path of cahp-sim
-	path, err := getPathOf("CAHP_SIM")
+	stop, err := progress.start(&opts)
 	if err != nil {
 		return err
 	}
-
-	// Run
-	return execCmd(path, os.Args[2:])
+	err = kvsp.Resume(signalCtx, b, opts)
+	stop(err)
+	if err != nil {
+		return checkInterrupted(opts, err)
+	}
+	printResumeHint(opts)
+	return nil
 }
 
-func doEmu() error {
+func doRunUntilDone() error {
 	// Parse command-line arguments.
-	fs := flag.NewFlagSet("emu", flag.ExitOnError)
+	fs := flag.NewFlagSet("run-until-done", flag.ExitOnError)
 	var (
-		iyokanArgs arrayFlags
+		nChunk           = fs.Uint("chunk", 0, "Number of clocks to run between checks of the finish flag")
+		nMax             = fs.Uint("max", 0, "Maximum number of clocks to run in total")
+		keyFileName      = fs.String("k", "", "Secret key file name")
+		bkeyFileName     = fs.String("bkey", "", "Bootstrapping key file name")
+		inputFileName    = fs.String("i", "", "Input file name (encrypted)")
+		outputFileName   = fs.String("o", "", "Output file name (encrypted)")
+		numGPU           = fs.Uint("g", 0, "Number of GPUs (Unspecify or set 0 for CPU mode)")
+		snapshotFileName = fs.String("snapshot", "", "Snapshot file name to write in")
+		quiet            = fs.Bool("quiet", false, "Be quiet")
+		iyokanArgs       arrayFlags
 	)
-	cpuName, cahpCPUName := addCPUFlags(fs)
+	cpu := addCPUFlags(fs)
 	backend := addBackendFlag(fs)
 	fs.Var(&iyokanArgs, "iyokan-args", "Raw arguments for Iyokan")
-	err := fs.Parse(os.Args[2:])
+	progress := addProgressFlags(fs)
+	addWorkDirFlags(fs)
+	err := parseFlags(fs, os.Args[2:])
 	if err != nil {
 		return err
 	}
-	if err := selectBackend(*backend); err != nil {
-		return err
-	}
-	profile, err := resolveCPU(*cpuName, *cahpCPUName)
+	b, err := selectBackend(*backend)
 	if err != nil {
 		return err
 	}
-
-	// Create tmp file for packing
-	packedFile, err := ioutil.TempFile("", "")
+	profile, err := cpu.resolve()
 	if err != nil {
 		return err
 	}
-	defer os.Remove(packedFile.Name())
 
-	// Pack
-	err = packELF(fs.Args()[0], packedFile.Name(), fs.Args()[1:], profile)
+	opts := kvsp.RunUntilDoneOptions{
+		RunOptions: kvsp.RunOptions{
+			Cycles:           *nChunk,
+			BootstrappingKey: *bkeyFileName,
+			Input:            *inputFileName,
+			Output:           *outputFileName,
+			Snapshot:         *snapshotFileName,
+			NumGPU:           *numGPU,
+			Quiet:            *quiet,
+			IyokanArgs:       iyokanArgs,
+		},
+		SecretKey: *keyFileName,
+		MaxCycles: *nMax,
+	}
+	if opts.Snapshot == "" {
+		opts.Snapshot = kvsp.DefaultSnapshotName()
+	}
+	stop, err := progress.start(&opts.RunOptions)
 	if err != nil {
 		return err
 	}
-
-	// Create tmp file for the result
-	resTmpFile, err := ioutil.TempFile("", "")
+	cycles, finished, err := kvsp.RunUntilDone(signalCtx, b, opts, profile)
+	stop(err)
 	if err != nil {
-		return err
+		// Resume the rest in chunks as run-until-done did.
+		rest := opts.RunOptions
+		rest.Cycles = opts.MaxCycles
+		rest.CheckpointEvery = opts.Cycles
+		return checkInterrupted(rest, err)
+	}
+	if !finished {
+		printResumeHint(opts.RunOptions)
+		return fmt.Errorf("The program did not finish in %d cycles", cycles)
 	}
-	defer os.Remove(resTmpFile.Name())
+	if !opts.Quiet {
+		fmt.Printf("\nFinished within %d cycles. The result was written in '%s' and the snapshot in '%s'.\n",
+			cycles, opts.Output, opts.Snapshot)
+	}
+	return nil
+}
 
-	// Run Iyokan in plain mode
-	blueprint, err := getPathOf(profile.BlueprintName)
+func doServe() error {
+	// Parse command-line arguments.
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	var (
+		addr   = fs.String("addr", "localhost:8080", "Address to listen on")
+		dir    = fs.String("dir", "kvsp-server", "Directory to keep keys and jobs in")
+		numGPU = fs.Uint("g", 0, "Number of GPUs for each job (Unspecify or set 0 for CPU mode)")
+		token  = fs.String("token", os.Getenv("KVSP_SERVER_TOKEN"), "Token which clients must send (default $KVSP_SERVER_TOKEN)")
+	)
+	backend := addBackendFlag(fs)
+	err := parseFlags(fs, os.Args[2:])
 	if err != nil {
 		return err
 	}
-	err = runIyokan([]string{"plain", "-i", packedFile.Name(), "-o", resTmpFile.Name(), "--blueprint", blueprint}, iyokanArgs)
+	b, err := selectBackend(*backend)
 	if err != nil {
 		return err
 	}
 
-	// Unpack the result
-	result, err := runIyokanPacket("packet2toml", "--in", resTmpFile.Name())
-	if err != nil {
-		return err
+	// Report the jobs unless --log-file or --log-format says otherwise.
+	if kvsp.Logger == nil {
+		kvsp.Logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
 	}
 
-	// Parse and print the result
-	var pkt plainPacket
-	if err := pkt.loadTOML(result, profile); err != nil {
+	server, err := kvsp.NewServer(*dir, b)
+	if err != nil {
 		return err
 	}
-	pkt.print(os.Stdout, profile)
+	server.NumGPU = *numGPU
+	server.Token = *token
+
+	// Stop taking requests, and then stop the running job, when interrupted.
+	httpServer := &http.Server{Addr: *addr, Handler: server}
+	shutdown := make(chan struct{})
+	go func() {
+		<-signalCtx.Done()
+		httpServer.Shutdown(context.Background())
+		close(shutdown)
+	}()
+	log.Printf("Listening on %s", *addr)
+	err = httpServer.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		<-shutdown
+		err = nil
+	}
+	server.Close()
+	return err
+}
 
-	return nil
+// addClientFlags adds the flags to reach a kvsp server.
+func addClientFlags(fs *flag.FlagSet) *kvsp.Client {
+	c := &kvsp.Client{}
+	fs.StringVar(&c.URL, "server", os.Getenv("KVSP_SERVER"), "URL of the kvsp server (default $KVSP_SERVER)")
+	fs.StringVar(&c.Token, "token", os.Getenv("KVSP_SERVER_TOKEN"), "Token for the kvsp server (default $KVSP_SERVER_TOKEN)")
+	return c
 }
 
-func doDec() error {
+func doSubmit() error {
 	// Parse command-line arguments.
-	fs := flag.NewFlagSet("dec", flag.ExitOnError)
+	fs := flag.NewFlagSet("submit", flag.ExitOnError)
 	var (
-		keyFileName   = fs.String("k", "", "Key file name")
+		nClocks       = fs.Uint("c", 0, "Number of clocks to run")
+		bkeyFileName  = fs.String("bkey", "", "Bootstrapping key file name")
 		inputFileName = fs.String("i", "", "Input file name (encrypted)")
+		resumeJob     = fs.String("resume", "", "Job to resume from instead of -bkey and -i")
 	)
-	cpuName, cahpCPUName := addCPUFlags(fs)
-	backend := addBackendFlag(fs)
-	err := fs.Parse(os.Args[2:])
-	if err != nil {
-		return err
-	}
-	if err := selectBackend(*backend); err != nil {
-		return err
-	}
-	profile, err := resolveCPU(*cpuName, *cahpCPUName)
+	cpu := addCPUFlags(fs)
+	client := addClientFlags(fs)
+	err := parseFlags(fs, os.Args[2:])
 	if err != nil {
 		return err
 	}
-	if *keyFileName == "" || *inputFileName == "" {
-		return errors.New("Specify -k and -i options properly")
+	if client.URL == "" || *nClocks == 0 {
+		return errors.New("Specify -server and -c options properly")
 	}
 
-	// Create tmp file for decryption
-	packedFile, err := ioutil.TempFile("", "")
+	var job *kvsp.Job
+	if *resumeJob != "" {
+		job, err = client.SubmitResume(*resumeJob, *nClocks)
+	} else {
+		if *bkeyFileName == "" || *inputFileName == "" {
+			return errors.New("Specify -bkey and -i options properly")
+		}
+		// The server runs the job on its own profile of the same name.
+		var profile kvsp.CPUProfile
+		profile, err = cpu.resolve()
+		if err != nil {
+			return err
+		}
+		var keyID string
+		keyID, err = client.UploadKey(*bkeyFileName)
+		if err != nil {
+			return err
+		}
+		job, err = client.Submit(keyID, *inputFileName, *nClocks, profile.Name)
+	}
 	if err != nil {
 		return err
 	}
-	defer os.Remove(packedFile.Name())
+	fmt.Println(job.ID)
+	return nil
+}
 
-	// Decrypt
-	_, err = runIyokanPacket("dec",
-		"--key", *keyFileName,
-		"--in", *inputFileName,
-		"--out", packedFile.Name())
+func doStatus() error {
+	// Parse command-line arguments.
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	client := addClientFlags(fs)
+	format := addFormatFlag(fs)
+	err := parseFlags(fs, os.Args[2:])
 	if err != nil {
 		return err
 	}
-
-	// Unpack
-	result, err := runIyokanPacket("packet2toml", "--in", packedFile.Name())
-	if err != nil {
+	if client.URL == "" {
+		return errors.New("Specify -server options properly")
+	}
+	if err := checkFormat(*format); err != nil {
 		return err
 	}
 
-	// Parse and print the result
-	var pkt plainPacket
-	if err := pkt.loadTOML(result, profile); err != nil {
-		return err
+	var jobs []kvsp.Job
+	if fs.NArg() == 0 {
+		if jobs, err = client.Jobs(); err != nil {
+			return err
+		}
+	}
+	for _, id := range fs.Args() {
+		job, err := client.Job(id)
+		if err != nil {
+			return err
+		}
+		jobs = append(jobs, *job)
 	}
-	pkt.print(os.Stdout, profile)
 
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(jobs)
+	}
+	for _, job := range jobs {
+		fmt.Printf("%s\t%s\t%s\t%d", job.ID, job.State, job.CPU, job.Cycles)
+		if job.ResumeOf != "" {
+			fmt.Printf("\tresumes %s", job.ResumeOf)
+		}
+		if job.Error != "" {
+			fmt.Printf("\t%s", job.Error)
+		}
+		fmt.Println()
+	}
 	return nil
 }
 
-func doEnc() error {
+func doFetch() error {
 	// Parse command-line arguments.
-	fs := flag.NewFlagSet("enc", flag.ExitOnError)
+	fs := flag.NewFlagSet("fetch", flag.ExitOnError)
 	var (
-		keyFileName    = fs.String("k", "", "Secret key file name")
-		inputFileName  = fs.String("i", "", "Input file name (plain)")
-		outputFileName = fs.String("o", "", "Output file name (encrypted)")
+		outputFileName   = fs.String("o", "", "Output file name (encrypted)")
+		snapshotFileName = fs.String("snapshot", "", "Snapshot file name to write in (Unspecify not to download it)")
 	)
-	cpuName, cahpCPUName := addCPUFlags(fs)
-	backend := addBackendFlag(fs)
-	err := fs.Parse(os.Args[2:])
+	client := addClientFlags(fs)
+	err := parseFlags(fs, os.Args[2:])
 	if err != nil {
 		return err
 	}
-	if err := selectBackend(*backend); err != nil {
-		return err
+	if client.URL == "" || *outputFileName == "" || fs.NArg() != 1 {
+		return errors.New("Specify -server, -o, and a job properly")
+	}
+
+	return client.Fetch(fs.Arg(0), *outputFileName, *snapshotFileName)
+}
+
+func doSnapshot() error {
+	if len(os.Args) < 3 {
+		return errors.New("Usage: kvsp snapshot list|show|prune [OPTIONS]...")
 	}
-	profile, err := resolveCPU(*cpuName, *cahpCPUName)
+	switch os.Args[2] {
+	case "list":
+		return doSnapshotList()
+	case "show":
+		return doSnapshotShow()
+	case "prune":
+		return doSnapshotPrune()
+	}
+	return fmt.Errorf("unknown snapshot command %q (expected list, show, or prune)", os.Args[2])
+}
+
+func doSnapshotList() error {
+	fs := flag.NewFlagSet("snapshot list", flag.ExitOnError)
+	err := parseFlags(fs, os.Args[3:])
 	if err != nil {
 		return err
 	}
-	if *keyFileName == "" || *inputFileName == "" || *outputFileName == "" {
-		return errors.New("Specify -k, -i, and -o options properly")
+	dir := "."
+	if fs.NArg() > 0 {
+		dir = fs.Arg(0)
 	}
 
-	// Create tmp file for packing
-	packedFile, err := ioutil.TempFile("", "")
+	entries, err := kvsp.ListSnapshots(dir)
 	if err != nil {
 		return err
 	}
-	defer os.Remove(packedFile.Name())
+	for _, entry := range entries {
+		if entry.Info == nil {
+			fmt.Printf("%s\t-\t-\t-\t%s\n", entry.Path, entry.ModTime.Format(time.RFC3339))
+			continue
+		}
+		fmt.Printf("%s\t%d\t%s\t%s\t%s\n", entry.Path, entry.Info.Cycles,
+			entry.Info.CPU, entry.Info.Backend, entry.Info.Created.Format(time.RFC3339))
+	}
+	return nil
+}
 
-	// Pack
-	err = packELF(*inputFileName, packedFile.Name(), fs.Args(), profile)
+func doSnapshotShow() error {
+	fs := flag.NewFlagSet("snapshot show", flag.ExitOnError)
+	err := parseFlags(fs, os.Args[3:])
 	if err != nil {
 		return err
 	}
+	if fs.NArg() != 1 {
+		return errors.New("Specify a snapshot file")
+	}
 
-	// Encrypt
-	_, err = runIyokanPacket("enc",
-		"--key", *keyFileName,
-		"--in", packedFile.Name(),
-		"--out", *outputFileName)
-	return err
+	info, err := kvsp.ReadSnapshotInfo(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	return info.Print(os.Stdout)
 }
 
-func doGenkey() error {
-	// Parse command-line arguments.
-	fs := flag.NewFlagSet("genkey", flag.ExitOnError)
+func doSnapshotPrune() error {
+	fs := flag.NewFlagSet("snapshot prune", flag.ExitOnError)
 	var (
-		outputFileName = fs.String("o", "", "Output file name")
+		keep   = fs.Int("keep", 1, "Number of the newest snapshots of each run to keep")
+		dryRun = fs.Bool("n", false, "Only print what would be removed")
 	)
-	backend := addBackendFlag(fs)
-	err := fs.Parse(os.Args[2:])
+	err := parseFlags(fs, os.Args[3:])
 	if err != nil {
 		return err
 	}
-	if err := selectBackend(*backend); err != nil {
-		return err
+	if *keep < 0 {
+		return fmt.Errorf("Invalid -keep: %d", *keep)
 	}
-	if *outputFileName == "" {
-		return errors.New("Specify -o options properly")
+	dir := "."
+	if fs.NArg() > 0 {
+		dir = fs.Arg(0)
 	}
 
-	_, err = runIyokanPacket("genkey",
-		"--type", "tfhepp",
-		"--out", *outputFileName)
+	removed, err := kvsp.PruneSnapshots(dir, *keep, *dryRun)
+	for _, path := range removed {
+		fmt.Println(path)
+	}
 	return err
 }
 
-func doGenbkey() error {
+func doQueue() error {
+	if len(os.Args) < 3 {
+		return errors.New("Usage: kvsp queue add|list|run|cancel [OPTIONS]...")
+	}
+	switch os.Args[2] {
+	case "add":
+		return doQueueAdd()
+	case "list":
+		return doQueueList()
+	case "run":
+		return doQueueRun()
+	case "cancel":
+		return doQueueCancel()
+	}
+	return fmt.Errorf("unknown queue command %q (expected add, list, run, or cancel)", os.Args[2])
+}
+
+func addQueueDirFlag(fs *flag.FlagSet) *string {
+	dir := os.Getenv("KVSP_QUEUE")
+	if dir == "" {
+		dir = "kvsp-queue"
+	}
+	return fs.String("dir", dir, "Directory of the job queue (default $KVSP_QUEUE or kvsp-queue)")
+}
+
+func doQueueAdd() error {
 	// Parse command-line arguments.
-	fs := flag.NewFlagSet("genbkey", flag.ExitOnError)
-	var (
-		inputFileName  = fs.String("i", "", "Input file name (secret key)")
-		outputFileName = fs.String("o", "", "Output file name (bootstrapping key)")
-	)
+	fs := flag.NewFlagSet("queue add", flag.ExitOnError)
+	dir := addQueueDirFlag(fs)
+	run := addRunFlags(fs, false)
+	nChunk := fs.Uint("chunk", 0, "Number of clocks to run between snapshots (Unspecify or set 0 to run at once)")
+	cpu := addCPUFlags(fs)
 	backend := addBackendFlag(fs)
-	err := fs.Parse(os.Args[2:])
+	err := parseFlags(fs, os.Args[3:])
 	if err != nil {
 		return err
 	}
-	if err := selectBackend(*backend); err != nil {
+	if flagWasSet(fs, "snapshot") || flagWasSet(fs, "quiet") {
+		return errors.New("The queue keeps the snapshots and logs of jobs by itself; do not specify -snapshot or -quiet")
+	}
+	if flagWasSet(fs, "checkpoint-every") {
+		return errors.New("Specify -chunk instead of -checkpoint-every for jobs")
+	}
+	if _, err := selectBackend(*backend); err != nil {
 		return err
 	}
-	if *inputFileName == "" || *outputFileName == "" {
-		return errors.New("Specify -i and -o options properly")
+	profile, err := cpu.resolve()
+	if err != nil {
+		return err
 	}
 
-	_, err = runIyokanPacket("genevalkey",
-		"--in", *inputFileName,
-		"--out", *outputFileName)
+	// Each input file given as an argument makes a job whose output is
+	// INPUT.result.enc, without the extension of INPUT.
+	opts := run.options()
+	type inout struct{ input, output string }
+	var files []inout
+	if opts.Input != "" || opts.Output != "" {
+		files = append(files, inout{opts.Input, opts.Output})
+	}
+	for _, input := range fs.Args() {
+		files = append(files, inout{input, strings.TrimSuffix(input, filepath.Ext(input)) + ".result.enc"})
+	}
+	if len(files) == 0 {
+		return errors.New("Specify -i and -o options, or input files properly")
+	}
 
-	return err
+	q, err := kvsp.OpenQueue(*dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		job := kvsp.QueueJob{
+			CPU:        profile.Name,
+			Backend:    *backend,
+			Cycles:     opts.Cycles,
+			NumGPU:     opts.NumGPU,
+			IyokanArgs: opts.IyokanArgs,
+			Chunk:      *nChunk,
+		}
+		// The queue may run in another directory.
+		if *cpu.profileFile != "" {
+			if job.CPUProfile, err = filepath.Abs(*cpu.profileFile); err != nil {
+				return err
+			}
+		}
+		for _, path := range []struct {
+			dst *string
+			src string
+		}{
+			{&job.BootstrappingKey, opts.BootstrappingKey},
+			{&job.Input, file.input},
+			{&job.Output, file.output},
+		} {
+			if path.src == "" {
+				continue
+			}
+			if *path.dst, err = filepath.Abs(path.src); err != nil {
+				return err
+			}
+		}
+		added, err := q.Add(job)
+		if err != nil {
+			return err
+		}
+		fmt.Println(added.ID)
+	}
+	return nil
 }
 
-func doPlainpacket() error {
-	// Parse command-line arguments.
-	fs := flag.NewFlagSet("plainpacket", flag.ExitOnError)
-	var (
-		inputFileName  = fs.String("i", "", "Input file name (plain)")
-		outputFileName = fs.String("o", "", "Output file name (encrypted)")
-	)
-	cpuName, cahpCPUName := addCPUFlags(fs)
-	backend := addBackendFlag(fs)
-	err := fs.Parse(os.Args[2:])
+func doQueueList() error {
+	fs := flag.NewFlagSet("queue list", flag.ExitOnError)
+	dir := addQueueDirFlag(fs)
+	format := addFormatFlag(fs)
+	err := parseFlags(fs, os.Args[3:])
 	if err != nil {
 		return err
 	}
-	if err := selectBackend(*backend); err != nil {
+	if err := checkFormat(*format); err != nil {
 		return err
 	}
-	profile, err := resolveCPU(*cpuName, *cahpCPUName)
+
+	q, err := kvsp.OpenQueue(*dir)
 	if err != nil {
 		return err
 	}
-	if *inputFileName == "" || *outputFileName == "" {
-		return errors.New("Specify -i, and -o options properly")
+	jobs, err := q.Jobs()
+	if err != nil {
+		return err
+	}
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(jobs)
+	}
+	for _, job := range jobs {
+		fmt.Printf("%s\t%s\t%d/%d\t%s", job.ID, job.State, job.Done, job.Cycles, job.Input)
+		if job.Error != "" {
+			fmt.Printf("\t%s", job.Error)
+		}
+		fmt.Println()
 	}
+	return nil
+}
 
-	return packELF(*inputFileName, *outputFileName, fs.Args(), profile)
+// queueCommand returns the command to run a queued job by this kvsp.
+func queueCommand(self string) func(kvsp.QueueJob, kvsp.RunOptions, bool) *exec.Cmd {
+	return func(job kvsp.QueueJob, opts kvsp.RunOptions, resume bool) *exec.Cmd {
+		args := []string{"run"}
+		if resume {
+			args = []string{"resume"}
+		}
+		args = append(args, runArgs(opts, resume)...)
+		if !resume {
+			if job.CPUProfile != "" {
+				args = append(args, "--cpu-profile", job.CPUProfile)
+			} else {
+				args = append(args, "--cpu", job.CPU)
+			}
+		}
+		// The job has all settings; do not let a kvsp.toml change them.
+		args = append(args, "--backend", job.Backend, "--config", os.DevNull)
+		args = append(args, logArgs...)
+		return exec.Command(self, args...)
+	}
 }
 
-func doRun() error {
-	// Parse command-line arguments.
-	fs := flag.NewFlagSet("run", flag.ExitOnError)
+func doQueueRun() error {
+	fs := flag.NewFlagSet("queue run", flag.ExitOnError)
 	var (
-		nClocks          = fs.Uint("c", 0, "Number of clocks to run")
-		bkeyFileName     = fs.String("bkey", "", "Bootstrapping key file name")
-		inputFileName    = fs.String("i", "", "Input file name (encrypted)")
-		outputFileName   = fs.String("o", "", "Output file name (encrypted)")
-		numGPU           = fs.Uint("g", 0, "Number of GPUs (Unspecify or set 0 for CPU mode)")
-		snapshotFileName = fs.String("snapshot", "", "Snapshot file name to write in")
-		quiet            = fs.Bool("quiet", false, "Be quiet")
-		iyokanArgs       arrayFlags
+		dir         = addQueueDirFlag(fs)
+		concurrency = fs.Int("j", 0, "Number of jobs to run at once (Unspecify or set 0 to decide from the cores and GPUs)")
+		cpusPerJob  = fs.Int("cpus-per-job", runtime.NumCPU(), "Number of cores each CPU job uses, to decide the number of jobs to run at once")
+		numGPU      = fs.Int("gpus", -1, "Number of GPUs of this host (default as many as nvidia-smi finds)")
+		retries     = fs.Int("retries", 2, "Number of times to retry a failed job from its latest snapshot")
 	)
-	cpuName, cahpCPUName := addCPUFlags(fs)
-	backend := addBackendFlag(fs)
-	fs.Var(&iyokanArgs, "iyokan-args", "Raw arguments for Iyokan")
-	err := fs.Parse(os.Args[2:])
+	err := parseFlags(fs, os.Args[3:])
 	if err != nil {
 		return err
 	}
-	if err := selectBackend(*backend); err != nil {
-		return err
+	if *numGPU < 0 {
+		*numGPU = kvsp.CountGPUs()
 	}
-	profile, err := resolveCPU(*cpuName, *cahpCPUName)
+	self, err := os.Executable()
 	if err != nil {
 		return err
 	}
 
-	if *nClocks == 0 || *bkeyFileName == "" || *inputFileName == "" || *outputFileName == "" {
-		return errors.New("Specify -c, -bkey, -i, and -o options properly")
+	q, err := kvsp.OpenQueue(*dir)
+	if err != nil {
+		return err
 	}
-
-	blueprint, err := getPathOf(profile.BlueprintName)
+	if *concurrency <= 0 {
+		jobs, err := q.Jobs()
+		if err != nil {
+			return err
+		}
+		*concurrency = kvsp.QueueConcurrency(jobs, runtime.NumCPU(), *cpusPerJob, *numGPU)
+	}
+	log.Printf("Running the jobs in %s, %d at once", *dir, *concurrency)
+	summary, err := q.Run(signalCtx, kvsp.QueueRunOptions{
+		Concurrency: *concurrency,
+		NumGPU:      *numGPU,
+		MaxRetries:  *retries,
+		Command:     queueCommand(self),
+		Log:         os.Stdout,
+	})
 	if err != nil {
 		return err
 	}
 
-	args := []string{
-		"-i", *inputFileName,
-		"--blueprint", blueprint,
+	var cycles uint
+	for _, job := range summary.Jobs {
+		cycles += job.Done
 	}
-	if *numGPU > 0 {
-		args = append(args, "--enable-gpu", "--gpu_num", fmt.Sprint(*numGPU))
+	fmt.Printf("\n%d jobs in %s: %d done, %d failed, %d canceled; %d cycles in total\n",
+		len(summary.Jobs), summary.Elapsed.Round(time.Second),
+		summary.Count(kvsp.JobDone), summary.Count(kvsp.JobFailed), summary.Count(kvsp.JobCanceled), cycles)
+	for _, job := range summary.Jobs {
+		if job.State == kvsp.JobFailed {
+			fmt.Printf("Job %s failed: %s (see %s)\n", job.ID, job.Error, q.LogFile(job.ID))
+		}
 	}
-
-	return runIyokanTFHE(*nClocks, *bkeyFileName, *outputFileName, *snapshotFileName, *quiet, args, iyokanArgs)
+	if n := summary.Count(kvsp.JobQueued); n > 0 {
+		fmt.Printf("%d jobs were stopped and queued again; run kvsp queue run to resume them\n", n)
+	}
+	if n := summary.Count(kvsp.JobFailed); n > 0 {
+		return fmt.Errorf("%d jobs failed", n)
+	}
+	return nil
 }
 
-func doResume() error {
-	// Parse command-line arguments.
-	fs := flag.NewFlagSet("resume", flag.ExitOnError)
-	var (
-		nClocks          = fs.Uint("c", 0, "Number of clocks to run")
-		bkeyFileName     = fs.String("bkey", "", "Bootstrapping key file name")
-		inputFileName    = fs.String("i", "", "Snapshot file to resume from")
-		outputFileName   = fs.String("o", "", "Output file name (encrypted)")
-		snapshotFileName = fs.String("snapshot", "", "Snapshot file name to write in")
-		quiet            = fs.Bool("quiet", false, "Be quiet")
-		iyokanArgs       arrayFlags
-	)
-	backend := addBackendFlag(fs)
-	fs.Var(&iyokanArgs, "iyokan-args", "Raw arguments for Iyokan")
-	err := fs.Parse(os.Args[2:])
+func doQueueCancel() error {
+	fs := flag.NewFlagSet("queue cancel", flag.ExitOnError)
+	dir := addQueueDirFlag(fs)
+	err := parseFlags(fs, os.Args[3:])
 	if err != nil {
 		return err
 	}
-	if err := selectBackend(*backend); err != nil {
-		return err
+	if fs.NArg() == 0 {
+		return errors.New("Specify jobs to cancel")
 	}
 
-	if *nClocks == 0 || *bkeyFileName == "" || *inputFileName == "" || *outputFileName == "" {
-		return errors.New("Specify -c, -bkey, -i, and -o options properly")
+	q, err := kvsp.OpenQueue(*dir)
+	if err != nil {
+		return err
+	}
+	for _, id := range fs.Args() {
+		if err := q.Cancel(id); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	args := []string{
-		"--resume", *inputFileName,
+func printResumeHint(opts kvsp.RunOptions) {
+	if opts.Quiet {
+		return
 	}
-	return runIyokanTFHE(*nClocks, *bkeyFileName, *outputFileName, *snapshotFileName, *quiet, args, iyokanArgs)
+	fmt.Printf("\n")
+	fmt.Printf("Snapshot was taken as file '%s'. You can resume the process like:\n", opts.Snapshot)
+	fmt.Printf("\t$ %s\n", resumeCommand(opts.Snapshot, opts.Cycles, opts))
 }
 
-func runIyokanTFHE(nClocks uint, bkeyFileName string, outputFileName string, snapshotFileName string, quiet bool, otherArgs0 []string, otherArgs1 []string) error {
-	var err error
+// resumeCommand returns the command which runs cycles more clocks from
+// snapshot into the output of opts.
+func resumeCommand(snapshot string, cycles uint, opts kvsp.RunOptions) string {
+	args := runArgs(kvsp.RunOptions{
+		Cycles:           cycles,
+		Input:            snapshot,
+		Output:           opts.Output,
+		BootstrappingKey: opts.BootstrappingKey,
+		CheckpointEvery:  opts.CheckpointEvery,
+	}, true)
+	return fmt.Sprintf("%s resume %s", os.Args[0], strings.Join(args, " "))
+}
 
-	if snapshotFileName == "" {
-		snapshotFileName = fmt.Sprintf(
-			"kvsp_%s.snapshot", time.Now().Format("20060102150405"))
-	}
+// signalError is the cause of the cancellation of signalCtx.
+type signalError struct {
+	sig os.Signal
+}
 
-	args := []string{
-		"tfhe",
-		"--evalkey", bkeyFileName,
-		"-o", outputFileName,
-		"-c", fmt.Sprint(nClocks),
-		"--snapshot", snapshotFileName,
-	}
-	if quiet {
-		args = append(args, "--quiet")
+func (e *signalError) Error() string {
+	return fmt.Sprintf("Interrupted by %v", e.sig)
+}
+
+// signalCtx is canceled with a *signalError when a command in
+// signalCommands gets SIGINT or SIGTERM.
+var signalCtx = context.Background()
+
+// signalCommands are the commands which handle SIGINT and SIGTERM, so that
+// they remove their plaintext temporary files, and stop the tools or jobs
+// they run, before exiting. Each maps to the message printed when it
+// gets a signal. The others, e.g. debug, leave the signals to their
+// children.
+var signalCommands = map[string]string{
+	"dec":            "",
+	"emu":            "",
+	"enc":            "",
+	"enc-batch":      "",
+	"estimate":       "",
+	"genbkey":        "",
+	"genkey":         "",
+	"key":            "",
+	"queue run":      "Stopping the jobs; they are queued again to resume from their latest snapshots.",
+	"resume":         "Stopping the evaluator; the run keeps its last checkpoint, if any.",
+	"run":            "Stopping the evaluator; the run keeps its last checkpoint, if any.",
+	"run-until-done": "Stopping the evaluator; the run keeps its last checkpoint, if any.",
+	"serve":          "Stopping the server; a running job is queued again.",
+}
+
+// notifySignals makes the first SIGINT or SIGTERM print message and cancel
+// signalCtx, and ignores the rest until the returned function is called.
+func notifySignals(message string) func() {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	signalCtx = ctx
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-sigCh:
+			if message != "" {
+				fmt.Fprintf(os.Stderr, "\n%s\n", message)
+			}
+			cancel(&signalError{sig})
+		case <-done:
+		}
+	}()
+	return func() {
+		signal.Stop(sigCh)
+		close(done)
 	}
-	args = append(args, otherArgs0...)
-	args = append(args, otherArgs1...)
-	if err = runIyokan(args, []string{}); err != nil {
+}
+
+// checkInterrupted prints how to go on with the run opts if err is its
+// interruption, and returns the error to exit with.
+func checkInterrupted(opts kvsp.RunOptions, err error) error {
+	var interrupted *kvsp.InterruptedError
+	if !errors.As(err, &interrupted) {
 		return err
 	}
-
-	if !quiet {
-		fmt.Printf("\n")
-		fmt.Printf("Snapshot was taken as file '%s'. You can resume the process like:\n", snapshotFileName)
-		fmt.Printf("\t$ %s resume -c %d -i %s -o %s -bkey %s\n",
-			os.Args[0], nClocks, snapshotFileName, outputFileName, bkeyFileName)
+	// The evaluator does not report where it stopped, and its snapshot is
+	// dropped, so that only the cycles up to the last checkpoint are kept.
+	fmt.Fprintf(os.Stderr, "\n%v.\n", interrupted.Cause)
+	switch {
+	case interrupted.Checkpoint != "":
+		fmt.Fprintf(os.Stderr, "The last checkpoint '%s' is kept, %d of %d cycles in; the cycles run after it are lost. You can resume the process like:\n",
+			interrupted.Checkpoint, interrupted.Cycles, opts.Cycles)
+		fmt.Fprintf(os.Stderr, "\t$ %s\n", resumeCommand(interrupted.Checkpoint, opts.Cycles-interrupted.Cycles, opts))
+	case opts.CheckpointEvery == 0 || opts.CheckpointEvery >= opts.Cycles:
+		fmt.Fprintf(os.Stderr, "The run took no checkpoint, so that it is lost. Run it again with -checkpoint-every N to take one every N cycles.\n")
+	default:
+		fmt.Fprintf(os.Stderr, "The run was interrupted before its first checkpoint at cycle %d, so that it is lost. Run it again from the start.\n",
+			opts.CheckpointEvery)
 	}
-
-	return nil
+	return &exitCodeError{1}
 }
 
 var kvspVersion = "unk"
@@ -1064,8 +2004,9 @@ func doVersion() error {
 }
 
 func main() {
+	kvsp.Version = kvspVersion
 	if envvarVerbose := os.Getenv("KVSP_VERBOSE"); envvarVerbose == "1" {
-		flagVerbose = true
+		kvsp.Verbose = true
 	}
 
 	flag.Usage = func() {
@@ -1077,13 +2018,24 @@ Commands:
 	cc
 	debug
 	dec
+	doctor
 	emu
 	enc
+	enc-batch
+	estimate
+	fetch
 	genkey
 	genbkey
+	key
 	plainpacket
+	queue
 	resume
 	run
+	run-until-done
+	serve
+	snapshot
+	status
+	submit
 	version
 `, os.Args[0])
 		flag.PrintDefaults()
@@ -1094,6 +2046,33 @@ Commands:
 		os.Exit(1)
 	}
 
+	err := runCommand(os.Args[1])
+	var sigErr *signalError
+	if errors.As(context.Cause(signalCtx), &sigErr) {
+		os.Exit(128 + int(sigErr.sig.(syscall.Signal)))
+	}
+	var exitErr *exitCodeError
+	if errors.As(err, &exitErr) {
+		os.Exit(exitErr.code)
+	}
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+}
+
+// runCommand runs the command name, and removes the plaintext temporary
+// files it leaves when it returns.
+func runCommand(name string) error {
+	if name == "queue" && len(os.Args) > 2 {
+		name += " " + os.Args[2]
+	}
+	if message, ok := signalCommands[name]; ok {
+		stop := notifySignals(message)
+		defer stop()
+	}
+	defer kvsp.CleanupWorkDir()
+
 	var err error
 	switch os.Args[1] {
 	case "cc":
@@ -1102,29 +2081,47 @@ Commands:
 		err = doDebug()
 	case "dec":
 		err = doDec()
+	case "doctor":
+		err = doDoctor()
 	case "emu":
 		err = doEmu()
 	case "enc":
 		err = doEnc()
+	case "enc-batch":
+		err = doEncBatch()
+	case "estimate":
+		err = doEstimate()
+	case "fetch":
+		err = doFetch()
 	case "genkey":
 		err = doGenkey()
 	case "genbkey":
 		err = doGenbkey()
+	case "key":
+		err = doKey()
 	case "plainpacket":
 		err = doPlainpacket()
+	case "queue":
+		err = doQueue()
 	case "resume":
 		err = doResume()
 	case "run":
 		err = doRun()
+	case "run-until-done":
+		err = doRunUntilDone()
+	case "serve":
+		err = doServe()
+	case "snapshot":
+		err = doSnapshot()
+	case "status":
+		err = doStatus()
+	case "submit":
+		err = doSubmit()
 	case "version":
 		err = doVersion()
 	default:
 		flag.Usage()
 		os.Exit(1)
 	}
-
-	if err != nil {
-		log.Fatal(err)
-		os.Exit(1)
-	}
+	return err
 }
@@ -1,8 +1,15 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/kvsp/kvsp/pkg/kvsp"
 )
 
 func TestBackendFlagDefaultsToTangor(t *testing.T) {
@@ -17,18 +24,170 @@ func TestBackendFlagDefaultsToTangor(t *testing.T) {
 }
 
 func TestSelectBackend(t *testing.T) {
-	previous := evaluatorBackend
-	t.Cleanup(func() { evaluatorBackend = previous })
-
 	for _, name := range []string{"tangor", "iyokan", "IYOKAN"} {
-		if err := selectBackend(name); err != nil {
+		b, err := selectBackend(name)
+		if err != nil {
 			t.Fatalf("selectBackend(%q): %v", name, err)
 		}
+		if want := strings.ToLower(name); b.Name() != want {
+			t.Fatalf("selected backend = %q, want %s", b.Name(), want)
+		}
 	}
-	if evaluatorBackend != "iyokan" {
-		t.Fatalf("selected backend = %q, want iyokan", evaluatorBackend)
-	}
-	if err := selectBackend("unknown"); err == nil {
+	if _, err := selectBackend("unknown"); err == nil {
 		t.Fatal("selectBackend accepted an unknown backend")
 	}
 }
+
+func TestProgramExit(t *testing.T) {
+	profile, err := kvsp.LoadCPUProfile("../share/cpus/alexandrite.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		finished bool
+		a0       int
+		want     int
+	}{
+		{true, 0, 0},
+		{true, 5, 5},
+		{true, 0xffffffff, 255}, // return -1;
+		{true, 0x100, 0},
+		{false, 5, exitCodeNotFinished},
+	} {
+		pkt := &kvsp.PlainPacket{
+			Flags: map[string]bool{"finflag": tc.finished},
+			Regs:  map[string]int{"reg_x10": tc.a0},
+		}
+		code := 0
+		var exitErr *exitCodeError
+		if err := programExit(pkt, profile); errors.As(err, &exitErr) {
+			code = exitErr.code
+		}
+		if code != tc.want {
+			t.Errorf("programExit(finflag=%t, a0=%#x) exits with %d, want %d", tc.finished, tc.a0, code, tc.want)
+		}
+	}
+}
+
+func TestRunArgs(t *testing.T) {
+	for _, resume := range []bool{false, true} {
+		for _, every := range []uint{0, 10, defaultCheckpointEvery} {
+			opts := kvsp.RunOptions{
+				Cycles:           30,
+				BootstrappingKey: "bootstrapping.key",
+				Input:            "fib.enc",
+				Output:           "result.enc",
+				Snapshot:         "fib.snapshot",
+				Quiet:            true,
+				IyokanArgs:       []string{"--dump-prefix", "dump"},
+				CheckpointEvery:  every,
+			}
+			if !resume {
+				opts.NumGPU = 2
+			}
+			fs := flag.NewFlagSet("run-args", flag.ContinueOnError)
+			run := addRunFlags(fs, resume)
+			if err := fs.Parse(runArgs(opts, resume)); err != nil {
+				t.Fatal(err)
+			}
+			if got := run.options(); !reflect.DeepEqual(got, opts) {
+				t.Errorf("options(runArgs(%+v, %t)) = %+v", opts, resume, got)
+			}
+		}
+	}
+}
+
+func TestParseFlagsConfig(t *testing.T) {
+	dir := t.TempDir()
+	config := filepath.Join(dir, "kvsp.toml")
+	if err := os.WriteFile(config, []byte(`
+[defaults]
+cpu = "pearl"
+keys = "main"
+g = 1
+quiet = false
+
+[commands.run]
+quiet = true
+
+[commands.resume]
+iyokan-args = ["--enable-gpu", "--gpu_num", "1"]
+
+[commands.queue.add]
+chunk = 100
+
+[keys.main]
+secret = "secret.key"
+bootstrapping = "/keys/bootstrapping.key"
+
+[keys.other]
+bootstrapping = "other.key"
+
+[programs.fib]
+cycles = 30
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	parseRun := func(args ...string) (*flag.FlagSet, *runFlags, cpuFlags) {
+		t.Helper()
+		fs := flag.NewFlagSet("run", flag.ContinueOnError)
+		run := addRunFlags(fs, false)
+		cpu := addCPUFlags(fs)
+		if err := parseFlags(fs, append([]string{"--config", config}, args...)); err != nil {
+			t.Fatal(err)
+		}
+		return fs, run, cpu
+	}
+
+	fs, run, cpu := parseRun("-i", "out/fib.enc", "-g", "0")
+	opts := run.options()
+	want := kvsp.RunOptions{
+		Cycles:           30,
+		BootstrappingKey: "/keys/bootstrapping.key",
+		Input:            "out/fib.enc",
+		Quiet:            true,
+		CheckpointEvery:  defaultCheckpointEvery,
+	}
+	if !reflect.DeepEqual(opts, want) {
+		t.Errorf("options = %+v, want %+v", opts, want)
+	}
+	if *cpu.name != "pearl" {
+		t.Errorf("--cpu = %q, want pearl", *cpu.name)
+	}
+	if !flagWasSet(fs, "g") || flagWasSet(fs, "c") {
+		t.Error("flagWasSet does not tell the command line from the configuration")
+	}
+
+	fs = flag.NewFlagSet("resume", flag.ContinueOnError)
+	resume := addRunFlags(fs, true)
+	if err := parseFlags(fs, []string{"--config", config, "-i", "fib.snapshot"}); err != nil {
+		t.Fatal(err)
+	}
+	if args := resume.options().IyokanArgs; !reflect.DeepEqual(args, []string{"--enable-gpu", "--gpu_num", "1"}) {
+		t.Errorf("resume: --iyokan-args = %q", args)
+	}
+
+	_, run, cpu = parseRun("-i", "prog.enc", "-c", "5", "--keys", "other", "--cpu-profile", "my.toml")
+	if *run.nClocks != 5 || *run.bkeyFileName != filepath.Join(dir, "other.key") || *cpu.name != "" {
+		t.Errorf("-c = %d, -bkey = %q, --cpu = %q", *run.nClocks, *run.bkeyFileName, *cpu.name)
+	}
+
+	fs = flag.NewFlagSet("queue add", flag.ContinueOnError)
+	chunk := fs.Uint("chunk", 0, "")
+	if err := parseFlags(fs, []string{"--config", config}); err != nil || *chunk != 100 {
+		t.Errorf("queue add: -chunk = %d, %v", *chunk, err)
+	}
+
+	fs = flag.NewFlagSet("genkey", flag.ContinueOnError)
+	out := fs.String("o", "", "")
+	if err := parseFlags(fs, []string{"--config", config}); err != nil || *out != filepath.Join(dir, "secret.key") {
+		t.Errorf("genkey: -o = %q, %v", *out, err)
+	}
+
+	fs = flag.NewFlagSet("dec", flag.ContinueOnError)
+	fs.String("k", "", "")
+	if err := parseFlags(fs, []string{"--config", config, "--keys", "missing"}); err == nil {
+		t.Error("parseFlags accepted a missing key set")
+	}
+}
@@ -0,0 +1,263 @@
+package kvsp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Backend is an evaluator which KVSP drives to manage keys, to encrypt and
+// decrypt packets, and to run packets in plaintext or over TFHE. Plain
+// packets are read and written by KVSP itself. The methods which take a ctx
+// stop the tool they run when it is done.
+type Backend interface {
+	// Name returns the name the backend is registered as.
+	Name() string
+	// GenKey generates a TFHE secret key into outputFileName.
+	GenKey(ctx context.Context, outputFileName string) error
+	// GenEvalKey generates the evaluation (bootstrapping) key for the secret
+	// key secretKeyFileName into outputFileName.
+	GenEvalKey(ctx context.Context, secretKeyFileName, outputFileName string) error
+	// Enc encrypts a plain packet.
+	Enc(ctx context.Context, keyFileName, inputFileName, outputFileName string) error
+	// Dec decrypts an encrypted packet into a plain one.
+	Dec(ctx context.Context, keyFileName, inputFileName, outputFileName string) error
+	// RunPlain runs the plain packet inputFileName on blueprint.
+	RunPlain(ctx context.Context, blueprint, inputFileName, outputFileName string, extraArgs []string) error
+	// RunTFHE runs the evaluator in TFHE mode with args.
+	RunTFHE(ctx context.Context, args []string) error
+	// Probe checks that the backend is installed and reports what it can do.
+	Probe() (Capabilities, error)
+}
+
+// Capabilities is what Backend.Probe finds out about an evaluator.
+type Capabilities struct {
+	// Evaluator and Packet are the resolved paths of the evaluator binaries.
+	Evaluator string
+	Packet    string
+	// GPU tells if the evaluator was built with GPU support.
+	GPU GPUSupport
+}
+
+// GPUSupport is whether an evaluator can run on GPUs.
+type GPUSupport string
+
+const (
+	GPUSupported   GPUSupport = "yes"
+	GPUUnsupported GPUSupport = "no"
+	// GPUUnknown is reported if the evaluator's help does not tell.
+	GPUUnknown GPUSupport = "unknown"
+)
+
+var backends = map[string]Backend{}
+
+// RegisterBackend makes b available by its name. It panics if the name is
+// already registered.
+func RegisterBackend(b Backend) {
+	name := strings.ToLower(b.Name())
+	if _, ok := backends[name]; ok {
+		panic(fmt.Sprintf("kvsp: backend %q registered twice", name))
+	}
+	backends[name] = b
+}
+
+// LookupBackend returns the backend registered as name.
+func LookupBackend(name string) (Backend, error) {
+	b, ok := backends[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown evaluator backend %q (expected %s)",
+			name, strings.Join(BackendNames(), " or "))
+	}
+	return b, nil
+}
+
+// BackendNames returns the names of the registered backends in sorted order.
+func BackendNames() []string {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DefaultBackend is the name of the backend used unless specified.
+const DefaultBackend = "tangor"
+
+func init() {
+	RegisterBackend(NewIyokanCompatibleBackend("iyokan", "iyokan", "iyokan-packet"))
+	// The AVX2 Tangor build uses suffixed binary names. Prefer the
+	// release/AVX512 names, then transparently use this portable build.
+	RegisterBackend(NewIyokanCompatibleBackend("tangor",
+		"tangor-iyokan", "tangor-iyokan-packet",
+		"tangor-iyokan-avx2", "tangor-iyokan-packet-avx2"))
+}
+
+type iyokanCompatibleBackend struct {
+	name                              string
+	evaluator, packet                 string
+	evaluatorFallback, packetFallback string
+	// envName is the NAME of KVSP_NAME_PATH which overrides the evaluator,
+	// and NAME-PACKET overrides the packet tool.
+	envName string
+}
+
+// legacyEnvName is the envName of the iyokan backend, which every backend
+// read before KVSP had backends.
+const legacyEnvName = "IYOKAN"
+
+// NewIyokanCompatibleBackend returns a backend whose binaries take the same
+// command-line arguments as Iyokan's iyokan and iyokan-packet. evaluator and
+// packet are file names in the directory of the running executable, and are
+// overridden by KVSP_<NAME>_IYOKAN_PATH and KVSP_<NAME>_IYOKAN_PACKET_PATH,
+// where NAME is name in upper case, e.g. KVSP_TANGOR_IYOKAN_PATH. The iyokan
+// backend keeps KVSP_IYOKAN_PATH and KVSP_IYOKAN_PACKET_PATH. The optional
+// fallbacks are tried, in the same directory, when they do not exist.
+func NewIyokanCompatibleBackend(name, evaluator, packet string, fallbacks ...string) Backend {
+	b := &iyokanCompatibleBackend{name: name, evaluator: evaluator, packet: packet}
+	b.envName = strings.ToUpper(name) + "_IYOKAN"
+	if strings.EqualFold(name, "iyokan") {
+		b.envName = legacyEnvName
+	}
+	if len(fallbacks) > 0 {
+		b.evaluatorFallback = fallbacks[0]
+	}
+	if len(fallbacks) > 1 {
+		b.packetFallback = fallbacks[1]
+	}
+	return b
+}
+
+func (b *iyokanCompatibleBackend) Name() string {
+	return b.name
+}
+
+func (b *iyokanCompatibleBackend) evaluatorPath() (string, error) {
+	return b.lookupPath(b.envName, b.evaluator, b.evaluatorFallback)
+}
+
+func (b *iyokanCompatibleBackend) packetPath() (string, error) {
+	return b.lookupPath(b.envName+"-PACKET", b.packet, b.packetFallback)
+}
+
+// lookupPath resolves path like lookupPath. KVSP_IYOKAN_PATH and
+// KVSP_IYOKAN_PACKET_PATH, which every backend read before KVSP had
+// backends, are still read when the backend's own variable is unset, with a
+// warning that they are deprecated for it.
+func (b *iyokanCompatibleBackend) lookupPath(name, path, fallback string) (string, error) {
+	legacyName := legacyEnvName + strings.TrimPrefix(name, b.envName)
+	if name != legacyName && os.Getenv(pathEnvName(legacyName)) != "" && os.Getenv(pathEnvName(name)) == "" {
+		warnDeprecatedEnv(pathEnvName(legacyName), pathEnvName(name), b.name)
+		name = legacyName
+	}
+	return lookupPath(name, path, fallback)
+}
+
+// warnDeprecatedEnv warns once that the backend reads the variable legacy
+// instead of its own variable name.
+func warnDeprecatedEnv(legacy, name, backend string) {
+	warnOnce(fmt.Sprintf("%s is deprecated for the %s backend; set %s instead", legacy, backend, name))
+}
+
+func (b *iyokanCompatibleBackend) runPacket(ctx context.Context, args ...string) (string, error) {
+	// Get the path of iyokan-packet
+	path, err := b.packetPath()
+	if err != nil {
+		return "", err
+	}
+
+	// Run
+	return outCmd(ctx, path, args)
+}
+
+func (b *iyokanCompatibleBackend) runEvaluator(ctx context.Context, args []string) error {
+	path, err := b.evaluatorPath()
+	if err != nil {
+		return err
+	}
+	return execCmd(ctx, path, args)
+}
+
+func (b *iyokanCompatibleBackend) GenKey(ctx context.Context, outputFileName string) error {
+	_, err := b.runPacket(ctx, "genkey",
+		"--type", "tfhepp",
+		"--out", outputFileName)
+	return err
+}
+
+func (b *iyokanCompatibleBackend) GenEvalKey(ctx context.Context, secretKeyFileName, outputFileName string) error {
+	_, err := b.runPacket(ctx, "genevalkey",
+		"--in", secretKeyFileName,
+		"--out", outputFileName)
+	return err
+}
+
+func (b *iyokanCompatibleBackend) Enc(ctx context.Context, keyFileName, inputFileName, outputFileName string) error {
+	_, err := b.runPacket(ctx, "enc",
+		"--key", keyFileName,
+		"--in", inputFileName,
+		"--out", outputFileName)
+	return err
+}
+
+func (b *iyokanCompatibleBackend) Dec(ctx context.Context, keyFileName, inputFileName, outputFileName string) error {
+	_, err := b.runPacket(ctx, "dec",
+		"--key", keyFileName,
+		"--in", inputFileName,
+		"--out", outputFileName)
+	return err
+}
+
+func (b *iyokanCompatibleBackend) RunPlain(ctx context.Context, blueprint, inputFileName, outputFileName string, extraArgs []string) error {
+	args := []string{"plain", "-i", inputFileName, "-o", outputFileName, "--blueprint", blueprint}
+	return b.runEvaluator(ctx, append(args, extraArgs...))
+}
+
+func (b *iyokanCompatibleBackend) RunTFHE(ctx context.Context, args []string) error {
+	return b.runEvaluator(ctx, append([]string{"tfhe"}, args...))
+}
+
+// runTFHEOutput is RunTFHE which writes the standard output of the evaluator
+// to stdout.
+func (b *iyokanCompatibleBackend) runTFHEOutput(ctx context.Context, args []string, stdout io.Writer) error {
+	path, err := b.evaluatorPath()
+	if err != nil {
+		return err
+	}
+	cmd := execCmdImpl(ctx, path, append([]string{"tfhe"}, args...))
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = stdout
+	return runCmd(cmd)
+}
+
+func (b *iyokanCompatibleBackend) Probe() (Capabilities, error) {
+	var caps Capabilities
+	var err error
+	if caps.Evaluator, err = b.evaluatorPath(); err != nil {
+		return caps, err
+	}
+	if caps.Packet, err = b.packetPath(); err != nil {
+		return caps, err
+	}
+	// Iyokan has --enable-gpu for tfhe only if it was built with GPU
+	// support. Ignore the exit status, and look only at the help text, which
+	// lists --blueprint in any case.
+	var out bytes.Buffer
+	cmd := execCmdImpl(context.Background(), caps.Evaluator, []string{"tfhe", "--help"})
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	runCmd(cmd)
+	switch help := out.String(); {
+	case strings.Contains(help, "--enable-gpu"):
+		caps.GPU = GPUSupported
+	case strings.Contains(help, "--blueprint"):
+		caps.GPU = GPUUnsupported
+	default:
+		caps.GPU = GPUUnknown
+	}
+	return caps, nil
+}
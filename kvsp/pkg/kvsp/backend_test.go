@@ -0,0 +1,104 @@
+package kvsp
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackendRegistry(t *testing.T) {
+	for _, name := range []string{"iyokan", "tangor", "Tangor"} {
+		if _, err := LookupBackend(name); err != nil {
+			t.Fatalf("LookupBackend(%q): %v", name, err)
+		}
+	}
+	if _, err := LookupBackend("unknown"); err == nil {
+		t.Fatal("LookupBackend accepted an unknown backend")
+	}
+
+	b := NewIyokanCompatibleBackend("test-registry", "my-iyokan", "my-iyokan-packet")
+	RegisterBackend(b)
+	t.Cleanup(func() { delete(backends, "test-registry") })
+	if got, err := LookupBackend("test-registry"); err != nil || got != b {
+		t.Fatalf("LookupBackend(test-registry) = %v, %v", got, err)
+	}
+}
+
+func TestProbeHonoursPathOverrides(t *testing.T) {
+	dir := t.TempDir()
+	// Iyokan lists --enable-gpu for tfhe if it was built with GPU support.
+	script := "#!/bin/sh\necho 'Usage: iyokan tfhe [OPTIONS]'\necho '  --blueprint TEXT'\necho '  --enable-gpu'\n"
+	for _, name := range []string{"iyokan", "iyokan-packet", "tangor-iyokan", "tangor-iyokan-packet"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each backend reads its own variables.
+	t.Setenv("KVSP_IYOKAN_PATH", filepath.Join(dir, "iyokan"))
+	t.Setenv("KVSP_IYOKAN_PACKET_PATH", filepath.Join(dir, "iyokan-packet"))
+	t.Setenv("KVSP_TANGOR_IYOKAN_PATH", filepath.Join(dir, "tangor-iyokan"))
+	t.Setenv("KVSP_TANGOR_IYOKAN_PACKET_PATH", filepath.Join(dir, "tangor-iyokan-packet"))
+	for _, name := range []string{"iyokan", "tangor"} {
+		b, err := LookupBackend(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		caps, err := b.Probe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		prefix := ""
+		if name == "tangor" {
+			prefix = "tangor-"
+		}
+		if caps.Evaluator != filepath.Join(dir, prefix+"iyokan") ||
+			caps.Packet != filepath.Join(dir, prefix+"iyokan-packet") || caps.GPU != GPUSupported {
+			t.Errorf("Probe() of %s = %+v", name, caps)
+		}
+	}
+
+	// Without its own variables, tangor falls back to KVSP_IYOKAN_PATH and
+	// KVSP_IYOKAN_PACKET_PATH.
+	t.Setenv("KVSP_TANGOR_IYOKAN_PATH", "")
+	t.Setenv("KVSP_TANGOR_IYOKAN_PACKET_PATH", "")
+	b, err := LookupBackend("tangor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	caps, err := b.Probe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caps.Evaluator != filepath.Join(dir, "iyokan") || caps.Packet != filepath.Join(dir, "iyokan-packet") {
+		t.Errorf("Probe() of tangor with the iyokan variables = %+v", caps)
+	}
+}
+
+func TestProbeGPU(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		help string
+		want GPUSupport
+	}{
+		{"Usage: iyokan tfhe [OPTIONS]\n  --blueprint TEXT\n  --enable-gpu\n  --gpu_num UINT\n", GPUSupported},
+		{"Usage: iyokan tfhe [OPTIONS]\n  --blueprint TEXT\n", GPUUnsupported},
+		{"iyokan: unknown option\n", GPUUnknown},
+	} {
+		for _, name := range []string{"iyokan", "iyokan-packet"} {
+			script := "#!/bin/sh\nprintf '" + tc.help + "'\nexit 1\n"
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		t.Setenv("KVSP_IYOKAN_PATH", filepath.Join(dir, "iyokan"))
+		t.Setenv("KVSP_IYOKAN_PACKET_PATH", filepath.Join(dir, "iyokan-packet"))
+		b, err := LookupBackend("iyokan")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if caps, err := b.Probe(); err != nil || caps.GPU != tc.want {
+			t.Errorf("Probe() with help %q = %+v, %v, want GPU %s", tc.help, caps, err, tc.want)
+		}
+	}
+}
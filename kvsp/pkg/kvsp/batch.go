@@ -0,0 +1,172 @@
+package kvsp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EncryptBatchItem is a packet for EncryptBatch to make.
+type EncryptBatchItem struct {
+	// Args are the command-line arguments of the program.
+	Args []string
+	// Output is the file name of the encrypted packet.
+	Output string
+}
+
+// EncryptBatch packs the ELF file inputFileName with the arguments of each
+// of items and encrypts them with the secret key keyFileName, using up to
+// workers processes of the backend at once. The ELF file is parsed, and the
+// key unwrapped, only once. It makes as many packets as it can, and returns
+// an error about those it cannot.
+func EncryptBatch(ctx context.Context, b Backend, keyFileName, inputFileName string, items []EncryptBatchItem, profile CPUProfile, workers int) error {
+	if len(items) == 0 {
+		return errors.New("no packets to encrypt")
+	}
+	start := time.Now()
+	img, err := loadProgram(inputFileName, profile)
+	logStep("pack", start, err, "input", inputFileName, "cpu", profile.Name)
+	if err != nil {
+		return err
+	}
+	plainKeyFileName, cleanup, err := openSecretKey(ctx, keyFileName)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	fingerprint, err := KeyFingerprint(plainKeyFileName)
+	if err != nil {
+		return err
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+	errs := make([]error, len(items))
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indices {
+				item := items[index]
+				img := img.clone()
+				err := img.AttachCommandLineOptions(item.Args, profile)
+				if err == nil {
+					err = encryptImage(ctx, b, plainKeyFileName, fingerprint, img, item.Output)
+				}
+				if err != nil {
+					errs[index] = fmt.Errorf("%s: %v", item.Output, err)
+				}
+			}
+		}()
+	}
+	for index := range items {
+		indices <- index
+	}
+	close(indices)
+	wg.Wait()
+
+	var failed []error
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+	switch len(failed) {
+	case 0:
+		return nil
+	case 1:
+		return failed[0]
+	}
+	return fmt.Errorf("%d of %d packets failed; the first is %v", len(failed), len(items), failed[0])
+}
+
+// ReadArgsLines reads a set of command-line arguments from each line of r.
+// Arguments are separated by white spaces, and may be quoted by ' or " as
+// in the shell; \ escapes the next character outside ' quotes. Empty lines
+// and those starting with # are skipped. It is an error if no line is left.
+func ReadArgsLines(r io.Reader) ([][]string, error) {
+	var argSets [][]string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		args, err := splitArgs(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineno, err)
+		}
+		argSets = append(argSets, args)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(argSets) == 0 {
+		return nil, errors.New("no sets of arguments; write one in each line")
+	}
+	return argSets, nil
+}
+
+// splitArgs splits line into arguments as described in ReadArgsLines.
+func splitArgs(line string) ([]string, error) {
+	var (
+		args    []string
+		arg     strings.Builder
+		inArg   bool
+		quote   rune
+		escaped bool
+	)
+	for _, c := range line {
+		switch {
+		case escaped:
+			arg.WriteRune(c)
+			escaped = false
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				arg.WriteRune(c)
+			}
+		case c == '\\':
+			escaped = true
+			inArg = true
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else {
+				arg.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inArg = true
+		case c == ' ' || c == '\t':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(c)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if escaped {
+		return nil, errors.New("\\ at the end of the line")
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
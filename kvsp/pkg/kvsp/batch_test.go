@@ -0,0 +1,94 @@
+package kvsp
+
+import (
+	"context"
+	"debug/elf"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// copyEncBackend "encrypts" a packet by copying it.
+type copyEncBackend struct {
+	fakeBackend
+}
+
+func (*copyEncBackend) Enc(_ context.Context, key, in, out string) error {
+	data, err := os.ReadFile(in)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(out, data, 0644)
+}
+
+func TestEncryptBatch(t *testing.T) {
+	profile := testProfile(t, "ruby")
+	dir := t.TempDir()
+	prog := writeTestELF(t, elf.EM_NONE, []testSegment{
+		{addr: 0, data: []byte{1, 2, 3, 4}, memSize: 4},
+	})
+	key := writeTestFile(t, dir, "secret.key", "secret")
+
+	var items []EncryptBatchItem
+	for i := 0; i < 10; i++ {
+		items = append(items, EncryptBatchItem{
+			Args:   []string{fmt.Sprint(i), "arg"},
+			Output: filepath.Join(dir, fmt.Sprintf("%d.enc", i)),
+		})
+	}
+	items = append(items, EncryptBatchItem{
+		Args:   []string{strings.Repeat("x", int(profile.RAMSize))},
+		Output: filepath.Join(dir, "long.enc"),
+	})
+
+	err := EncryptBatch(context.Background(), &copyEncBackend{}, key, prog, items, profile, 3)
+	if err == nil || !strings.Contains(err.Error(), "long.enc") {
+		t.Fatalf("EncryptBatch() = %v, want an error about long.enc", err)
+	}
+	for i, item := range items[:10] {
+		raw, err := ReadPlainPacketFile(item.Output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := &Image{RAM: make([]byte, profile.RAMSize)}
+		if err := want.AttachCommandLineOptions(item.Args, profile); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(raw.RAM["ram"].Bytes, want.RAM) {
+			t.Errorf("RAM of packet %d does not have its arguments", i)
+		}
+		if fp, _ := recordedFingerprint(item.Output); fp != keyFingerprint([]byte("secret")) {
+			t.Errorf("fingerprint of packet %d = %q", i, fp)
+		}
+	}
+}
+
+func TestReadArgsLines(t *testing.T) {
+	src := `# comment
+5
+  a "b c" 'd \e'  f\ g
+
+"" x\"y "\\"
+`
+	got, err := ReadArgsLines(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{"5"}, {"a", "b c", `d \e`, "f g"}, {"", `x"y`, `\`}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("ReadArgsLines() = %q, want %q", got, want)
+	}
+
+	if _, err := ReadArgsLines(strings.NewReader("# comment\n\n")); err == nil {
+		t.Error("ReadArgsLines accepted no sets of arguments")
+	}
+
+	for _, bad := range []string{"a 'b", `a "b`, `a\`} {
+		if _, err := ReadArgsLines(strings.NewReader("1\n" + bad)); err == nil || !strings.Contains(err.Error(), "line 2") {
+			t.Errorf("ReadArgsLines(%q) = %v, want an error at line 2", bad, err)
+		}
+	}
+}
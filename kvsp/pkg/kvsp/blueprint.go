@@ -0,0 +1,131 @@
+package kvsp
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/BurntSushi/toml"
+)
+
+type blueprintTOML struct {
+	File    []blueprintFileTOML    `toml:"file"`
+	Builtin []blueprintBuiltinTOML `toml:"builtin"`
+	Connect map[string]string      `toml:"connect"`
+}
+type blueprintFileTOML struct {
+	Type string `toml:"type"`
+	Path string `toml:"path"`
+	Name string `toml:"name"`
+}
+type blueprintBuiltinTOML struct {
+	Type          string `toml:"type"`
+	Name          string `toml:"name"`
+	InAddrWidth   int    `toml:"in_addr_width"`
+	InWdataWidth  int    `toml:"in_wdata_width"`
+	OutRdataWidth int    `toml:"out_rdata_width"`
+}
+
+// Blueprint is what KVSP needs to know of an Iyokan blueprint.
+type Blueprint struct {
+	ROMSize  uint64
+	RAMSize  uint64
+	RegCount int
+	RegWidth int
+	// Describes where ROMSize and RAMSize come from, for error messages.
+	romOrigin, ramOrigin string
+}
+
+var blueprintPortRegexp = regexp.MustCompile(`^@reg_x(\d+)(?:\[(\d+):(\d+)\])?$`)
+
+// LoadBlueprint reads the memory and register layout of the blueprint in
+// fileName.
+func LoadBlueprint(fileName string) (Blueprint, error) {
+	var src blueprintTOML
+	if _, err := toml.DecodeFile(fileName, &src); err != nil {
+		return Blueprint{}, fmt.Errorf("invalid blueprint %s: %v", fileName, err)
+	}
+
+	bp := Blueprint{romOrigin: "no rom builtin", ramOrigin: "no ram builtin"}
+	for _, builtin := range src.Builtin {
+		switch builtin.Type {
+		case "rom":
+			bp.ROMSize = (uint64(1) << builtin.InAddrWidth) * uint64(builtin.OutRdataWidth) / 8
+			bp.romOrigin = fmt.Sprintf("in_addr_width = %d, out_rdata_width = %d",
+				builtin.InAddrWidth, builtin.OutRdataWidth)
+		case "ram":
+			if builtin.InWdataWidth != builtin.OutRdataWidth {
+				return Blueprint{}, fmt.Errorf(
+					"invalid blueprint %s: ram has in_wdata_width = %d but out_rdata_width = %d",
+					fileName, builtin.InWdataWidth, builtin.OutRdataWidth)
+			}
+			bp.RAMSize = (uint64(1) << builtin.InAddrWidth) * uint64(builtin.InWdataWidth) / 8
+			bp.ramOrigin = fmt.Sprintf("in_addr_width = %d, in_wdata_width = %d",
+				builtin.InAddrWidth, builtin.InWdataWidth)
+		}
+	}
+
+	// Registers are output ports named @reg_xN[lo:hi].
+	regWidths := make(map[int]int)
+	for key, val := range src.Connect {
+		for _, port := range []string{key, val} {
+			m := blueprintPortRegexp.FindStringSubmatch(port)
+			if m == nil {
+				continue
+			}
+			index, _ := strconv.Atoi(m[1])
+			width := 1
+			if m[2] != "" {
+				lo, _ := strconv.Atoi(m[2])
+				hi, _ := strconv.Atoi(m[3])
+				width = hi - lo + 1
+			}
+			regWidths[index] = width
+		}
+	}
+	bp.RegCount = len(regWidths)
+	for i := 0; i < bp.RegCount; i++ {
+		width, ok := regWidths[i]
+		if !ok {
+			return Blueprint{}, fmt.Errorf("invalid blueprint %s: @reg_x%d is missing", fileName, i)
+		}
+		if i == 0 {
+			bp.RegWidth = width
+		} else if width != bp.RegWidth {
+			return Blueprint{}, fmt.Errorf(
+				"invalid blueprint %s: @reg_x%d is %d bits wide but @reg_x0 is %d bits wide",
+				fileName, i, width, bp.RegWidth)
+		}
+	}
+
+	return bp, nil
+}
+
+// CheckBlueprint returns an error naming the first field of profile which
+// disagrees with its blueprint.
+func CheckBlueprint(profile CPUProfile) error {
+	fileName, err := profile.blueprintPath()
+	if err != nil {
+		return err
+	}
+	bp, err := LoadBlueprint(fileName)
+	if err != nil {
+		return err
+	}
+
+	mismatch := func(field string, profileVal, bpVal interface{}, origin string) error {
+		return fmt.Errorf("CPU profile %q does not match blueprint %s: %s is %v but the blueprint has %v (%s)",
+			profile.Name, fileName, field, profileVal, bpVal, origin)
+	}
+	switch {
+	case profile.ROMSize != bp.ROMSize:
+		return mismatch("rom_size", profile.ROMSize, bp.ROMSize, "rom: "+bp.romOrigin)
+	case profile.RAMSize != bp.RAMSize:
+		return mismatch("ram_size", profile.RAMSize, bp.RAMSize, "ram: "+bp.ramOrigin)
+	case profile.RegCount != bp.RegCount:
+		return mismatch("reg_count", profile.RegCount, bp.RegCount, "number of @reg_xN ports")
+	case profile.RegWidth != bp.RegWidth:
+		return mismatch("reg_width", profile.RegWidth, bp.RegWidth, "width of @reg_xN ports")
+	}
+	return nil
+}
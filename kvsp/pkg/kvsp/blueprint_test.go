@@ -0,0 +1,38 @@
+package kvsp
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckBlueprintShippedProfiles(t *testing.T) {
+	for _, name := range []string{"ruby", "pearl", "alexandrite"} {
+		if err := CheckBlueprint(testProfile(t, name)); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestCheckBlueprintMismatch(t *testing.T) {
+	profile := testProfile(t, "alexandrite")
+	src, err := os.ReadFile(profile.Blueprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ from, to, want string }{
+		{"in_addr_width = 8", "in_addr_width = 9", "ram_size is 1024 but the blueprint has 2048"},
+		{"in_addr_width = 10", "in_addr_width = 9", "rom_size is 4096 but the blueprint has 2048"},
+		{`"@reg_x31[0:31]" = "core/io_x31[0:31]"`, "", "reg_count is 32 but the blueprint has 31"},
+	} {
+		profile.Blueprint = filepath.Join(t.TempDir(), "bp.toml")
+		if err := os.WriteFile(profile.Blueprint, []byte(strings.Replace(string(src), tc.from, tc.to, 1)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := CheckBlueprint(profile)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Fatalf("CheckBlueprint with %q: err = %v, want %q", tc.to, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package kvsp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Client talks to a Server.
+type Client struct {
+	// URL is the base URL of the server, e.g. "http://localhost:8080".
+	URL string
+	// Token is sent as "Authorization: Bearer TOKEN" if not empty.
+	Token string
+	// HTTP is used for the requests; http.DefaultClient if nil.
+	HTTP *http.Client
+}
+
+func (c *Client) do(method, path string, body io.Reader, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, strings.TrimRight(c.URL, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	for key, vals := range header {
+		req.Header[key] = vals
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	httpClient := c.HTTP
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return httpClient.Do(req)
+}
+
+// responseError returns the error of the response res if it failed.
+func responseError(res *http.Response) error {
+	if res.StatusCode/100 == 2 {
+		return nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 4096))
+	return fmt.Errorf("server: %s: %s", res.Status, strings.TrimSpace(string(msg)))
+}
+
+func (c *Client) doJSON(method, path string, body io.Reader, header http.Header, v interface{}) error {
+	res, err := c.do(method, path, body, header)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if err := responseError(res); err != nil {
+		return err
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// UploadKey uploads the bootstrapping key keyFileName unless the server has
+// it already, and returns its ID.
+func (c *Client) UploadKey(keyFileName string) (string, error) {
+	id, err := fileSHA256(keyFileName)
+	if err != nil {
+		return "", err
+	}
+	res, err := c.do(http.MethodHead, "/keys/"+id, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	res.Body.Close()
+	if res.StatusCode == http.StatusOK {
+		return id, nil
+	}
+	if res.StatusCode != http.StatusNotFound {
+		return "", responseError(res)
+	}
+
+	f, err := os.Open(keyFileName)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	header, err := fingerprintHeader(keyFileName)
+	if err != nil {
+		return "", err
+	}
+	res, err = c.do(http.MethodPut, "/keys/"+id, f, header)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	return id, responseError(res)
+}
+
+// fingerprintHeader returns the header carrying the key fingerprint of
+// fileName, if known.
+func fingerprintHeader(fileName string) (http.Header, error) {
+	fingerprint, err := recordedFingerprint(fileName)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{}
+	if fingerprint != "" {
+		header.Set(keyFingerprintHeader, fingerprint)
+	}
+	return header, nil
+}
+
+// Submit submits the encrypted packet inputFileName to run on cpu for cycles
+// clocks with the bootstrapping key keyID.
+func (c *Client) Submit(keyID, inputFileName string, cycles uint, cpu string) (*Job, error) {
+	f, err := os.Open(inputFileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	header, err := fingerprintHeader(inputFileName)
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{
+		"key":    {keyID},
+		"cycles": {fmt.Sprint(cycles)},
+		"cpu":    {cpu},
+	}
+	var job Job
+	if err := c.doJSON(http.MethodPost, "/jobs?"+query.Encode(), f, header, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// SubmitResume submits a job which resumes from the snapshot of the job
+// jobID for cycles more clocks.
+func (c *Client) SubmitResume(jobID string, cycles uint) (*Job, error) {
+	query := url.Values{
+		"resume": {jobID},
+		"cycles": {fmt.Sprint(cycles)},
+	}
+	var job Job
+	if err := c.doJSON(http.MethodPost, "/jobs?"+query.Encode(), nil, nil, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Job returns the job jobID.
+func (c *Client) Job(jobID string) (*Job, error) {
+	var job Job
+	if err := c.doJSON(http.MethodGet, "/jobs/"+url.PathEscape(jobID), nil, nil, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Jobs returns all jobs on the server.
+func (c *Client) Jobs() ([]Job, error) {
+	var jobs []Job
+	if err := c.doJSON(http.MethodGet, "/jobs", nil, nil, &jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// Fetch downloads the encrypted result of the finished job jobID to
+// outputFileName, and its snapshot to snapshotFileName if not empty.
+func (c *Client) Fetch(jobID, outputFileName, snapshotFileName string) error {
+	job, err := c.Job(jobID)
+	if err != nil {
+		return err
+	}
+	if err := c.download("/jobs/"+url.PathEscape(jobID)+"/result", outputFileName); err != nil {
+		return err
+	}
+	if err := writeFileMeta(outputFileName, "result", job.KeyFingerprint); err != nil {
+		return err
+	}
+	if snapshotFileName == "" {
+		return nil
+	}
+	return c.download("/jobs/"+url.PathEscape(jobID)+"/snapshot", snapshotFileName)
+}
+
+func (c *Client) download(path, fileName string) error {
+	res, err := c.do(http.MethodGet, path, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if err := responseError(res); err != nil {
+		return err
+	}
+	f, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, res.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,74 @@
+package kvsp
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// ConfigFile is the name of the project configuration file which kvsp reads
+// from the working directory.
+const ConfigFile = "kvsp.toml"
+
+// Config is a project configuration file. Its values are those of the
+// command-line flags, named without leading dashes, e.g. cpu = "ruby" or
+// iyokan-args = ["--enable-gpu"].
+type Config struct {
+	// Defaults holds the flags of all commands which have them.
+	Defaults map[string]interface{} `toml:"defaults"`
+	// Commands holds the flags of each command, e.g. "run" or "queue add".
+	Commands map[string]map[string]interface{} `toml:"commands"`
+	// Keys holds named key sets.
+	Keys map[string]KeySet `toml:"keys"`
+	// Programs holds the flags, e.g. the cycle budget, of each program,
+	// named as ProgramName does.
+	Programs map[string]map[string]interface{} `toml:"programs"`
+}
+
+// KeySet is a pair of a secret key and its bootstrapping key.
+type KeySet struct {
+	Secret        string `toml:"secret"`
+	Bootstrapping string `toml:"bootstrapping"`
+}
+
+// LoadConfig reads the configuration file fileName. The paths of key sets
+// are resolved against the directory of fileName.
+func LoadConfig(fileName string) (*Config, error) {
+	var config Config
+	md, err := toml.DecodeFile(fileName, &config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration %s: %v", fileName, err)
+	}
+	for _, key := range md.Undecoded() {
+		// The tables of flags hold anything; the commands check them.
+		switch key[0] {
+		case "defaults", "commands", "programs":
+			continue
+		}
+		return nil, fmt.Errorf("invalid configuration %s: unknown key %q", fileName, key.String())
+	}
+
+	dir := filepath.Dir(fileName)
+	for name, keys := range config.Keys {
+		for _, path := range []*string{&keys.Secret, &keys.Bootstrapping} {
+			if *path != "" && !filepath.IsAbs(*path) {
+				*path = filepath.Join(dir, *path)
+			}
+		}
+		config.Keys[name] = keys
+	}
+	return &config, nil
+}
+
+// ProgramName returns the name of the program in fileName, an ELF file or a
+// packet made of it, i.e. its base name up to the first dot: "fib" for
+// "fib", "fib.exe", and "out/fib.enc".
+func ProgramName(fileName string) string {
+	name := filepath.Base(fileName)
+	if i := strings.Index(name, "."); i > 0 {
+		name = name[:i]
+	}
+	return name
+}
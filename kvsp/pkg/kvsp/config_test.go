@@ -0,0 +1,54 @@
+package kvsp
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	fileName := writeTestFile(t, dir, "kvsp.toml", `
+[defaults]
+cpu = "ruby"
+
+[commands.run]
+iyokan-args = ["--enable-gpu"]
+
+[keys.main]
+secret = "keys/secret.key"
+bootstrapping = "/keys/bootstrapping.key"
+
+[programs.fib]
+cycles = 30
+`)
+	config, err := LoadConfig(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := config.Keys["main"]; keys.Secret != filepath.Join(dir, "keys/secret.key") || keys.Bootstrapping != "/keys/bootstrapping.key" {
+		t.Errorf("keys = %+v", keys)
+	}
+	if config.Defaults["cpu"] != "ruby" || config.Programs["fib"]["cycles"] != int64(30) {
+		t.Errorf("config = %+v", config)
+	}
+
+	fileName = writeTestFile(t, dir, "bad.toml", "[keys.main]\nsecert = \"secret.key\"\n")
+	if _, err := LoadConfig(fileName); err == nil || !strings.Contains(err.Error(), "secert") {
+		t.Errorf("LoadConfig() with a typo = %v", err)
+	}
+}
+
+func TestProgramName(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"fib", "fib"},
+		{"fib.exe", "fib"},
+		{"out/fib.enc", "fib"},
+		{"fib.result.enc", "fib"},
+		{".hidden", ".hidden"},
+	} {
+		if got := ProgramName(tc.in); got != tc.want {
+			t.Errorf("ProgramName(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
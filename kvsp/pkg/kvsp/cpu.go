@@ -0,0 +1,251 @@
+package kvsp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// RAMBaseAddr is the address where RAM is mapped in the CPU's address space.
+// Addresses below it belong to ROM.
+const RAMBaseAddr = 0x10000
+
+// CPUProfile describes the memory layout and register file of a CPU that
+// KVSP can run. Profiles are loaded from TOML files; see share/cpus.
+type CPUProfile struct {
+	Name string `toml:"name"`
+	// ISA selects the compiler target: "cahp" or "rv32i".
+	ISA string `toml:"isa"`
+	// Blueprint is the Iyokan blueprint of the CPU.
+	Blueprint string `toml:"blueprint"`
+	// Runtime is the directory of the C runtime (crt0.o, libc.a, ...).
+	Runtime string `toml:"runtime"`
+	// LinkerScript is the linker script in Runtime, used for rv32i.
+	LinkerScript       string `toml:"linker_script"`
+	ROMSize            uint64 `toml:"rom_size"`
+	RAMSize            uint64 `toml:"ram_size"`
+	PointerWidth       int    `toml:"pointer_width"`
+	StackAlign         int    `toml:"stack_align"`
+	StackPointerOffset uint64 `toml:"stack_pointer_offset"`
+	RegCount           int    `toml:"reg_count"`
+	RegWidth           int    `toml:"reg_width"`
+	// ReturnRegister is the index of the register in which main() returns.
+	ReturnRegister int `toml:"return_register"`
+}
+
+// CPUProfilesDir returns the directory searched for CPU profiles,
+// ../share/kvsp/cpus relative to the running executable unless
+// KVSP_CPU_PROFILES_PATH is set.
+func CPUProfilesDir() (string, error) {
+	return lookupPath("CPU-PROFILES", "../share/kvsp/cpus", "")
+}
+
+// LoadCPUProfile reads and validates the CPU profile in fileName. Relative
+// paths in it are resolved against the directory of fileName.
+func LoadCPUProfile(fileName string) (CPUProfile, error) {
+	var profile CPUProfile
+	md, err := toml.DecodeFile(fileName, &profile)
+	if err != nil {
+		return CPUProfile{}, fmt.Errorf("invalid CPU profile %s: %v", fileName, err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return CPUProfile{}, fmt.Errorf("invalid CPU profile %s: unknown key %q", fileName, undecoded[0].String())
+	}
+	if err := profile.validate(); err != nil {
+		return CPUProfile{}, fmt.Errorf("invalid CPU profile %s: %v", fileName, err)
+	}
+
+	dir := filepath.Dir(fileName)
+	profile.Name = strings.ToLower(profile.Name)
+	if !filepath.IsAbs(profile.Blueprint) {
+		profile.Blueprint = filepath.Join(dir, profile.Blueprint)
+	}
+	if !filepath.IsAbs(profile.Runtime) {
+		profile.Runtime = filepath.Join(dir, profile.Runtime)
+	}
+	return profile, nil
+}
+
+func (profile *CPUProfile) validate() error {
+	switch {
+	case profile.Name == "":
+		return errors.New("name is missing")
+	case profile.ISA != "cahp" && profile.ISA != "rv32i":
+		return fmt.Errorf("isa must be cahp or rv32i, not %q", profile.ISA)
+	case profile.Blueprint == "":
+		return errors.New("blueprint is missing")
+	case profile.Runtime == "":
+		return errors.New("runtime is missing")
+	case profile.ISA == "rv32i" && profile.LinkerScript == "":
+		return errors.New("linker_script is missing")
+	case profile.ROMSize == 0:
+		return errors.New("rom_size must be positive")
+	case profile.RAMSize == 0:
+		return errors.New("ram_size must be positive")
+	case profile.PointerWidth != 2 && profile.PointerWidth != 4:
+		return fmt.Errorf("pointer_width must be 2 or 4, not %d", profile.PointerWidth)
+	case profile.StackAlign <= 0:
+		return errors.New("stack_align must be positive")
+	case profile.StackPointerOffset+uint64(profile.PointerWidth) > profile.RAMSize:
+		return errors.New("stack_pointer_offset is outside RAM")
+	case profile.RegCount <= 0:
+		return errors.New("reg_count must be positive")
+	case profile.RegWidth <= 0 || profile.RegWidth%8 != 0:
+		return fmt.Errorf("reg_width must be a positive multiple of 8, not %d", profile.RegWidth)
+	case profile.ReturnRegister <= 0 || profile.ReturnRegister >= profile.RegCount:
+		return fmt.Errorf("return_register must be between 1 and reg_count - 1, not %d", profile.ReturnRegister)
+	}
+	return nil
+}
+
+// CPUProfileError is why a file of a profile directory is left out by
+// LoadCPUProfiles.
+type CPUProfileError struct {
+	// Name is the CPU which the file defines, or the name of the file
+	// without .toml if it cannot be loaded.
+	Name     string
+	FileName string
+	Err      error
+}
+
+func (e *CPUProfileError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *CPUProfileError) Unwrap() error {
+	return e.Err
+}
+
+// LoadCPUProfiles loads every *.toml in dir, keyed by profile name. The files
+// which cannot be loaded, and every definition of a CPU defined twice, are
+// left out and returned in errs, so that they do not hide the others.
+func LoadCPUProfiles(dir string) (profiles map[string]CPUProfile, errs []*CPUProfileError) {
+	fileNames, _ := filepath.Glob(filepath.Join(dir, "*.toml"))
+	profiles = make(map[string]CPUProfile)
+	definedIn := make(map[string][]string)
+	for _, fileName := range fileNames {
+		profile, err := LoadCPUProfile(fileName)
+		if err != nil {
+			name := strings.ToLower(strings.TrimSuffix(filepath.Base(fileName), ".toml"))
+			errs = append(errs, &CPUProfileError{Name: name, FileName: fileName, Err: err})
+			continue
+		}
+		profiles[profile.Name] = profile
+		definedIn[profile.Name] = append(definedIn[profile.Name], fileName)
+	}
+	names := make([]string, 0, len(definedIn))
+	for name := range definedIn {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if fileNames := definedIn[name]; len(fileNames) > 1 {
+			delete(profiles, name)
+			err := fmt.Errorf("CPU %q is defined twice in %s", name, strings.Join(fileNames, " and "))
+			errs = append(errs, &CPUProfileError{Name: name, FileName: fileNames[1], Err: err})
+		}
+	}
+	return profiles, errs
+}
+
+// loadCPUProfiles is LoadCPUProfiles of CPUProfilesDir which warns about the
+// files left out, except for the error about the CPU named name if any.
+func loadCPUProfiles(name string) (map[string]CPUProfile, error) {
+	dir, err := CPUProfilesDir()
+	if err != nil {
+		return nil, err
+	}
+	profiles, errs := LoadCPUProfiles(dir)
+	var nameErr error
+	for _, err := range errs {
+		if err.Name == name {
+			nameErr = err
+			continue
+		}
+		warnOnce(fmt.Sprintf("%v; it is ignored", err))
+	}
+	return profiles, nameErr
+}
+
+// CPUProfileNames returns the names of the CPU profiles in CPUProfilesDir.
+// It warns about the profiles which cannot be loaded.
+func CPUProfileNames() ([]string, error) {
+	profiles, err := loadCPUProfiles("")
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// GetCPUProfile returns the profile of the CPU named name in CPUProfilesDir.
+// The profiles which cannot be loaded are only warned about, unless one is
+// the CPU's, i.e. defines it or is named after it.
+func GetCPUProfile(name string) (CPUProfile, error) {
+	name = strings.ToLower(name)
+	profiles, err := loadCPUProfiles(name)
+	if err != nil {
+		return CPUProfile{}, err
+	}
+	profile, ok := profiles[name]
+	if !ok {
+		return CPUProfile{}, fmt.Errorf("unknown CPU %q", name)
+	}
+	return profile, nil
+}
+
+// builtinPathNames maps the built-in CPUs to the NAMEs of the KVSP_NAME_PATH
+// variables which override their blueprint and runtime, as they did before
+// CPUs were described by profiles.
+var builtinPathNames = map[string]struct{ blueprint, runtime string }{
+	"ruby":        {"IYOKAN-BLUEPRINT-RUBY", "CAHP_RT"},
+	"pearl":       {"IYOKAN-BLUEPRINT-PEARL", "CAHP_RT"},
+	"alexandrite": {"IYOKAN-BLUEPRINT-ALEXANDRITE", "ALEXANDRITE_RT"},
+}
+
+// overriddenPath returns KVSP_<NAME>_PATH if it is set, and otherwise path.
+func overriddenPath(name, path string) (string, error) {
+	if name == "" {
+		return path, nil
+	}
+	envName := pathEnvName(name)
+	envPath := os.Getenv(envName)
+	if envPath == "" {
+		return path, nil
+	}
+	if _, err := os.Stat(envPath); err != nil {
+		return "", fmt.Errorf("%s not found at %s (set by %s)", name, envPath, envName)
+	}
+	return envPath, nil
+}
+
+func (profile *CPUProfile) blueprintPath() (string, error) {
+	path, err := overriddenPath(builtinPathNames[profile.Name].blueprint, profile.Blueprint)
+	if err != nil {
+		return "", err
+	}
+	if !fileExists(path) {
+		return "", fmt.Errorf("blueprint of CPU %q not found at %s", profile.Name, path)
+	}
+	return path, nil
+}
+
+func (profile *CPUProfile) runtimePath() (string, error) {
+	path, err := overriddenPath(builtinPathNames[profile.Name].runtime, profile.Runtime)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("runtime of CPU %q not found at %s", profile.Name, path)
+	}
+	return path, nil
+}
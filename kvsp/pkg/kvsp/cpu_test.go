@@ -0,0 +1,134 @@
+package kvsp
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testCPUProfilesDir = "../../../share/cpus"
+
+func testProfile(t *testing.T, name string) CPUProfile {
+	t.Helper()
+	profile, err := LoadCPUProfile(filepath.Join(testCPUProfilesDir, name+".toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return profile
+}
+
+func TestLoadCPUProfiles(t *testing.T) {
+	t.Setenv("KVSP_CPU_PROFILES_PATH", testCPUProfilesDir)
+	names, err := CPUProfileNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(names, ","); got != "alexandrite,pearl,ruby" {
+		t.Fatalf("CPUProfileNames() = %s", got)
+	}
+
+	profile, err := GetCPUProfile("Alexandrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.ISA != "rv32i" || profile.RAMSize != 1024 || profile.RegCount != 32 {
+		t.Fatalf("alexandrite profile = %+v", profile)
+	}
+	if want := filepath.Join(testCPUProfilesDir, "../alexandrite.toml"); profile.Blueprint != want {
+		t.Fatalf("blueprint = %s, want %s", profile.Blueprint, want)
+	}
+	if _, err := GetCPUProfile("emerald"); err == nil {
+		t.Fatal("GetCPUProfile accepted an unknown CPU")
+	}
+}
+
+func TestLoadCPUProfilesSkipsBadFiles(t *testing.T) {
+	dir := t.TempDir()
+	ruby, err := os.ReadFile(filepath.Join(testCPUProfilesDir, "ruby.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pearl := strings.Replace(string(ruby), `name = "ruby"`, `name = "pearl"`, 1)
+	for name, content := range map[string]string{
+		"ruby.toml":   string(ruby),
+		"pearl.toml":  pearl,
+		"pearl2.toml": pearl,
+		"broken.toml": "name = ",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("KVSP_CPU_PROFILES_PATH", dir)
+
+	profiles, errs := LoadCPUProfiles(dir)
+	if len(profiles) != 1 || len(errs) != 2 || errs[0].Name != "broken" || errs[1].Name != "pearl" {
+		t.Fatalf("LoadCPUProfiles() = %v, %v", profiles, errs)
+	}
+	if names, err := CPUProfileNames(); err != nil || strings.Join(names, ",") != "ruby" {
+		t.Errorf("CPUProfileNames() = %q, %v", names, err)
+	}
+	if _, err := GetCPUProfile("ruby"); err != nil {
+		t.Errorf("a broken profile hides ruby: %v", err)
+	}
+	if _, err := GetCPUProfile("Broken"); err == nil || !strings.Contains(err.Error(), "broken.toml") {
+		t.Errorf("GetCPUProfile(Broken) = %v", err)
+	}
+	if _, err := GetCPUProfile("pearl"); err == nil || !strings.Contains(err.Error(), "defined twice") {
+		t.Errorf("GetCPUProfile(pearl) = %v", err)
+	}
+}
+
+func TestLoadCPUProfileValidates(t *testing.T) {
+	base, err := os.ReadFile(filepath.Join(testCPUProfilesDir, "ruby.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ from, to, want string }{
+		{`isa = "cahp"`, `isa = "arm"`, "isa must be"},
+		{"ram_size = 512", "ram_size = 256", "stack_pointer_offset is outside RAM"},
+		{"reg_width = 16", "reg_width = 12", "reg_width must be"},
+		{"reg_count = 16", "reg_count = 16\nregs = 16", `unknown key "regs"`},
+	} {
+		fileName := filepath.Join(t.TempDir(), "cpu.toml")
+		src := strings.Replace(string(base), tc.from, tc.to, 1)
+		if err := os.WriteFile(fileName, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadCPUProfile(fileName)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Fatalf("LoadCPUProfile with %q: err = %v, want %q", tc.to, err, tc.want)
+		}
+	}
+}
+
+func TestBuiltinCPUPathOverrides(t *testing.T) {
+	dir := t.TempDir()
+	blueprint := filepath.Join(dir, "pearl.toml")
+	if err := os.WriteFile(blueprint, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KVSP_IYOKAN_BLUEPRINT_PEARL_PATH", blueprint)
+	t.Setenv("KVSP_CAHP_RT_PATH", dir)
+
+	pearl := testProfile(t, "pearl")
+	if got, err := pearl.blueprintPath(); err != nil || got != blueprint {
+		t.Errorf("blueprintPath() = %q, %v, want %q", got, err, blueprint)
+	}
+	if got, err := pearl.runtimePath(); err != nil || got != dir {
+		t.Errorf("runtimePath() = %q, %v, want %q", got, err, dir)
+	}
+
+	// A variable pointing nowhere is an error, not a fallback.
+	t.Setenv("KVSP_CAHP_RT_PATH", filepath.Join(dir, "missing"))
+	ruby := testProfile(t, "ruby")
+	if _, err := ruby.runtimePath(); err == nil || !strings.Contains(err.Error(), "KVSP_CAHP_RT_PATH") {
+		t.Errorf("runtimePath() = %v, want the error about KVSP_CAHP_RT_PATH", err)
+	}
+	// Overrides of other CPUs are not read.
+	alexandrite := testProfile(t, "alexandrite")
+	if got, _ := alexandrite.blueprintPath(); got == blueprint {
+		t.Errorf("alexandrite read KVSP_IYOKAN_BLUEPRINT_PEARL_PATH")
+	}
+}
@@ -0,0 +1,314 @@
+package kvsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Diagnosis is what Diagnose finds out about the installation of KVSP and
+// the machine it runs on.
+type Diagnosis struct {
+	// Files are the binaries and data files known to GetPathOf and friends.
+	Files []FileCheck `json:"files"`
+	// Overrides are the KVSP_*_PATH variables which are set.
+	Overrides map[string]string `json:"overrides"`
+	Host      HostCPU           `json:"host"`
+	// GPUs is the number of NVIDIA GPUs which nvidia-smi finds.
+	GPUs     int            `json:"gpus"`
+	Backends []BackendCheck `json:"backends"`
+	CPUs     []CPUCheck     `json:"cpus"`
+	// Problems are the reasons why some commands will fail or run slowly.
+	Problems []string `json:"problems,omitempty"`
+}
+
+// FileCheck is the resolved path of a file, or why it is missing.
+type FileCheck struct {
+	Name  string `json:"name"`
+	Path  string `json:"path,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// HostCPU is the SIMD support of the host CPU which the evaluators need.
+type HostCPU struct {
+	AVX2   bool   `json:"avx2"`
+	AVX512 bool   `json:"avx512"`
+	Error  string `json:"error,omitempty"`
+}
+
+// BackendCheck is what Probe finds out about a backend.
+type BackendCheck struct {
+	Name      string `json:"name"`
+	Evaluator string `json:"evaluator,omitempty"`
+	Packet    string `json:"packet,omitempty"`
+	// Fallback is true if the fallback binaries, i.e. Tangor's AVX2 build,
+	// are used.
+	Fallback bool       `json:"fallback"`
+	GPU      GPUSupport `json:"gpu,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// CPUCheck is the blueprint and runtime files of a CPU profile.
+type CPUCheck struct {
+	Name  string      `json:"name"`
+	Files []FileCheck `json:"files"`
+}
+
+// Diagnose resolves every file which the commands of KVSP use for each
+// backend and CPU, and checks that the host can run them. What is missing
+// is in Problems.
+func Diagnose() *Diagnosis {
+	d := &Diagnosis{Overrides: pathOverrides(os.Environ())}
+
+	for _, name := range []string{"CLANG", "CAHP_SIM"} {
+		path, err := GetPathOf(name)
+		d.addFile(&d.Files, name, path, err)
+	}
+	profilesDir, err := CPUProfilesDir()
+	d.addFile(&d.Files, "CPU-PROFILES", profilesDir, err)
+	throughput, err := ThroughputFile()
+	d.addFile(&d.Files, "THROUGHPUT", throughput, err)
+
+	if d.Host, err = readHostCPU("/proc/cpuinfo"); err != nil {
+		d.Host.Error = err.Error()
+	} else if !d.Host.AVX2 {
+		d.Problems = append(d.Problems, "the CPU does not support AVX2, which the evaluators need")
+	}
+	d.GPUs = CountGPUs()
+
+	for _, name := range BackendNames() {
+		d.Backends = append(d.Backends, d.checkBackend(backends[name]))
+	}
+
+	if profilesDir != "" {
+		profiles, errs := LoadCPUProfiles(profilesDir)
+		for _, err := range errs {
+			d.Problems = append(d.Problems, err.Error())
+		}
+		names := make([]string, 0, len(profiles))
+		for name := range profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			d.CPUs = append(d.CPUs, d.checkCPU(profiles[name]))
+		}
+	}
+	return d
+}
+
+// addFile appends the result of resolving the file name to files, and the
+// error to the problems.
+func (d *Diagnosis) addFile(files *[]FileCheck, name, path string, err error) {
+	check := FileCheck{Name: name, Path: path}
+	if err != nil {
+		check.Error = err.Error()
+		d.Problems = append(d.Problems, err.Error())
+	}
+	*files = append(*files, check)
+}
+
+func (d *Diagnosis) checkBackend(b Backend) BackendCheck {
+	check := BackendCheck{Name: b.Name()}
+	caps, err := b.Probe()
+	if err != nil {
+		check.Error = err.Error()
+		d.Problems = append(d.Problems, fmt.Sprintf("backend %s: %v", b.Name(), err))
+		return check
+	}
+	check.Evaluator, check.Packet, check.GPU = caps.Evaluator, caps.Packet, caps.GPU
+
+	// Backends with a fallback prefer their AVX-512 build, unless a variable,
+	// maybe the deprecated KVSP_IYOKAN_PATH, picks it.
+	ib, ok := b.(*iyokanCompatibleBackend)
+	if !ok || ib.evaluatorFallback == "" || d.Overrides[pathEnvName(ib.envName)] != "" ||
+		d.Overrides[pathEnvName(legacyEnvName)] != "" {
+		return check
+	}
+	check.Fallback = filepath.Base(caps.Evaluator) == ib.evaluatorFallback
+	if !check.Fallback && d.Host.Error == "" && !d.Host.AVX512 {
+		d.Problems = append(d.Problems, fmt.Sprintf(
+			"backend %s: %s is the AVX-512 build, but the CPU does not support AVX-512", b.Name(), caps.Evaluator))
+	}
+	return check
+}
+
+func (d *Diagnosis) checkCPU(profile CPUProfile) CPUCheck {
+	check := CPUCheck{Name: profile.Name}
+	blueprint, err := profile.blueprintPath()
+	d.addFile(&check.Files, "blueprint", blueprint, err)
+	runtime, err := profile.runtimePath()
+	d.addFile(&check.Files, "runtime", runtime, err)
+	if err != nil {
+		return check
+	}
+	names := []string{"crt0.o", "libc.a"}
+	if profile.LinkerScript != "" {
+		names = append(names, profile.LinkerScript)
+	}
+	for _, name := range names {
+		path := filepath.Join(runtime, name)
+		var err error
+		if !fileExists(path) {
+			err = fmt.Errorf("%s of CPU %q not found at %s", name, profile.Name, path)
+			path = ""
+		}
+		d.addFile(&check.Files, name, path, err)
+	}
+	return check
+}
+
+// pathOverrides returns the KVSP_*_PATH variables in environ which are set.
+func pathOverrides(environ []string) map[string]string {
+	overrides := map[string]string{}
+	for _, kv := range environ {
+		name, value, ok := strings.Cut(kv, "=")
+		if ok && value != "" && strings.HasPrefix(name, "KVSP_") && strings.HasSuffix(name, "_PATH") {
+			overrides[name] = value
+		}
+	}
+	return overrides
+}
+
+// readHostCPU reads the flags of the first processor in the cpuinfo file
+// fileName.
+func readHostCPU(fileName string) (HostCPU, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return HostCPU{}, err
+	}
+	defer f.Close()
+	return parseCPUInfo(f)
+}
+
+func parseCPUInfo(r io.Reader) (HostCPU, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok || strings.TrimSpace(key) != "flags" {
+			continue
+		}
+		var host HostCPU
+		for _, flag := range strings.Fields(value) {
+			switch flag {
+			case "avx2":
+				host.AVX2 = true
+			case "avx512f":
+				host.AVX512 = true
+			}
+		}
+		return host, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return HostCPU{}, err
+	}
+	return HostCPU{}, fmt.Errorf("no CPU flags in cpuinfo")
+}
+
+// CountGPUs returns the number of NVIDIA GPUs which nvidia-smi finds, or 0
+// if it is not installed.
+func CountGPUs() int {
+	out, err := exec.Command("nvidia-smi", "-L").Output()
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "GPU ") {
+			n++
+		}
+	}
+	return n
+}
+
+// Print writes d in text to w.
+func (d *Diagnosis) Print(w io.Writer) error {
+	printFile := func(indent string, f FileCheck) {
+		if f.Error != "" {
+			fmt.Fprintf(w, "%s%s\tMISSING\t%s\n", indent, f.Name, f.Error)
+		} else {
+			fmt.Fprintf(w, "%s%s\t%s\n", indent, f.Name, f.Path)
+		}
+	}
+
+	fmt.Fprintln(w, "Files:")
+	for _, f := range d.Files {
+		printFile("\t", f)
+	}
+
+	fmt.Fprintln(w, "Overrides:")
+	names := make([]string, 0, len(d.Overrides))
+	for name := range d.Overrides {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "\t%s=%s\n", name, d.Overrides[name])
+	}
+	if len(names) == 0 {
+		fmt.Fprintln(w, "\t(none)")
+	}
+
+	fmt.Fprintln(w, "Host:")
+	if d.Host.Error != "" {
+		fmt.Fprintf(w, "\tCPU flags unknown\t%s\n", d.Host.Error)
+	} else {
+		fmt.Fprintf(w, "\tAVX2\t%s\n", yesNo(d.Host.AVX2))
+		fmt.Fprintf(w, "\tAVX-512\t%s\n", yesNo(d.Host.AVX512))
+	}
+	fmt.Fprintf(w, "\tGPUs\t%d\n", d.GPUs)
+
+	fmt.Fprintln(w, "Backends:")
+	for _, b := range d.Backends {
+		if b.Error != "" {
+			fmt.Fprintf(w, "\t%s\tMISSING\t%s\n", b.Name, b.Error)
+			continue
+		}
+		build := ""
+		if b.Fallback {
+			build = " (AVX2 build)"
+		}
+		fmt.Fprintf(w, "\t%s\t%s%s\n", b.Name, b.Evaluator, build)
+		fmt.Fprintf(w, "\t\tpacket\t%s\n", b.Packet)
+		fmt.Fprintf(w, "\t\tGPU support\t%s\n", b.GPU)
+	}
+
+	fmt.Fprintln(w, "CPUs:")
+	for _, cpu := range d.CPUs {
+		fmt.Fprintf(w, "\t%s\n", cpu.Name)
+		for _, f := range cpu.Files {
+			printFile("\t\t", f)
+		}
+	}
+
+	if len(d.Problems) == 0 {
+		fmt.Fprintln(w, "No problems found.")
+		return nil
+	}
+	fmt.Fprintf(w, "%d problem(s) found:\n", len(d.Problems))
+	for _, problem := range d.Problems {
+		fmt.Fprintf(w, "\t%s\n", problem)
+	}
+	return nil
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// PrintJSON writes d to w as an indented JSON object.
+func (d *Diagnosis) PrintJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(d)
+}
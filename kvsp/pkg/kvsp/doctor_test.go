@@ -0,0 +1,107 @@
+package kvsp
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseCPUInfo(t *testing.T) {
+	for _, tc := range []struct {
+		cpuinfo string
+		want    HostCPU
+	}{
+		{"processor\t: 0\nflags\t\t: fpu sse2 avx avx2\n", HostCPU{AVX2: true}},
+		{"processor\t: 0\nflags\t\t: avx2 avx512f avx512dq\n\nprocessor\t: 1\nflags\t\t: sse2\n", HostCPU{AVX2: true, AVX512: true}},
+		{"processor\t: 0\nflags\t\t: sse2 avx512vl\n", HostCPU{}},
+	} {
+		got, err := parseCPUInfo(strings.NewReader(tc.cpuinfo))
+		if err != nil || got != tc.want {
+			t.Errorf("parseCPUInfo(%q) = %+v, %v, want %+v", tc.cpuinfo, got, err, tc.want)
+		}
+	}
+	if _, err := parseCPUInfo(strings.NewReader("processor\t: 0\n")); err == nil {
+		t.Error("parseCPUInfo() accepted cpuinfo without flags")
+	}
+}
+
+func TestDiagnose(t *testing.T) {
+	dir := t.TempDir()
+	for _, sub := range []string{"cpus", "rt"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"clang", "iyokan", "iyokan-packet", "throughput.toml", "ruby.toml", "rt/crt0.o"} {
+		writeTestFile(t, filepath.Dir(filepath.Join(dir, name)), filepath.Base(name), "")
+	}
+	profilesDir := filepath.Join(dir, "cpus")
+	writeTestFile(t, profilesDir, "ruby.toml", `name = "ruby"
+isa = "cahp"
+blueprint = "../ruby.toml"
+runtime = "../rt"
+rom_size = 512
+ram_size = 512
+pointer_width = 2
+stack_align = 2
+stack_pointer_offset = 510
+reg_count = 16
+reg_width = 16
+return_register = 8
+`)
+	for _, name := range []string{"iyokan", "iyokan-packet"} {
+		if err := os.Chmod(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("KVSP_CLANG_PATH", filepath.Join(dir, "clang"))
+	t.Setenv("KVSP_CAHP_SIM_PATH", filepath.Join(dir, "cahp-sim"))
+	t.Setenv("KVSP_CPU_PROFILES_PATH", profilesDir)
+	t.Setenv("KVSP_THROUGHPUT_PATH", filepath.Join(dir, "throughput.toml"))
+	t.Setenv("KVSP_IYOKAN_PATH", filepath.Join(dir, "iyokan"))
+	t.Setenv("KVSP_IYOKAN_PACKET_PATH", filepath.Join(dir, "iyokan-packet"))
+	t.Setenv("KVSP_TANGOR_IYOKAN_PATH", filepath.Join(dir, "iyokan"))
+	t.Setenv("KVSP_TANGOR_IYOKAN_PACKET_PATH", filepath.Join(dir, "iyokan-packet"))
+
+	d := Diagnose()
+	if got := d.Overrides["KVSP_CLANG_PATH"]; got != filepath.Join(dir, "clang") {
+		t.Errorf("Overrides[KVSP_CLANG_PATH] = %q", got)
+	}
+	for _, f := range d.Files {
+		if missing := f.Name == "CAHP_SIM"; missing != (f.Error != "") {
+			t.Errorf("file %+v", f)
+		}
+	}
+	for _, b := range d.Backends {
+		if b.Error != "" || b.Evaluator != filepath.Join(dir, "iyokan") || b.Fallback {
+			t.Errorf("backend %+v", b)
+		}
+	}
+	if len(d.CPUs) != 1 || d.CPUs[0].Name != "ruby" {
+		t.Fatalf("CPUs = %+v", d.CPUs)
+	}
+	missing := map[string]bool{}
+	for _, f := range d.CPUs[0].Files {
+		missing[f.Name] = f.Error != ""
+	}
+	if missing["blueprint"] || missing["runtime"] || missing["crt0.o"] || !missing["libc.a"] {
+		t.Errorf("files of ruby = %+v", d.CPUs[0].Files)
+	}
+
+	problems := strings.Join(d.Problems, "\n")
+	for _, want := range []string{"CAHP_SIM not found", "libc.a of CPU \"ruby\" not found"} {
+		if !strings.Contains(problems, want) {
+			t.Errorf("problems = %q, want %q", d.Problems, want)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := d.Print(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "\tlibc.a\tMISSING\t") {
+		t.Errorf("Print() = %q", buf.String())
+	}
+}
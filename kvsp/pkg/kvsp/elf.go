@@ -0,0 +1,295 @@
+package kvsp
+
+import (
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+)
+
+func writeLE(out []byte, val uint64) {
+	for i := range out {
+		out[i] = byte((val >> (8 * i)) & 0xff)
+	}
+}
+
+// Segment is a PT_LOAD segment of an ELF file.
+type Segment struct {
+	Addr     uint64
+	FileSize uint64
+	MemSize  uint64
+}
+
+// Image is the initial content of ROM and RAM built from an ELF file.
+type Image struct {
+	ROM []byte
+	RAM []byte
+	// RAMSegments are the segments loaded into RAM, each of which occupies
+	// MemSize bytes including its zero-filled part such as .bss.
+	RAMSegments []Segment
+}
+
+// elfTarget is what an ISA expects of the ELF header.
+type elfTarget struct {
+	class elf.Class
+	data  elf.Data
+	// machine is EM_NONE if the ISA has no machine number of its own.
+	machine elf.Machine
+}
+
+var elfTargets = map[string]elfTarget{
+	// llvm-cahp's machine number is not registered, so CAHP executables
+	// are identified only by not being any other ISA's.
+	"cahp":  {elf.ELFCLASS32, elf.ELFDATA2LSB, elf.EM_NONE},
+	"rv32i": {elf.ELFCLASS32, elf.ELFDATA2LSB, elf.EM_RISCV},
+}
+
+// checkELFHeader checks that input is an executable linked for profile.
+func checkELFHeader(input *elf.File, profile CPUProfile) error {
+	target, ok := elfTargets[profile.ISA]
+	if !ok {
+		return fmt.Errorf("unknown ISA %q", profile.ISA)
+	}
+	cpu := fmt.Sprintf("CPU %q (%s)", profile.Name, profile.ISA)
+
+	if input.Class != target.class {
+		return fmt.Errorf("Invalid ELF: class is %v but %s expects %v", input.Class, cpu, target.class)
+	}
+	if input.Data != target.data {
+		return fmt.Errorf("Invalid ELF: data encoding is %v but %s expects %v", input.Data, cpu, target.data)
+	}
+	if target.machine != elf.EM_NONE {
+		if input.Machine != target.machine {
+			return fmt.Errorf("Invalid ELF: machine is %v but %s expects %v", input.Machine, cpu, target.machine)
+		}
+	} else {
+		for isa, other := range elfTargets {
+			if other.machine != elf.EM_NONE && input.Machine == other.machine {
+				return fmt.Errorf("Invalid ELF: machine is %v, which is for %s, but %s expects a %s executable",
+					input.Machine, isa, cpu, profile.ISA)
+			}
+		}
+	}
+	if input.Type != elf.ET_EXEC {
+		if input.Type == elf.ET_REL {
+			return fmt.Errorf("Invalid ELF: type is %v; link the object file into an executable first", input.Type)
+		}
+		return fmt.Errorf("Invalid ELF: type is %v but %s expects %v", input.Type, cpu, elf.ET_EXEC)
+	}
+	if input.Entry != 0 {
+		return fmt.Errorf("Invalid ELF: entry point is 0x%x but %s starts at 0x0", input.Entry, cpu)
+	}
+	return nil
+}
+
+// LoadELF parses the input as ELF and gets the ROM and RAM images for
+// profile. It checks that the input is an executable for profile's ISA.
+func LoadELF(fileName string, profile CPUProfile) (*Image, error) {
+	input, err := elf.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer input.Close()
+
+	if err := checkELFHeader(input, profile); err != nil {
+		return nil, err
+	}
+	return loadELF(input, profile.ROMSize, profile.RAMSize)
+}
+
+func loadELF(input *elf.File, romSize, ramSize uint64) (*Image, error) {
+	img := &Image{
+		ROM: make([]byte, romSize),
+		RAM: make([]byte, ramSize),
+	}
+
+	var loaded []Segment
+	for _, prog := range input.Progs {
+		if prog.ProgHeader.Type != elf.PT_LOAD {
+			continue
+		}
+		seg := Segment{
+			Addr:     prog.ProgHeader.Vaddr,
+			FileSize: prog.ProgHeader.Filesz,
+			MemSize:  prog.ProgHeader.Memsz,
+		}
+		if seg.FileSize > seg.MemSize {
+			return nil, fmt.Errorf("Invalid ELF: segment at 0x%x has filesz %d larger than memsz %d",
+				seg.Addr, seg.FileSize, seg.MemSize)
+		}
+		if seg.MemSize == 0 {
+			continue
+		}
+
+		// Bound-check the whole memsz so that .bss is reserved as well.
+		var mem []byte
+		if seg.Addr < RAMBaseAddr { // ROM
+			if !seg.fits(0, romSize) {
+				return nil, fmt.Errorf("Invalid ROM size: too small for segment at 0x%x with memsz %d (ROM is %d bytes)",
+					seg.Addr, seg.MemSize, romSize)
+			}
+			mem = img.ROM[seg.Addr : seg.Addr+seg.MemSize]
+		} else { // RAM
+			if !seg.fits(RAMBaseAddr, ramSize) {
+				return nil, fmt.Errorf("Invalid RAM size: too small for segment at 0x%x with memsz %d (RAM is %d bytes)",
+					seg.Addr, seg.MemSize, ramSize)
+			}
+			offset := seg.Addr - RAMBaseAddr
+			mem = img.RAM[offset : offset+seg.MemSize]
+			img.RAMSegments = append(img.RAMSegments, seg)
+		}
+		// Both are in bounds, so their ends do not overflow.
+		for _, other := range loaded {
+			if seg.Addr < other.Addr+other.MemSize && other.Addr < seg.Addr+seg.MemSize {
+				return nil, fmt.Errorf("Invalid ELF: segment at 0x%x-0x%x overlaps segment at 0x%x-0x%x",
+					seg.Addr, seg.Addr+seg.MemSize, other.Addr, other.Addr+other.MemSize)
+			}
+		}
+		loaded = append(loaded, seg)
+
+		reader := prog.Open()
+		if _, err := io.ReadFull(reader, mem[:seg.FileSize]); err != nil {
+			return nil, err
+		}
+		for i := seg.FileSize; i < seg.MemSize; i++ {
+			mem[i] = 0
+		}
+	}
+
+	return img, nil
+}
+
+// fits reports whether seg lies within the size bytes from base. It does
+// not add to seg.Addr, which may be near the top of the address space.
+func (seg Segment) fits(base, size uint64) bool {
+	return seg.Addr >= base && seg.Addr-base <= size && seg.MemSize <= size-(seg.Addr-base)
+}
+
+// clone returns a copy of img whose RAM can be modified on its own. ROM is
+// shared.
+func (img *Image) clone() *Image {
+	return &Image{
+		ROM:         img.ROM,
+		RAM:         append([]byte(nil), img.RAM...),
+		RAMSegments: img.RAMSegments,
+	}
+}
+
+// AttachCommandLineOptions writes argc, argv and the initial stack pointer
+// into img.RAM as the runtime's crt0 expects them, and fails if they collide with a segment loaded in RAM.
+func (img *Image) AttachCommandLineOptions(cmdOpts []string, profile CPUProfile) error {
+	start, end, err := attachCommandLineOptions(img.RAM, cmdOpts, profile)
+	if err != nil {
+		return err
+	}
+	for _, seg := range img.RAMSegments {
+		segStart := seg.Addr - RAMBaseAddr
+		segEnd := segStart + seg.MemSize
+		if uint64(start) < segEnd && segStart < uint64(end) {
+			return fmt.Errorf(
+				"Invalid RAM size: command line arguments at 0x%x-0x%x collide with segment at 0x%x-0x%x (filesz %d, memsz %d)",
+				RAMBaseAddr+start, RAMBaseAddr+end, seg.Addr, seg.Addr+seg.MemSize, seg.FileSize, seg.MemSize)
+		}
+	}
+	return nil
+}
+
+// attachCommandLineOptions writes argc, argv and the initial stack pointer
+// into the RAM image as the runtime's crt0 expects them, and returns the RAM
+// range [start, end) occupied by argc, argv and the argument strings.
+func attachCommandLineOptions(ram []byte, cmdOptsSrc []string, profile CPUProfile) (int, int, error) {
+	// N1548 5.1.2.2.1 2
+	// the string pointed to by argv[0]
+	// represents the program name; argv[0][0] shall be the null character if the
+	// program name is not available from the host environment.
+	cmdOpts := []string{""}
+	cmdOpts = append(cmdOpts, cmdOptsSrc...)
+	argc := len(cmdOpts)
+
+	// Slice for *argv.
+	sargv := []int{
+		// N1548 5.1.2.2.1 2
+		// argv[argc] shall be a null pointer.
+		0,
+	}
+
+	ramSize := len(ram)
+	stackTop := ramSize
+	if profile.StackPointerOffset+uint64(profile.PointerWidth) == uint64(ramSize) {
+		stackTop = int(profile.StackPointerOffset)
+	}
+	index := stackTop
+
+	// Set **argv to RAM
+	for i := len(cmdOpts) - 1; i >= 0; i-- {
+		opt := append([]byte(cmdOpts[i]), 0)
+		for j := len(opt) - 1; j >= 0; j-- {
+			index--
+			if index < 0 {
+				return 0, 0, errors.New("Invalid RAM size: command line arguments do not fit")
+			}
+			ram[index] = opt[j]
+		}
+		sargv = append(sargv, index)
+	}
+	// Align index
+	index -= index % profile.StackAlign
+	if index < 0 {
+		return 0, 0, errors.New("Invalid RAM size: command line arguments do not fit")
+	}
+	// Set *argv to RAM
+	for _, val := range sargv {
+		index -= profile.PointerWidth
+		if index < 0 {
+			return 0, 0, errors.New("Invalid RAM size: command line arguments do not fit")
+		}
+		writeLE(ram[index:index+profile.PointerWidth], uint64(val))
+	}
+	// Save argc in RAM
+	index -= profile.PointerWidth
+	if index < 0 {
+		return 0, 0, errors.New("Invalid RAM size: command line arguments do not fit")
+	}
+	writeLE(ram[index:index+profile.PointerWidth], uint64(argc))
+	// Save initial stack pointer in RAM
+	initSP := index
+	if profile.StackPointerOffset+uint64(profile.PointerWidth) > uint64(len(ram)) {
+		return 0, 0, errors.New("Invalid CPU profile: stack pointer slot is outside RAM")
+	}
+	spOffset := int(profile.StackPointerOffset)
+	writeLE(ram[spOffset:spOffset+profile.PointerWidth], uint64(initSP))
+
+	return initSP, stackTop, nil
+}
+
+// PackELF builds ROM and RAM images from the ELF file inputFileName with
+// cmdOpts as its command-line arguments, and writes them as a plain packet
+// to outputFileName. It refuses to pack for a profile which disagrees with
+// its blueprint.
+func PackELF(
+	inputFileName, outputFileName string,
+	cmdOpts []string,
+	profile CPUProfile,
+) error {
+	img, err := loadProgram(inputFileName, profile)
+	if err != nil {
+		return err
+	}
+	if err = img.AttachCommandLineOptions(cmdOpts, profile); err != nil {
+		return err
+	}
+
+	return WritePlainPacketFile(outputFileName, NewPlainPacket(img))
+}
+
+// loadProgram loads the ELF file inputFileName to pack for profile, checking
+// the profile against its blueprint.
+func loadProgram(inputFileName string, profile CPUProfile) (*Image, error) {
+	if !fileExists(inputFileName) {
+		return nil, errors.New("File not found")
+	}
+	if err := CheckBlueprint(profile); err != nil {
+		return nil, err
+	}
+	return LoadELF(inputFileName, profile)
+}
@@ -0,0 +1,259 @@
+package kvsp
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAttachCommandLineOptions(t *testing.T) {
+	profile := testProfile(t, "ruby")
+	img := &Image{RAM: make([]byte, profile.RAMSize)}
+	if err := img.AttachCommandLineOptions([]string{"5"}, profile); err != nil {
+		t.Fatal(err)
+	}
+	ram := img.RAM
+
+	read16 := func(addr int) int { return int(ram[addr]) | int(ram[addr+1])<<8 }
+	if sp := read16(510); sp != 498 {
+		t.Fatalf("initial SP = %d, want 498", sp)
+	}
+	if argc := read16(498); argc != 2 {
+		t.Fatalf("argc = %d, want 2", argc)
+	}
+	for i, want := range []int{507, 508, 0} {
+		if got := read16(500 + 2*i); got != want {
+			t.Fatalf("argv[%d] = %d, want %d", i, got, want)
+		}
+	}
+	if string(ram[507:510]) != "\x005\x00" {
+		t.Fatalf("argument strings = %q", ram[507:510])
+	}
+}
+
+func TestAttachCommandLineOptionsTooLong(t *testing.T) {
+	profile := testProfile(t, "ruby")
+	img := &Image{RAM: make([]byte, profile.RAMSize)}
+	long := string(make([]byte, profile.RAMSize))
+	if err := img.AttachCommandLineOptions([]string{long}, profile); err == nil {
+		t.Fatal("AttachCommandLineOptions accepted arguments larger than RAM")
+	}
+}
+
+type testSegment struct {
+	addr    uint32
+	data    []byte
+	memSize uint32
+}
+
+type testSymbol struct {
+	name  string
+	value uint32
+	size  uint32
+}
+
+// writeTestELF writes a little-endian ELF32 executable with segs as its
+// PT_LOAD segments and returns its file name. edits modify the header.
+func writeTestELF(t *testing.T, machine elf.Machine, segs []testSegment, edits ...func(*elf.Header32)) string {
+	t.Helper()
+	return writeTestELFWithSymbols(t, machine, segs, nil, edits...)
+}
+
+// writeTestELFWithSymbols is writeTestELF with a symbol table of syms.
+func writeTestELFWithSymbols(t *testing.T, machine elf.Machine, segs []testSegment, syms []testSymbol, edits ...func(*elf.Header32)) string {
+	t.Helper()
+
+	var data bytes.Buffer
+	dataOffset := uint32(52 + 32*len(segs))
+	var progs []elf.Prog32
+	for _, seg := range segs {
+		progs = append(progs, elf.Prog32{
+			Type:   uint32(elf.PT_LOAD),
+			Off:    dataOffset + uint32(data.Len()),
+			Vaddr:  seg.addr,
+			Paddr:  seg.addr,
+			Filesz: uint32(len(seg.data)),
+			Memsz:  seg.memSize,
+			Flags:  uint32(elf.PF_R),
+		})
+		data.Write(seg.data)
+	}
+
+	var sections []elf.Section32
+	if len(syms) > 0 {
+		var symtab, strtab bytes.Buffer
+		strtab.WriteByte(0)
+		binary.Write(&symtab, binary.LittleEndian, elf.Sym32{})
+		for _, sym := range syms {
+			binary.Write(&symtab, binary.LittleEndian, elf.Sym32{
+				Name:  uint32(strtab.Len()),
+				Value: sym.value,
+				Size:  sym.size,
+				Info:  elf.ST_INFO(elf.STB_GLOBAL, elf.STT_OBJECT),
+				Shndx: uint16(elf.SHN_ABS),
+			})
+			strtab.WriteString(sym.name)
+			strtab.WriteByte(0)
+		}
+		shstrtab := "\x00.symtab\x00.strtab\x00.shstrtab\x00"
+
+		sections = append(sections, elf.Section32{})
+		sections = append(sections, elf.Section32{
+			Name: 1, Type: uint32(elf.SHT_SYMTAB), Off: dataOffset + uint32(data.Len()),
+			Size: uint32(symtab.Len()), Link: 2, Info: 1, Addralign: 4, Entsize: 16,
+		})
+		data.Write(symtab.Bytes())
+		sections = append(sections, elf.Section32{
+			Name: 9, Type: uint32(elf.SHT_STRTAB), Off: dataOffset + uint32(data.Len()),
+			Size: uint32(strtab.Len()), Addralign: 1,
+		})
+		data.Write(strtab.Bytes())
+		sections = append(sections, elf.Section32{
+			Name: 17, Type: uint32(elf.SHT_STRTAB), Off: dataOffset + uint32(data.Len()),
+			Size: uint32(len(shstrtab)), Addralign: 1,
+		})
+		data.WriteString(shstrtab)
+	}
+
+	hdr := elf.Header32{
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(machine),
+		Version:   uint32(elf.EV_CURRENT),
+		Phoff:     52,
+		Ehsize:    52,
+		Phentsize: 32,
+		Phnum:     uint16(len(segs)),
+		Shentsize: 40,
+	}
+	if len(sections) > 0 {
+		hdr.Shoff = dataOffset + uint32(data.Len())
+		hdr.Shnum = uint16(len(sections))
+		hdr.Shstrndx = 3
+	}
+	copy(hdr.Ident[:], elf.ELFMAG)
+	hdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS32)
+	hdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	hdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	for _, edit := range edits {
+		edit(&hdr)
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, hdr)
+	binary.Write(&buf, binary.LittleEndian, progs)
+	buf.Write(data.Bytes())
+	binary.Write(&buf, binary.LittleEndian, sections)
+
+	fileName := filepath.Join(t.TempDir(), "a.out")
+	if err := os.WriteFile(fileName, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+func TestLoadELFZeroFillsBSS(t *testing.T) {
+	profile := testProfile(t, "ruby")
+	fileName := writeTestELF(t, elf.EM_NONE, []testSegment{
+		{addr: 0, data: []byte{1, 2, 3, 4}, memSize: 4},
+		{addr: RAMBaseAddr + 16, data: []byte{5, 6}, memSize: 8},
+	})
+	img, err := LoadELF(fileName, profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(img.ROM[:4], []byte{1, 2, 3, 4}) {
+		t.Fatalf("ROM = % x", img.ROM[:4])
+	}
+	if !bytes.Equal(img.RAM[16:24], []byte{5, 6, 0, 0, 0, 0, 0, 0}) {
+		t.Fatalf("RAM = % x", img.RAM[16:24])
+	}
+	if len(img.RAMSegments) != 1 || img.RAMSegments[0].MemSize != 8 {
+		t.Fatalf("RAMSegments = %+v", img.RAMSegments)
+	}
+}
+
+func TestLoadELFChecksMemsz(t *testing.T) {
+	profile := testProfile(t, "ruby")
+
+	// .bss runs past the end of RAM although .data fits.
+	fileName := writeTestELF(t, elf.EM_NONE, []testSegment{
+		{addr: RAMBaseAddr + 500, data: []byte{1}, memSize: 16},
+	})
+	if _, err := LoadELF(fileName, profile); err == nil || !strings.Contains(err.Error(), "too small") {
+		t.Fatalf("LoadELF: err = %v", err)
+	}
+
+	// .bss fits but overlaps the command line arguments.
+	fileName = writeTestELF(t, elf.EM_NONE, []testSegment{
+		{addr: RAMBaseAddr + 400, data: []byte{1}, memSize: 100},
+	})
+	img, err := LoadELF(fileName, profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = img.AttachCommandLineOptions([]string{"5"}, profile)
+	if err == nil || !strings.Contains(err.Error(), "collide with segment at 0x10190-0x101f4") {
+		t.Fatalf("AttachCommandLineOptions: err = %v", err)
+	}
+}
+
+func TestLoadELFChecksSegments(t *testing.T) {
+	profile := testProfile(t, "ruby")
+
+	fileName := writeTestELF(t, elf.EM_NONE, []testSegment{
+		{addr: 0, data: []byte{1, 2, 3, 4}, memSize: 8},
+		{addr: 4, data: []byte{5, 6}, memSize: 2},
+	})
+	if _, err := LoadELF(fileName, profile); err == nil || !strings.Contains(err.Error(), "overlaps segment at 0x0-0x8") {
+		t.Fatalf("LoadELF: err = %v", err)
+	}
+
+	// Segments whose end address overflows are out of bounds, not wrapped.
+	for _, seg := range []Segment{
+		{Addr: RAMBaseAddr + 8, MemSize: math.MaxUint64},
+		{Addr: math.MaxUint64 - 1, MemSize: 4},
+	} {
+		if seg.fits(RAMBaseAddr, profile.RAMSize) {
+			t.Errorf("%+v fits in RAM", seg)
+		}
+	}
+	if seg := (Segment{Addr: RAMBaseAddr + 8, MemSize: profile.RAMSize - 8}); !seg.fits(RAMBaseAddr, profile.RAMSize) {
+		t.Errorf("%+v does not fit in RAM", seg)
+	}
+}
+
+func TestLoadELFChecksHeader(t *testing.T) {
+	ruby := testProfile(t, "ruby")
+	alexandrite := testProfile(t, "alexandrite")
+	segs := []testSegment{{addr: 0, data: []byte{1, 2, 3, 4}, memSize: 4}}
+
+	if _, err := LoadELF(writeTestELF(t, elf.EM_RISCV, segs), alexandrite); err != nil {
+		t.Fatalf("LoadELF(RV32 executable, alexandrite): %v", err)
+	}
+
+	for _, tc := range []struct {
+		profile CPUProfile
+		machine elf.Machine
+		edit    func(*elf.Header32)
+		want    string
+	}{
+		{ruby, elf.EM_RISCV, nil, "machine is EM_RISCV, which is for rv32i"},
+		{alexandrite, elf.EM_NONE, nil, "machine is EM_NONE but CPU \"alexandrite\" (rv32i) expects EM_RISCV"},
+		{alexandrite, elf.EM_RISCV, func(h *elf.Header32) { h.Type = uint16(elf.ET_REL) }, "link the object file"},
+		{alexandrite, elf.EM_RISCV, func(h *elf.Header32) { h.Entry = 0x40 }, "entry point is 0x40"},
+	} {
+		var edits []func(*elf.Header32)
+		if tc.edit != nil {
+			edits = append(edits, tc.edit)
+		}
+		_, err := LoadELF(writeTestELF(t, tc.machine, segs, edits...), tc.profile)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("LoadELF: err = %v, want %q", err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package kvsp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Estimate is what it costs to run a program over TFHE, derived from its
+// plaintext emulation.
+type Estimate struct {
+	// Cycles is the number of clocks the program took to halt.
+	Cycles uint
+	// MarginPercent is the safety margin added to Cycles.
+	MarginPercent float64
+	// RunCycles is Cycles plus the margin, i.e. the value to give to -c.
+	RunCycles uint
+	// Gates is the number of bootstrapped gates evaluated per clock, or 0 if
+	// unknown.
+	Gates uint
+	// GatesPerSec is the throughput of the backend, or 0 if unknown.
+	GatesPerSec float64
+}
+
+// NewEstimate returns the estimate for the plaintext result pkt with a margin
+// of marginPercent percent. The time is unknown until Gates and GatesPerSec
+// are set.
+func NewEstimate(pkt *PlainPacket, marginPercent float64) (Estimate, error) {
+	if !pkt.Flags["finflag"] {
+		return Estimate{}, fmt.Errorf("The program did not finish in %d cycles", pkt.NumCycles)
+	}
+	if marginPercent < 0 {
+		return Estimate{}, fmt.Errorf("Invalid margin: %v", marginPercent)
+	}
+	cycles := uint(pkt.NumCycles)
+	return Estimate{
+		Cycles:        cycles,
+		MarginPercent: marginPercent,
+		RunCycles:     uint(math.Ceil(float64(cycles) * (1 + marginPercent/100))),
+	}, nil
+}
+
+// Duration returns the expected wall-clock time to run RunCycles clocks, or 0
+// if it is unknown.
+func (e Estimate) Duration() time.Duration {
+	if e.Gates == 0 || e.GatesPerSec <= 0 {
+		return 0
+	}
+	secs := float64(e.RunCycles) * float64(e.Gates) / e.GatesPerSec
+	return time.Duration(secs * float64(time.Second))
+}
+
+// Print writes est in text to w. The gate count and the time are omitted if
+// unknown.
+func (e Estimate) Print(w io.Writer) error {
+	fmt.Fprintf(w, "#cycle\t%d\n", e.Cycles)
+	fmt.Fprintf(w, "margin\t%g%%\n", e.MarginPercent)
+	fmt.Fprintf(w, "run\t%d\n", e.RunCycles)
+	if e.Gates > 0 {
+		fmt.Fprintf(w, "gates\t%d\n", e.Gates)
+	}
+	if d := e.Duration(); d > 0 {
+		fmt.Fprintf(w, "gates/s\t%g\n", e.GatesPerSec)
+		fmt.Fprintf(w, "time\t%s\n", d.Round(time.Second))
+	}
+	return nil
+}
+
+type estimateJSON struct {
+	Cycles        uint    `json:"cycles"`
+	MarginPercent float64 `json:"margin_percent"`
+	RunCycles     uint    `json:"run_cycles"`
+	Gates         uint    `json:"gates,omitempty"`
+	GatesPerSec   float64 `json:"gates_per_sec,omitempty"`
+	Seconds       float64 `json:"seconds,omitempty"`
+}
+
+// PrintJSON writes est to w as an indented JSON object.
+func (e Estimate) PrintJSON(w io.Writer) error {
+	out := estimateJSON{
+		Cycles:        e.Cycles,
+		MarginPercent: e.MarginPercent,
+		RunCycles:     e.RunCycles,
+		Gates:         e.Gates,
+	}
+	if d := e.Duration(); d > 0 {
+		out.GatesPerSec = e.GatesPerSec
+		out.Seconds = d.Seconds()
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+type yosysJSON struct {
+	Modules map[string]struct {
+		Cells map[string]struct {
+			Type string `json:"type"`
+		} `json:"cells"`
+	} `json:"modules"`
+}
+
+// CountGates returns the number of gates in the blueprint of profile which
+// need bootstrapping, i.e. all cells but NOTs and flip-flops. ROM and RAM
+// builtins are not counted.
+func CountGates(profile CPUProfile) (uint, error) {
+	fileName, err := profile.blueprintPath()
+	if err != nil {
+		return 0, err
+	}
+	var src blueprintTOML
+	if _, err := toml.DecodeFile(fileName, &src); err != nil {
+		return 0, fmt.Errorf("invalid blueprint %s: %v", fileName, err)
+	}
+
+	var gates uint
+	for _, file := range src.File {
+		if file.Type != "yosys-json" {
+			return 0, fmt.Errorf("cannot count the gates of %s in blueprint %s: unsupported type %q",
+				file.Name, fileName, file.Type)
+		}
+		path := file.Path
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(fileName), path)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return 0, err
+		}
+		var netlist yosysJSON
+		if err := json.Unmarshal(data, &netlist); err != nil {
+			return 0, fmt.Errorf("invalid netlist %s: %v", path, err)
+		}
+		for _, module := range netlist.Modules {
+			for _, cell := range module.Cells {
+				if cell.Type == "$_NOT_" || strings.Contains(cell.Type, "DFF") {
+					continue
+				}
+				gates++
+			}
+		}
+	}
+	return gates, nil
+}
+
+// ThroughputFile returns the path of the table of gate throughputs per
+// backend. KVSP_THROUGHPUT_PATH overrides the default.
+func ThroughputFile() (string, error) {
+	return lookupPath("THROUGHPUT", "../share/kvsp/throughput.toml", "")
+}
+
+// LoadGateThroughput returns the number of gates per second that the backend
+// named backend evaluates according to the table in fileName.
+func LoadGateThroughput(fileName, backend string) (float64, error) {
+	var table map[string]struct {
+		GatesPerSec float64 `toml:"gates_per_sec"`
+	}
+	if _, err := toml.DecodeFile(fileName, &table); err != nil {
+		return 0, fmt.Errorf("invalid throughput table %s: %v", fileName, err)
+	}
+	entry, ok := table[strings.ToLower(backend)]
+	if !ok || entry.GatesPerSec <= 0 {
+		return 0, fmt.Errorf("no gates_per_sec for backend %q in %s; measure it as the file describes, or pass --gates-per-sec", backend, fileName)
+	}
+	return entry.GatesPerSec, nil
+}
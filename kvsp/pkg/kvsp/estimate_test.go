@@ -0,0 +1,97 @@
+package kvsp
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewEstimate(t *testing.T) {
+	pkt := &PlainPacket{NumCycles: 17, Flags: map[string]bool{"finflag": true}}
+	est, err := NewEstimate(pkt, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if est.Cycles != 17 || est.RunCycles != 19 {
+		t.Fatalf("NewEstimate(17 cycles, 10%%) = %+v", est)
+	}
+	est.Gates = 500
+	if est.Duration() != 0 {
+		t.Fatalf("Duration() = %v without a throughput", est.Duration())
+	}
+	var buf bytes.Buffer
+	if err := est.Print(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if want := "#cycle\t17\nmargin\t10%\nrun\t19\ngates\t500\n"; buf.String() != want {
+		t.Fatalf("Print() = %q without a throughput, want %q", buf.String(), want)
+	}
+	est.GatesPerSec = 1000
+	if got := est.Duration(); got != 9500*time.Millisecond {
+		t.Fatalf("Duration() = %v", got)
+	}
+
+	buf.Reset()
+	if err := est.Print(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := "#cycle\t17\nmargin\t10%\nrun\t19\ngates\t500\ngates/s\t1000\ntime\t10s\n"
+	if buf.String() != want {
+		t.Fatalf("Print() = %q, want %q", buf.String(), want)
+	}
+
+	pkt.Flags["finflag"] = false
+	if _, err := NewEstimate(pkt, 10); err == nil {
+		t.Fatal("NewEstimate accepted an unfinished program")
+	}
+}
+
+func TestCountGates(t *testing.T) {
+	dir := t.TempDir()
+	blueprint := filepath.Join(dir, "cpu.toml")
+	write := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("cpu.toml", "[[file]]\ntype = \"yosys-json\"\npath = \"core.json\"\nname = \"core\"\n")
+	write("core.json", `{"modules": {"core": {"cells": {
+		"a": {"type": "$_AND_"},
+		"b": {"type": "$_NAND_"},
+		"c": {"type": "$_MUX_"},
+		"d": {"type": "$_NOT_"},
+		"e": {"type": "$_DFF_P_"}
+	}}}}`)
+
+	gates, err := CountGates(CPUProfile{Name: "test", Blueprint: blueprint})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gates != 3 {
+		t.Fatalf("CountGates() = %d, want 3", gates)
+	}
+}
+
+func TestLoadGateThroughput(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "throughput.toml")
+	if err := os.WriteFile(fileName, []byte("[tangor]\ngates_per_sec = 2500\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if gps, err := LoadGateThroughput(fileName, "Tangor"); err != nil || gps != 2500 {
+		t.Errorf("LoadGateThroughput(Tangor) = %v, %v", gps, err)
+	}
+	if _, err := LoadGateThroughput(fileName, "iyokan"); err == nil || !strings.Contains(err.Error(), "iyokan") {
+		t.Errorf("LoadGateThroughput(iyokan) = %v", err)
+	}
+
+	// The shipped table has no figures to be taken for measured ones.
+	shipped := filepath.Join(testCPUProfilesDir, "../throughput.toml")
+	for _, name := range []string{"iyokan", "tangor"} {
+		if gps, err := LoadGateThroughput(shipped, name); err == nil {
+			t.Errorf("the shipped table has %v gates/s for %s", gps, name)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package kvsp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Verbose makes KVSP print every child process it executes to stderr.
+var Verbose bool
+
+// Logger receives a record of every child process KVSP executes and of the
+// steps it takes, e.g. packing, encryption and encrypted runs, with their
+// durations. Nothing is logged if it is nil.
+var Logger *slog.Logger
+
+// execCmdImpl returns the command which runs name with args, and which is
+// stopped when ctx is done.
+func execCmdImpl(ctx context.Context, name string, args []string) *exec.Cmd {
+	if Verbose {
+		fmtArgs := make([]string, len(args))
+		for i, arg := range args {
+			fmtArgs[i] = fmt.Sprintf("'%s'", arg)
+		}
+		fmt.Fprintf(os.Stderr, "exec: '%s' %s\n", name, strings.Join(fmtArgs, " "))
+	}
+
+	cmd := commandContext(ctx, name, args)
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+func execCmd(ctx context.Context, name string, args []string) error {
+	cmd := execCmdImpl(ctx, name, args)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	return runCmd(cmd)
+}
+
+func outCmd(ctx context.Context, name string, args []string) (string, error) {
+	var out bytes.Buffer
+	cmd := execCmdImpl(ctx, name, args)
+	cmd.Stdout = &out
+	err := runCmd(cmd)
+	return out.String(), err
+}
+
+// The flags of the evaluators which take the files they read and write.
+var (
+	inputFileFlags  = []string{"-i", "--in", "--key", "--evalkey", "--resume", "--blueprint"}
+	outputFileFlags = []string{"-o", "--out", "--snapshot"}
+)
+
+// runCmd runs cmd and logs it with its duration, exit status, and the sizes
+// of the files it reads and writes.
+func runCmd(cmd *exec.Cmd) error {
+	if Logger == nil {
+		return cmd.Run()
+	}
+	args := cmd.Args[1:]
+	inputs := fileSizes(args, inputFileFlags)
+	start := time.Now()
+	err := cmd.Run()
+	elapsed := time.Since(start)
+
+	exitStatus := -1
+	if cmd.ProcessState != nil {
+		exitStatus = cmd.ProcessState.ExitCode()
+	}
+	attrs := []any{
+		"path", cmd.Path,
+		"args", args,
+		"seconds", elapsed.Seconds(),
+		"exit_status", exitStatus,
+		"inputs", inputs,
+		"outputs", fileSizes(args, outputFileFlags),
+	}
+	if err != nil {
+		Logger.Error("exec", append(attrs, "error", err.Error())...)
+	} else {
+		Logger.Info("exec", attrs...)
+	}
+	return err
+}
+
+// fileSizes returns the sizes of the files which follow flags in args, keyed
+// by their names. Missing files are left out.
+func fileSizes(args []string, flags []string) map[string]int64 {
+	sizes := map[string]int64{}
+	for i := 0; i+1 < len(args); i++ {
+		for _, flag := range flags {
+			if args[i] != flag {
+				continue
+			}
+			if st, err := os.Stat(args[i+1]); err == nil {
+				sizes[args[i+1]] = st.Size()
+			}
+		}
+	}
+	return sizes
+}
+
+var (
+	warnedMu sync.Mutex
+	warned   = map[string]bool{}
+)
+
+// warnOnce prints the warning msg to stderr and logs it, unless it has been
+// already.
+func warnOnce(msg string) {
+	warnedMu.Lock()
+	defer warnedMu.Unlock()
+	if warned[msg] {
+		return
+	}
+	warned[msg] = true
+	fmt.Fprintf(os.Stderr, "Warning: %s.\n", msg)
+	if Logger != nil {
+		Logger.Warn(msg)
+	}
+}
+
+// logStep logs the step msg which started at start and ended with err.
+func logStep(msg string, start time.Time, err error, attrs ...any) {
+	if Logger == nil {
+		return
+	}
+	attrs = append(attrs, "seconds", time.Since(start).Seconds())
+	if err != nil {
+		Logger.Error(msg, append(attrs, "error", err.Error())...)
+		return
+	}
+	Logger.Info(msg, attrs...)
+}
+
+// fileSize returns the size of the file name, or -1 if unknown.
+func fileSize(name string) int64 {
+	st, err := os.Stat(name)
+	if err != nil {
+		return -1
+	}
+	return st.Size()
+}
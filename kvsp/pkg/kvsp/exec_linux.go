@@ -0,0 +1,11 @@
+package kvsp
+
+import "syscall"
+
+// childSysProcAttr puts a child in its own process group, and kills it if
+// KVSP dies, e.g. by SIGKILL, so that it does not run on unattended.
+// Pdeathsig follows the thread which started the child, which the Go runtime
+// keeps unless a goroutine exits locked to it; KVSP locks none.
+func childSysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true, Pdeathsig: syscall.SIGKILL}
+}
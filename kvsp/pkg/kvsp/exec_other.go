@@ -0,0 +1,11 @@
+//go:build !linux
+
+package kvsp
+
+import "syscall"
+
+// childSysProcAttr puts a child in its own process group. Unlike on Linux,
+// the child runs on if KVSP is killed by SIGKILL.
+func childSysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true}
+}
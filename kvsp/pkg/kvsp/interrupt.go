@@ -0,0 +1,57 @@
+package kvsp
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// InterruptedError is returned by Run, Resume and RunUntilDone when their
+// context is done before the run ends.
+type InterruptedError struct {
+	// Cause is the cause of the cancellation of the context.
+	Cause error
+	// Cycles is the number of clocks of the run which Checkpoint holds.
+	Cycles uint
+	// Checkpoint is the last checkpoint, i.e. the last complete snapshot, to
+	// resume from, or empty if there is none.
+	Checkpoint string
+}
+
+func (e *InterruptedError) Error() string {
+	return fmt.Sprintf("Interrupted after %d cycles: %v", e.Cycles, e.Cause)
+}
+
+func (e *InterruptedError) Unwrap() error {
+	return e.Cause
+}
+
+// interruptedError returns the *InterruptedError for the run with ctx after
+// cycles clocks kept in checkpoint.
+func interruptedError(ctx context.Context, cycles uint, checkpoint string) *InterruptedError {
+	return &InterruptedError{Cause: context.Cause(ctx), Cycles: cycles, Checkpoint: checkpoint}
+}
+
+// stopDelay is how long the evaluator of a canceled run may take to stop
+// after SIGTERM before it is killed.
+const stopDelay = 10 * time.Second
+
+// commandContext returns the command which runs name with args, and which
+// is stopped by SIGTERM when ctx is done. The evaluator may or may not write
+// its snapshot then; the run keeps only the checkpoints taken before.
+func commandContext(ctx context.Context, name string, args []string) *exec.Cmd {
+	if ctx.Done() == nil {
+		return exec.Command(name, args...)
+	}
+	cmd := exec.CommandContext(ctx, name, args...)
+	// Signals sent to KVSP's process group, e.g. by Ctrl-C, reach the
+	// child only through ctx.
+	cmd.SysProcAttr = childSysProcAttr()
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	cmd.WaitDelay = stopDelay
+	return cmd
+}
@@ -0,0 +1,144 @@
+package kvsp
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// FileMeta is the metadata that KVSP writes next to keys and ciphertexts, in
+// the file named by MetaFile, to tell which secret key they belong to.
+type FileMeta struct {
+	// Kind is "secret-key", "bootstrapping-key", "ciphertext", "result", or
+	// "snapshot".
+	Kind string `toml:"kind"`
+	// KeyFingerprint is the KeyFingerprint of the secret key.
+	KeyFingerprint string    `toml:"key_fingerprint,omitempty"`
+	KVSPVersion    string    `toml:"kvsp_version"`
+	Created        time.Time `toml:"created"`
+}
+
+// MetaFile returns the name of the metadata file of fileName.
+func MetaFile(fileName string) string {
+	return fileName + ".kvsp.toml"
+}
+
+// ReadFileMeta reads the metadata of fileName. The error satisfies
+// errors.Is(err, fs.ErrNotExist) if fileName has none.
+func ReadFileMeta(fileName string) (*FileMeta, error) {
+	var meta FileMeta
+	if _, err := toml.DecodeFile(MetaFile(fileName), &meta); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("invalid metadata %s: %v", MetaFile(fileName), err)
+	}
+	return &meta, nil
+}
+
+func writeFileMeta(fileName, kind, fingerprint string) error {
+	f, err := os.Create(MetaFile(fileName))
+	if err != nil {
+		return err
+	}
+	meta := FileMeta{
+		Kind:           kind,
+		KeyFingerprint: fingerprint,
+		KVSPVersion:    Version,
+		Created:        time.Now().UTC().Truncate(time.Second),
+	}
+	if err := toml.NewEncoder(f).Encode(meta); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// KeyFingerprint returns the fingerprint of the secret key keyFileName, i.e.
+// the first 128 bits of the SHA-256 of the key in the clear. A protected key
+// is unwrapped to compute it.
+func KeyFingerprint(keyFileName string) (string, error) {
+	plainFileName, cleanup, err := openSecretKey(context.Background(), keyFileName)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+	key, err := ioutil.ReadFile(plainFileName)
+	if err != nil {
+		return "", err
+	}
+	return keyFingerprint(key), nil
+}
+
+func keyFingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:16])
+}
+
+// recordedFingerprint returns the key fingerprint in the metadata of
+// fileName, or "" if unknown.
+func recordedFingerprint(fileName string) (string, error) {
+	meta, err := ReadFileMeta(fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return meta.KeyFingerprint, nil
+}
+
+// checkFingerprints returns an error if fileName is known to belong to
+// another secret key than keyFileName, whose fingerprint is fingerprint.
+func checkFingerprints(keyFileName, fingerprint, fileName string) error {
+	recorded, err := recordedFingerprint(fileName)
+	if err != nil {
+		return err
+	}
+	if fingerprint != "" && recorded != "" && fingerprint != recorded {
+		return fmt.Errorf("%s belongs to the key %s, but %s belongs to the key %s; "+
+			"they are not made with the same secret key", keyFileName, fingerprint, fileName, recorded)
+	}
+	return nil
+}
+
+// checkSecretKey returns an error if fileName is known to be encrypted with
+// another secret key than keyFileName, whose unwrapped key is in
+// plainFileName.
+func checkSecretKey(keyFileName, plainFileName, fileName string) error {
+	key, err := ioutil.ReadFile(plainFileName)
+	if err != nil {
+		return err
+	}
+	return checkFingerprints(keyFileName, keyFingerprint(key), fileName)
+}
+
+// renameWithMeta renames oldpath and its metadata, if any, to newpath.
+func renameWithMeta(oldpath, newpath string) error {
+	if err := os.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	err := os.Rename(MetaFile(oldpath), MetaFile(newpath))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// removeWithMeta removes path and its metadata.
+func removeWithMeta(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Remove(MetaFile(path)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
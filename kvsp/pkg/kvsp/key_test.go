@@ -0,0 +1,72 @@
+package kvsp
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestKeyFingerprints(t *testing.T) {
+	profile := testProfile(t, "ruby")
+	dir := t.TempDir()
+	b := &fakeBackend{haltAfter: 1}
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	for _, key := range []string{"a.key", "b.key"} {
+		if err := GenKey(context.Background(), b, path(key)); err != nil {
+			t.Fatal(err)
+		}
+		if err := GenBootstrappingKey(context.Background(), b, path(key), path(key+".bkey")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fingerprint, err := KeyFingerprint(path("a.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"a.key", "a.key.bkey"} {
+		meta, err := ReadFileMeta(path(file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.KeyFingerprint != fingerprint {
+			t.Errorf("fingerprint of %s = %s, want %s", file, meta.KeyFingerprint, fingerprint)
+		}
+	}
+
+	// Encrypt a packet by hand; Encrypt needs a real ELF file.
+	input := writeTestFile(t, dir, "fib.enc", "fib")
+	if err := writeFileMeta(input, "ciphertext", fingerprint); err != nil {
+		t.Fatal(err)
+	}
+	opts := RunOptions{
+		Cycles:           30,
+		BootstrappingKey: path("b.key.bkey"),
+		Input:            input,
+		Output:           path("result.enc"),
+		Snapshot:         path("result.snapshot"),
+	}
+	if err := Run(context.Background(), b, opts, profile); err == nil || !strings.Contains(err.Error(), "not made with the same secret key") {
+		t.Fatalf("Run with another key: %v", err)
+	}
+	opts.BootstrappingKey = path("a.key.bkey")
+	if err := Run(context.Background(), b, opts, profile); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Decrypt(context.Background(), b, path("b.key"), opts.Output, profile); err == nil || !strings.Contains(err.Error(), "not made with the same secret key") {
+		t.Fatalf("Decrypt with another key: %v", err)
+	}
+	if _, err := decryptFinflag(context.Background(), b, path("a.key"), path("a.key"), opts.Output); err != nil {
+		t.Fatal(err)
+	}
+
+	resume := opts
+	resume.Input = opts.Snapshot
+	resume.Snapshot = path("resumed.snapshot")
+	resume.BootstrappingKey = path("b.key.bkey")
+	if err := Resume(context.Background(), b, resume); err == nil || !strings.Contains(err.Error(), "belongs to the key") {
+		t.Fatalf("Resume with another key: %v", err)
+	}
+}
@@ -0,0 +1,319 @@
+package kvsp
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/term"
+)
+
+/*
+	A protected secret key file is
+
+		magic      "KVSPKEY1"
+		salt       16 bytes
+		iterations uint32, big endian
+		nonce      12 bytes
+		sealed     AES-256-GCM of the key with the bytes above as its
+		           additional data
+
+	where the AES key is PBKDF2-HMAC-SHA256 of the passphrase and salt.
+*/
+
+const (
+	protectedKeyMagic      = "KVSPKEY1"
+	protectedKeySaltLen    = 16
+	protectedKeyNonceLen   = 12
+	protectedKeyHeaderLen  = len(protectedKeyMagic) + protectedKeySaltLen + 4 + protectedKeyNonceLen
+	protectedKeyIterations = 600000
+)
+
+// PassphraseEnv is the environment variable which holds the passphrase of
+// secret keys. NewPassphraseEnv holds the new one for RewrapKey.
+const (
+	PassphraseEnv    = "KVSP_KEY_PASSPHRASE"
+	NewPassphraseEnv = "KVSP_NEW_KEY_PASSPHRASE"
+)
+
+// PromptPassphrase asks the user for a passphrase if its environment
+// variable is not set. By default it reads /dev/tty without echo. It returns
+// the cause of ctx if ctx is done first.
+var PromptPassphrase = promptPassphraseTTY
+
+// pbkdf2SHA256 is the key derivation of protected keys, which their format
+// fixes.
+func pbkdf2SHA256(password, salt []byte, iter, keyLen int) []byte {
+	return pbkdf2.Key(password, salt, iter, keyLen, sha256.New)
+}
+
+func newKeyAEAD(passphrase, salt []byte, iter int) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(pbkdf2SHA256(passphrase, salt, iter, 32))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ProtectKey seals the secret key key with passphrase.
+func ProtectKey(key, passphrase []byte) ([]byte, error) {
+	header := make([]byte, protectedKeyHeaderLen)
+	copy(header, protectedKeyMagic)
+	salt := header[len(protectedKeyMagic) : len(protectedKeyMagic)+protectedKeySaltLen]
+	nonce := header[protectedKeyHeaderLen-protectedKeyNonceLen:]
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint32(header[len(protectedKeyMagic)+protectedKeySaltLen:], protectedKeyIterations)
+
+	aead, err := newKeyAEAD(passphrase, salt, protectedKeyIterations)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(header, nonce, key, header), nil
+}
+
+// UnprotectKey opens the secret key sealed by ProtectKey.
+func UnprotectKey(data, passphrase []byte) ([]byte, error) {
+	if !isProtectedKey(data) || len(data) < protectedKeyHeaderLen {
+		return nil, errors.New("not a protected secret key")
+	}
+	header := data[:protectedKeyHeaderLen]
+	salt := header[len(protectedKeyMagic) : len(protectedKeyMagic)+protectedKeySaltLen]
+	iter := binary.BigEndian.Uint32(header[len(protectedKeyMagic)+protectedKeySaltLen:])
+	nonce := header[protectedKeyHeaderLen-protectedKeyNonceLen:]
+	if iter == 0 || iter > 100*protectedKeyIterations {
+		return nil, fmt.Errorf("invalid protected secret key: %d iterations", iter)
+	}
+
+	aead, err := newKeyAEAD(passphrase, salt, int(iter))
+	if err != nil {
+		return nil, err
+	}
+	key, err := aead.Open(nil, nonce, data[protectedKeyHeaderLen:], header)
+	if err != nil {
+		return nil, errors.New("wrong passphrase, or the secret key is corrupted")
+	}
+	return key, nil
+}
+
+func isProtectedKey(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(protectedKeyMagic))
+}
+
+// IsProtectedKey reports whether keyFileName is sealed by a passphrase.
+func IsProtectedKey(keyFileName string) (bool, error) {
+	f, err := os.Open(keyFileName)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	magic := make([]byte, len(protectedKeyMagic))
+	n, _ := f.Read(magic)
+	return isProtectedKey(magic[:n]), nil
+}
+
+// passphrase returns the passphrase in the environment variable env, or asks
+// the user for it, twice if confirm.
+func passphrase(ctx context.Context, env, prompt string, confirm bool) ([]byte, error) {
+	if pass := os.Getenv(env); pass != "" {
+		return []byte(pass), nil
+	}
+	pass, err := PromptPassphrase(ctx, prompt)
+	if ctx.Err() != nil {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v; set %s to give the passphrase", err, env)
+	}
+	if len(pass) == 0 {
+		return nil, errors.New("Empty passphrase")
+	}
+	if confirm {
+		again, err := PromptPassphrase(ctx, "Repeat the passphrase: ")
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(pass, again) {
+			return nil, errors.New("The passphrases do not match")
+		}
+	}
+	return pass, nil
+}
+
+func promptPassphraseTTY(ctx context.Context, prompt string) ([]byte, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, errors.New("cannot ask for the passphrase without a terminal")
+	}
+	fd := int(tty.Fd())
+	state, err := term.GetState(fd)
+	if err != nil {
+		tty.Close()
+		return nil, fmt.Errorf("cannot read the passphrase: %v", err)
+	}
+
+	// ReadPassword turns off the echo, and restores it before it returns.
+	type result struct {
+		pass []byte
+		err  error
+	}
+	done := make(chan result, 1)
+	fmt.Fprint(tty, prompt)
+	go func() {
+		pass, err := term.ReadPassword(fd)
+		done <- result{pass, err}
+	}()
+	select {
+	case res := <-done:
+		fmt.Fprintln(tty)
+		tty.Close()
+		if res.err != nil {
+			return nil, fmt.Errorf("cannot read the passphrase: %v", res.err)
+		}
+		return res.pass, nil
+	case <-ctx.Done():
+		// The read cannot be cancelled, so turn the echo back on ourselves.
+		// tty is left open for the read, which ends with the process.
+		term.Restore(fd, state)
+		fmt.Fprintln(tty)
+		return nil, context.Cause(ctx)
+	}
+}
+
+// openSecretKey returns the name of a file which holds the secret key
+// keyFileName in the clear, asking for the passphrase if it is protected.
+// The unwrapped key is written in a temporary file only readable by the user,
+// which cleanup removes.
+func openSecretKey(ctx context.Context, keyFileName string) (string, func(), error) {
+	data, err := ioutil.ReadFile(keyFileName)
+	if err != nil {
+		return "", nil, err
+	}
+	if !isProtectedKey(data) {
+		return keyFileName, func() {}, nil
+	}
+
+	pass, err := passphrase(ctx, PassphraseEnv, fmt.Sprintf("Passphrase for %s: ", keyFileName), false)
+	if err != nil {
+		return "", nil, err
+	}
+	key, err := UnprotectKey(data, pass)
+	if err != nil {
+		return "", nil, fmt.Errorf("Cannot open %s: %v", keyFileName, err)
+	}
+	fileName, err := writeTempKey(key)
+	if err != nil {
+		return "", nil, err
+	}
+	return fileName, func() { removeTemp(fileName) }, nil
+}
+
+// writeTempKey writes key in a new temporary file with mode 0600.
+func writeTempKey(key []byte) (string, error) {
+	fileName, err := tempFileName()
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(fileName, key, 0600); err != nil {
+		removeTemp(fileName)
+		return "", err
+	}
+	return fileName, nil
+}
+
+// writeKeyFile replaces fileName with data atomically, with mode 0600.
+func writeKeyFile(fileName string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(fileName), ".kvsp-key-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), fileName)
+}
+
+// GenProtectedKey generates a secret key into outputFileName sealed with the
+// passphrase of KVSP_KEY_PASSPHRASE or given by the user.
+func GenProtectedKey(ctx context.Context, b Backend, outputFileName string) error {
+	pass, err := passphrase(ctx, PassphraseEnv, fmt.Sprintf("New passphrase for %s: ", outputFileName), true)
+	if err != nil {
+		return err
+	}
+
+	plainFileName, err := writeTempKey(nil)
+	if err != nil {
+		return err
+	}
+	defer removeTemp(plainFileName)
+	if err := b.GenKey(ctx, plainFileName); err != nil {
+		return err
+	}
+	key, err := ioutil.ReadFile(plainFileName)
+	if err != nil {
+		return err
+	}
+	fingerprint := keyFingerprint(key)
+
+	data, err := ProtectKey(key, pass)
+	if err != nil {
+		return err
+	}
+	if err := writeKeyFile(outputFileName, data); err != nil {
+		return err
+	}
+	return writeFileMeta(outputFileName, "secret-key", fingerprint)
+}
+
+// RewrapKey writes the secret key inputFileName into outputFileName sealed
+// with a new passphrase from KVSP_NEW_KEY_PASSPHRASE or the user, or in the
+// clear if !protect. inputFileName and outputFileName may be the same.
+func RewrapKey(ctx context.Context, inputFileName, outputFileName string, protect bool) error {
+	plainFileName, cleanup, err := openSecretKey(ctx, inputFileName)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	key, err := ioutil.ReadFile(plainFileName)
+	if err != nil {
+		return err
+	}
+
+	data := key
+	if protect {
+		pass, err := passphrase(ctx, NewPassphraseEnv, fmt.Sprintf("New passphrase for %s: ", outputFileName), true)
+		if err != nil {
+			return err
+		}
+		if data, err = ProtectKey(key, pass); err != nil {
+			return err
+		}
+	}
+	if err := writeKeyFile(outputFileName, data); err != nil {
+		return err
+	}
+	return writeFileMeta(outputFileName, "secret-key", keyFingerprint(key))
+}
@@ -0,0 +1,117 @@
+package kvsp
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPBKDF2SHA256(t *testing.T) {
+	for _, tc := range []struct {
+		password, salt string
+		iter, keyLen   int
+		want           string
+	}{
+		// From RFC 7914, section 11.
+		{"passwd", "salt", 1, 64,
+			"55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+				"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, 64,
+			"4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56" +
+				"a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+		// The PBKDF2-HMAC-SHA256 counterparts of RFC 6070's vectors.
+		{"password", "salt", 4096, 32,
+			"c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+		{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096, 40,
+			"348c89dbcbd32b2f32d814b8116e84cf2b17347ebc1800181c4e2a1fb8dd53e1c635518c7dac47e9"},
+		{"pass\x00word", "sa\x00lt", 4096, 16,
+			"89b69d0516f829893c696226650a8687"},
+	} {
+		got := hex.EncodeToString(pbkdf2SHA256([]byte(tc.password), []byte(tc.salt), tc.iter, tc.keyLen))
+		if got != tc.want {
+			t.Errorf("pbkdf2SHA256(%q, %q, %d, %d) = %s, want %s",
+				tc.password, tc.salt, tc.iter, tc.keyLen, got, tc.want)
+		}
+	}
+}
+
+func TestProtectKey(t *testing.T) {
+	key := []byte("secret key")
+	data, err := ProtectKey(key, []byte("pass"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := UnprotectKey(data, []byte("pass")); err != nil || string(got) != string(key) {
+		t.Fatalf("UnprotectKey() = %q, %v", got, err)
+	}
+	if _, err := UnprotectKey(data, []byte("wrong")); err == nil {
+		t.Fatal("UnprotectKey accepted a wrong passphrase")
+	}
+	data[len(data)-1] ^= 1
+	if _, err := UnprotectKey(data, []byte("pass")); err == nil {
+		t.Fatal("UnprotectKey accepted a corrupted key")
+	}
+}
+
+func TestProtectedKeyFile(t *testing.T) {
+	PromptPassphrase = func(context.Context, string) ([]byte, error) { return nil, errors.New("no terminal") }
+	t.Cleanup(func() { PromptPassphrase = promptPassphraseTTY })
+	t.Setenv(PassphraseEnv, "pass")
+	dir := t.TempDir()
+	keyFileName := filepath.Join(dir, "secret.key")
+
+	b := &fakeBackend{}
+	if err := GenProtectedKey(context.Background(), b, keyFileName); err != nil {
+		t.Fatal(err)
+	}
+	if protected, err := IsProtectedKey(keyFileName); err != nil || !protected {
+		t.Fatalf("IsProtectedKey() = %t, %v", protected, err)
+	}
+	meta, err := ReadFileMeta(keyFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plainFileName, cleanup, err := openSecretKey(context.Background(), keyFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := os.Stat(plainFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode().Perm() != 0600 {
+		t.Errorf("unwrapped key has mode %v", st.Mode().Perm())
+	}
+	cleanup()
+	if _, err := os.Stat(plainFileName); !os.IsNotExist(err) {
+		t.Errorf("unwrapped key %s is left behind", plainFileName)
+	}
+
+	t.Setenv(NewPassphraseEnv, "new pass")
+	if err := RewrapKey(context.Background(), keyFileName, keyFileName, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := openSecretKey(context.Background(), keyFileName); err == nil {
+		t.Fatal("the old passphrase opened the rewrapped key")
+	}
+	t.Setenv(PassphraseEnv, "new pass")
+	plainKeyFileName := filepath.Join(dir, "plain.key")
+	if err := RewrapKey(context.Background(), keyFileName, plainKeyFileName, false); err != nil {
+		t.Fatal(err)
+	}
+	if protected, err := IsProtectedKey(plainKeyFileName); err != nil || protected {
+		t.Fatalf("IsProtectedKey(unwrapped) = %t, %v", protected, err)
+	}
+	if fingerprint, err := KeyFingerprint(plainKeyFileName); err != nil || fingerprint != meta.KeyFingerprint {
+		t.Fatalf("fingerprint changed from %s to %s (%v)", meta.KeyFingerprint, fingerprint, err)
+	}
+
+	t.Setenv(PassphraseEnv, "")
+	if _, _, err := openSecretKey(context.Background(), keyFileName); err == nil {
+		t.Fatal("openSecretKey opened a protected key without a passphrase")
+	}
+}
@@ -0,0 +1,632 @@
+// Package kvsp implements the operations behind the kvsp command: compiling
+// C programs for a KVSP CPU, packing and encrypting them, running them in
+// plaintext or over TFHE, and decrypting the results.
+package kvsp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func isCompileOnly(args []string) bool {
+	for _, arg := range args {
+		if arg == "-c" || arg == "-S" || arg == "-E" {
+			return true
+		}
+	}
+	return false
+}
+
+// Compile runs clang for profile with the runtime's options followed by args.
+func Compile(profile CPUProfile, args []string) error {
+	// Get the path of clang
+	path, err := GetPathOf("CLANG")
+	if err != nil {
+		return err
+	}
+
+	rtPath, err := profile.runtimePath()
+	if err != nil {
+		return err
+	}
+
+	var ccArgs []string
+	switch profile.ISA {
+	case "cahp":
+		ccArgs = []string{"-target", "cahp", "-mcpu=generic", "-Oz", "--sysroot", rtPath}
+		ccArgs = append(ccArgs, args...)
+	case "rv32i":
+		ccArgs = []string{
+			"-target", "riscv32-unknown-elf",
+			"-march=rv32i",
+			"-mabi=ilp32",
+			"-Oz",
+			"-ffreestanding",
+			"-fno-builtin",
+			"-fno-unwind-tables",
+			"-fno-asynchronous-unwind-tables",
+			"-isystem", rtPath,
+		}
+		if isCompileOnly(args) {
+			ccArgs = append(ccArgs, args...)
+		} else {
+			ccArgs = append(ccArgs,
+				"-fuse-ld=lld",
+				"-nostdlib",
+				filepath.Join(rtPath, "crt0.o"),
+			)
+			ccArgs = append(ccArgs, args...)
+			ccArgs = append(ccArgs,
+				"-Wl,-T,"+filepath.Join(rtPath, profile.LinkerScript),
+				"-L", rtPath,
+				"-lc",
+			)
+		}
+	default:
+		return errors.New("unreachable")
+	}
+	return execCmd(context.Background(), path, ccArgs)
+}
+
+// Debug runs cahp-sim with args.
+func Debug(args []string) error {
+	// Get the path of cahp-sim
+	path, err := GetPathOf("CAHP_SIM")
+	if err != nil {
+		return err
+	}
+
+	// Run
+	return execCmd(context.Background(), path, args)
+}
+
+// GenKey generates a TFHE secret key into outputFileName. Like the other
+// functions here which take a ctx, it stops the backend when ctx is done.
+func GenKey(ctx context.Context, b Backend, outputFileName string) error {
+	if err := b.GenKey(ctx, outputFileName); err != nil {
+		return err
+	}
+	fingerprint, err := KeyFingerprint(outputFileName)
+	if err != nil {
+		return err
+	}
+	return writeFileMeta(outputFileName, "secret-key", fingerprint)
+}
+
+// GenBootstrappingKey generates the bootstrapping key for the secret key
+// inputFileName into outputFileName.
+func GenBootstrappingKey(ctx context.Context, b Backend, inputFileName, outputFileName string) error {
+	keyFileName, cleanup, err := openSecretKey(ctx, inputFileName)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	fingerprint, err := KeyFingerprint(keyFileName)
+	if err != nil {
+		return err
+	}
+	if err := b.GenEvalKey(ctx, keyFileName, outputFileName); err != nil {
+		return err
+	}
+	return writeFileMeta(outputFileName, "bootstrapping-key", fingerprint)
+}
+
+// Pack writes a plain packet of the ELF file inputFileName to outputFileName.
+func Pack(inputFileName, outputFileName string, cmdOpts []string, profile CPUProfile) error {
+	return PackELF(inputFileName, outputFileName, cmdOpts, profile)
+}
+
+// Encrypt packs the ELF file inputFileName and encrypts it with the secret
+// key keyFileName into outputFileName.
+func Encrypt(ctx context.Context, b Backend, keyFileName, inputFileName, outputFileName string, cmdOpts []string, profile CPUProfile) error {
+	// Pack
+	start := time.Now()
+	img, err := loadProgram(inputFileName, profile)
+	if err == nil {
+		err = img.AttachCommandLineOptions(cmdOpts, profile)
+	}
+	logStep("pack", start, err, "input", inputFileName, "cpu", profile.Name)
+	if err != nil {
+		return err
+	}
+
+	// Encrypt
+	plainKeyFileName, cleanup, err := openSecretKey(ctx, keyFileName)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	fingerprint, err := KeyFingerprint(plainKeyFileName)
+	if err != nil {
+		return err
+	}
+	return encryptImage(ctx, b, plainKeyFileName, fingerprint, img, outputFileName)
+}
+
+// encryptImage encrypts the packet of img with the unwrapped secret key
+// plainKeyFileName, whose fingerprint is fingerprint, into outputFileName.
+func encryptImage(ctx context.Context, b Backend, plainKeyFileName, fingerprint string, img *Image, outputFileName string) error {
+	// Create tmp file for packing
+	packedFile, err := tempFileName()
+	if err != nil {
+		return err
+	}
+	defer removeTemp(packedFile)
+	if err := WritePlainPacketFile(packedFile, NewPlainPacket(img)); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	err = b.Enc(ctx, plainKeyFileName, packedFile, outputFileName)
+	logStep("encrypt", start, err, "backend", b.Name(), "output", outputFileName, "size", fileSize(outputFileName))
+	if err != nil {
+		return err
+	}
+	return writeFileMeta(outputFileName, "ciphertext", fingerprint)
+}
+
+// Decrypt decrypts the result packet inputFileName with the secret key
+// keyFileName.
+func Decrypt(ctx context.Context, b Backend, keyFileName, inputFileName string, profile CPUProfile) (*PlainPacket, error) {
+	// Create tmp file for decryption
+	packedFile, err := tempFileName()
+	if err != nil {
+		return nil, err
+	}
+	defer removeTemp(packedFile)
+
+	// Decrypt
+	plainKeyFileName, cleanup, err := openSecretKey(ctx, keyFileName)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	if err := checkSecretKey(keyFileName, plainKeyFileName, inputFileName); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	err = b.Dec(ctx, plainKeyFileName, inputFileName, packedFile)
+	logStep("decrypt", start, err, "backend", b.Name(), "input", inputFileName, "size", fileSize(inputFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	// Unpack
+	raw, err := ReadPlainPacketFile(packedFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse the result
+	var pkt PlainPacket
+	if err := pkt.Load(raw, profile); err != nil {
+		return nil, err
+	}
+	return &pkt, nil
+}
+
+// Emulate runs the ELF file inputFileName in plaintext mode and returns the
+// final state of the CPU.
+func Emulate(ctx context.Context, b Backend, inputFileName string, cmdOpts []string, profile CPUProfile, iyokanArgs []string) (*PlainPacket, error) {
+	// Create tmp file for packing
+	packedFile, err := tempFileName()
+	if err != nil {
+		return nil, err
+	}
+	defer removeTemp(packedFile)
+
+	// Pack
+	start := time.Now()
+	err = PackELF(inputFileName, packedFile, cmdOpts, profile)
+	logStep("pack", start, err, "input", inputFileName, "cpu", profile.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create tmp file for the result
+	resTmpFile, err := tempFileName()
+	if err != nil {
+		return nil, err
+	}
+	defer removeTemp(resTmpFile)
+
+	// Run Iyokan in plain mode
+	blueprint, err := profile.blueprintPath()
+	if err != nil {
+		return nil, err
+	}
+	start = time.Now()
+	err = b.RunPlain(ctx, blueprint, packedFile, resTmpFile, iyokanArgs)
+	logStep("emulate", start, err, "backend", b.Name(), "cpu", profile.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unpack the result
+	raw, err := ReadPlainPacketFile(resTmpFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse the result
+	var pkt PlainPacket
+	if err := pkt.Load(raw, profile); err != nil {
+		return nil, err
+	}
+	return &pkt, nil
+}
+
+// RunOptions configures an encrypted run by Run or Resume.
+type RunOptions struct {
+	// Cycles is the number of clocks to run.
+	Cycles uint
+	// BootstrappingKey is the bootstrapping key file name.
+	BootstrappingKey string
+	// Input is the encrypted packet for Run, or the snapshot for Resume.
+	Input string
+	// Output is the file name of the encrypted result.
+	Output string
+	// Snapshot is the snapshot file name to write in. DefaultSnapshotName is
+	// used if empty.
+	Snapshot string
+	// NumGPU is the number of GPUs to use; 0 means CPU mode. Only Run uses it.
+	NumGPU uint
+	Quiet  bool
+	// IyokanArgs is appended to the evaluator's arguments as is.
+	IyokanArgs []string
+	// Progress, if not nil, is called with the progress of the run, when it
+	// starts, after each clock and when it ends. It is called only at the
+	// start and the end if Quiet or if the backend cannot report its clocks.
+	Progress func(Progress)
+	// Stdout receives the evaluator's output if Progress is set. os.Stdout
+	// is used if nil.
+	Stdout io.Writer
+	// HideCycleLines drops the evaluator's lines of the clocks from Stdout,
+	// e.g. because Progress shows the progress in their place.
+	HideCycleLines bool
+	// CheckpointEvery, if not 0, makes Run and Resume run in chunks of that
+	// many clocks, replacing Output and Snapshot after each, so that an
+	// interrupted run loses at most a chunk.
+	CheckpointEvery uint
+}
+
+// DefaultSnapshotName returns a snapshot file name based on the current time.
+func DefaultSnapshotName() string {
+	return fmt.Sprintf(
+		"kvsp_%s.snapshot", time.Now().Format("20060102150405"))
+}
+
+// Run runs the encrypted packet opts.Input on profile over TFHE. If ctx is
+// done before the run ends, it stops the evaluator and returns an
+// *InterruptedError.
+func Run(ctx context.Context, b Backend, opts RunOptions, profile CPUProfile) error {
+	if opts.Cycles == 0 || opts.BootstrappingKey == "" || opts.Input == "" || opts.Output == "" {
+		return errors.New("Specify -c, -bkey, -i, and -o options properly")
+	}
+	if opts.CheckpointEvery > 0 && opts.CheckpointEvery < opts.Cycles {
+		_, err := runChunks(ctx, b, opts, profile, false, opts.CheckpointEvery, nil)
+		return err
+	}
+	return run(ctx, b, opts, profile)
+}
+
+func run(ctx context.Context, b Backend, opts RunOptions, profile CPUProfile) error {
+	if err := CheckBlueprint(profile); err != nil {
+		return err
+	}
+	blueprint, err := profile.blueprintPath()
+	if err != nil {
+		return err
+	}
+
+	args := []string{
+		"-i", opts.Input,
+		"--blueprint", blueprint,
+	}
+	if opts.NumGPU > 0 {
+		args = append(args, "--enable-gpu", "--gpu_num", fmt.Sprint(opts.NumGPU))
+	}
+
+	info, err := newSnapshotInfo(b, opts, false)
+	if err != nil {
+		return err
+	}
+	info.CPU = profile.Name
+	info.Blueprint = blueprint
+	if info.BlueprintSHA256, err = fileSHA256(blueprint); err != nil {
+		return err
+	}
+
+	return runIyokanTFHE(ctx, b, opts, args, info)
+}
+
+// Resume continues the encrypted run saved in the snapshot opts.Input. It
+// stops like Run when ctx is done.
+func Resume(ctx context.Context, b Backend, opts RunOptions) error {
+	if opts.Cycles == 0 || opts.BootstrappingKey == "" || opts.Input == "" || opts.Output == "" {
+		return errors.New("Specify -c, -bkey, -i, and -o options properly")
+	}
+	if opts.CheckpointEvery > 0 && opts.CheckpointEvery < opts.Cycles {
+		_, err := runChunks(ctx, b, opts, CPUProfile{}, true, opts.CheckpointEvery, nil)
+		return err
+	}
+	err := resume(ctx, b, opts)
+	// The snapshot resumed from is still the last checkpoint.
+	var interrupted *InterruptedError
+	if errors.As(err, &interrupted) {
+		interrupted.Checkpoint = opts.Input
+	}
+	return err
+}
+
+func resume(ctx context.Context, b Backend, opts RunOptions) error {
+	// Refuse a mismatched backend or key before Iyokan does.
+	info, err := newSnapshotInfo(b, opts, true)
+	if err != nil {
+		return err
+	}
+
+	args := []string{
+		"--resume", opts.Input,
+	}
+	return runIyokanTFHE(ctx, b, opts, args, info)
+}
+
+// RunUntilDoneOptions configures RunUntilDone. RunOptions.Cycles is the
+// number of clocks to run in each chunk.
+type RunUntilDoneOptions struct {
+	RunOptions
+	// SecretKey is the secret key file name used to read finflag between
+	// chunks.
+	SecretKey string
+	// MaxCycles is the limit of the total number of clocks.
+	MaxCycles uint
+}
+
+// RunUntilDone runs the encrypted packet opts.Input in chunks of opts.Cycles
+// clocks, resuming from the snapshot until the program halts or MaxCycles
+// clocks have run. Only finflag of each intermediate result is looked at.
+// opts.Output and opts.Snapshot are replaced only after a chunk succeeds, so
+// they always hold the last complete chunk. It returns the total number of
+// clocks run and whether the program has halted. It stops like Run when ctx
+// is done.
+func RunUntilDone(ctx context.Context, b Backend, opts RunUntilDoneOptions, profile CPUProfile) (uint, bool, error) {
+	start := time.Now()
+	cycles, finished, err := runUntilDone(ctx, b, opts, profile)
+	logRun("run-until-done", start, err, b, profile.Name, cycles, opts.NumGPU, "finished", finished)
+	return cycles, finished, err
+}
+
+func runUntilDone(ctx context.Context, b Backend, opts RunUntilDoneOptions, profile CPUProfile) (uint, bool, error) {
+	if opts.Cycles == 0 || opts.MaxCycles == 0 || opts.SecretKey == "" ||
+		opts.BootstrappingKey == "" || opts.Input == "" || opts.Output == "" {
+		return 0, false, errors.New("Specify -chunk, -max, -k, -bkey, -i, and -o options properly")
+	}
+	if opts.Snapshot == "" {
+		opts.Snapshot = DefaultSnapshotName()
+	}
+	// Ask for the passphrase only once.
+	plainKeyFileName, cleanup, err := openSecretKey(ctx, opts.SecretKey)
+	if err != nil {
+		return 0, false, err
+	}
+	defer cleanup()
+
+	chunked := opts.RunOptions
+	chunked.Cycles = opts.MaxCycles
+	var finished bool
+	total, err := runChunks(ctx, b, chunked, profile, false, opts.Cycles, func() (bool, error) {
+		var err error
+		finished, err = decryptFinflag(ctx, b, opts.SecretKey, plainKeyFileName, opts.Output)
+		return finished, err
+	})
+	return total, finished, err
+}
+
+// runChunks runs opts.Cycles clocks of the encrypted packet opts.Input, or
+// from the snapshot opts.Input if fromSnapshot, in chunks of chunkCycles
+// clocks. opts.Output and opts.Snapshot are replaced only after a chunk
+// succeeds, so they always hold the last complete chunk. done, if not nil, is
+// called after each chunk and stops the run if it returns true. It returns
+// the total number of clocks run.
+func runChunks(ctx context.Context, b Backend, opts RunOptions, profile CPUProfile, fromSnapshot bool, chunkCycles uint,
+	done func() (bool, error)) (uint, error) {
+	if opts.Snapshot == "" {
+		opts.Snapshot = DefaultSnapshotName()
+	}
+
+	// interrupted returns the error for the interruption after total
+	// clocks, with the last checkpoint.
+	interrupted := func(total uint) error {
+		checkpoint := ""
+		if total > 0 {
+			checkpoint = opts.Snapshot
+		} else if fromSnapshot {
+			checkpoint = opts.Input
+		}
+		return interruptedError(ctx, total, checkpoint)
+	}
+
+	start := time.Now()
+	var total uint
+	for total < opts.Cycles {
+		chunk := opts
+		chunk.Cycles = chunkCycles
+		if rest := opts.Cycles - total; chunk.Cycles > rest {
+			chunk.Cycles = rest
+		}
+		chunk.CheckpointEvery = 0
+		if opts.Progress != nil {
+			// Report the progress of the whole run, which goes on after
+			// each chunk until it fails.
+			doneCycles := total
+			chunk.Progress = func(p Progress) {
+				if p.State == JobDone {
+					p.State = JobRunning
+				}
+				p.Cycles += doneCycles
+				p.Total = opts.Cycles
+				p.Start = start
+				opts.Progress(p)
+			}
+		}
+		chunk.Output = opts.Output + ".next"
+		chunk.Snapshot = opts.Snapshot + ".next"
+
+		var err error
+		if total == 0 && !fromSnapshot {
+			err = run(ctx, b, chunk, profile)
+		} else {
+			if total > 0 {
+				chunk.Input = opts.Snapshot
+			}
+			err = resume(ctx, b, chunk)
+		}
+		if err != nil {
+			removeWithMeta(chunk.Output)
+			removeWithMeta(chunk.Snapshot)
+			var interruptedErr *InterruptedError
+			if errors.As(err, &interruptedErr) {
+				return total, interrupted(total)
+			}
+			return total, err
+		}
+		if err := renameWithMeta(chunk.Output, opts.Output); err != nil {
+			return total, err
+		}
+		if err := renameWithMeta(chunk.Snapshot, opts.Snapshot); err != nil {
+			return total, err
+		}
+		if err := setSnapshotOutput(opts.Snapshot, opts.Output); err != nil {
+			return total, err
+		}
+		total += chunk.Cycles
+
+		if ctx.Err() != nil {
+			return total, interrupted(total)
+		}
+		if done == nil {
+			continue
+		}
+		stop, err := done()
+		if ctx.Err() != nil {
+			return total, interrupted(total)
+		}
+		if err != nil || stop {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// decryptFinflag decrypts the encrypted result inputFileName with the secret
+// key keyFileName, which is unwrapped in plainKeyFileName, and returns its
+// finflag.
+func decryptFinflag(ctx context.Context, b Backend, keyFileName, plainKeyFileName, inputFileName string) (bool, error) {
+	packedFile, err := tempFileName()
+	if err != nil {
+		return false, err
+	}
+	defer removeTemp(packedFile)
+
+	if err := checkSecretKey(keyFileName, plainKeyFileName, inputFileName); err != nil {
+		return false, err
+	}
+	start := time.Now()
+	err = b.Dec(ctx, plainKeyFileName, inputFileName, packedFile)
+	logStep("decrypt", start, err, "backend", b.Name(), "input", inputFileName, "size", fileSize(inputFileName))
+	if err != nil {
+		return false, err
+	}
+	raw, err := ReadPlainPacketFile(packedFile)
+	if err != nil {
+		return false, err
+	}
+	entry, ok := raw.Bits["finflag"]
+	if !ok || entry.Size != 1 {
+		return false, fmt.Errorf("%s has no finflag", inputFileName)
+	}
+	return entry.Bytes[0] != 0, nil
+}
+
+// logRun logs an encrypted run of cycles clocks which started at start,
+// with its throughput in cycles per second, and attrs.
+func logRun(msg string, start time.Time, err error, b Backend, cpu string, cycles, numGPU uint, attrs ...any) {
+	attrs = append(attrs, "backend", b.Name(), "cpu", cpu, "cycles", cycles, "gpus", numGPU)
+	if secs := time.Since(start).Seconds(); err == nil && secs > 0 {
+		attrs = append(attrs, "cycles_per_sec", float64(cycles)/secs)
+	}
+	logStep(msg, start, err, attrs...)
+}
+
+func runIyokanTFHE(ctx context.Context, b Backend, opts RunOptions, otherArgs []string, info *SnapshotInfo) error {
+	snapshotFileName := opts.Snapshot
+	if snapshotFileName == "" {
+		snapshotFileName = DefaultSnapshotName()
+	}
+
+	args := []string{
+		"--evalkey", opts.BootstrappingKey,
+		"-o", opts.Output,
+		"-c", fmt.Sprint(opts.Cycles),
+		"--snapshot", snapshotFileName,
+	}
+	// The evaluator reports its clocks only without --quiet, so that only
+	// the start and the end of a quiet run are reported.
+	runner, canReport := b.(tfheOutputRunner)
+	var progress *progressWriter
+	if opts.Progress != nil {
+		out := opts.Stdout
+		if out == nil {
+			out = os.Stdout
+		}
+		progress = newProgressWriter(out, opts.Cycles, canReport && !opts.Quiet, opts.HideCycleLines, opts.Progress)
+	}
+	if opts.Quiet {
+		args = append(args, "--quiet")
+	}
+	args = append(args, otherArgs...)
+	args = append(args, opts.IyokanArgs...)
+	start := time.Now()
+	var err error
+	if progress != nil && canReport {
+		err = runner.runTFHEOutput(ctx, args, progress)
+	} else {
+		err = b.RunTFHE(ctx, args)
+	}
+	logRun("run", start, err, b, info.CPU, opts.Cycles, opts.NumGPU)
+	if ctx.Err() != nil && err != nil {
+		// The evaluator was stopped in the middle, so that the snapshot it
+		// was writing, if any, may be incomplete, and nothing tells if it is.
+		// The run keeps only the checkpoints taken by runChunks.
+		if snapshotFileName != opts.Input {
+			removeWithMeta(snapshotFileName)
+		}
+		err = interruptedError(ctx, 0, "")
+	}
+	if err == nil {
+		err = writeFileMeta(opts.Output, "result", info.KeyFingerprint)
+	}
+	if err == nil {
+		err = writeSnapshotInfo(snapshotFileName, info)
+	}
+	if progress != nil {
+		if err != nil {
+			progress.finish(progress.cycles, err)
+		} else {
+			progress.finish(opts.Cycles, nil)
+		}
+	}
+	return err
+}
+
+// tfheOutputRunner is a Backend which can write the standard output of its
+// evaluator elsewhere, so that its progress can be read.
+type tfheOutputRunner interface {
+	runTFHEOutput(ctx context.Context, args []string, stdout io.Writer) error
+}
@@ -0,0 +1,197 @@
+package kvsp
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeBackend runs nothing. Each RunTFHE call writes its -o and --snapshot
+// files with the call number, and Dec reports finflag once haltAfter calls
+// have been made.
+type fakeBackend struct {
+	haltAfter int
+	calls     [][]string
+}
+
+func (f *fakeBackend) Name() string { return "fake" }
+func (f *fakeBackend) GenKey(_ context.Context, out string) error {
+	return os.WriteFile(out, []byte(out), 0600)
+}
+func (f *fakeBackend) GenEvalKey(_ context.Context, in, out string) error {
+	return os.WriteFile(out, []byte(in), 0644)
+}
+func (f *fakeBackend) Enc(_ context.Context, key, in, out string) error {
+	return os.WriteFile(out, []byte(key), 0644)
+}
+func (f *fakeBackend) RunPlain(_ context.Context, bp, in, out string, _ []string) error { return nil }
+func (f *fakeBackend) Probe() (Capabilities, error)                                     { return Capabilities{}, nil }
+
+func (f *fakeBackend) RunTFHE(ctx context.Context, args []string) error {
+	f.calls = append(f.calls, args)
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == "-o" || args[i] == "--snapshot" {
+			if err := os.WriteFile(args[i+1], []byte{byte(len(f.calls))}, 0644); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (f *fakeBackend) Dec(_ context.Context, key, in, out string) error {
+	finflag := byte(0)
+	if len(f.calls) >= f.haltAfter {
+		finflag = 1
+	}
+	return WritePlainPacketFile(out, &RawPlainPacket{
+		ROM:  map[string]PacketEntry{},
+		RAM:  map[string]PacketEntry{},
+		Bits: map[string]PacketEntry{"finflag": {Size: 1, Bytes: []byte{finflag}}},
+	})
+}
+
+func TestRunUntilDone(t *testing.T) {
+	profile := testProfile(t, "ruby")
+	dir := t.TempDir()
+	bkey := writeTestFile(t, dir, "bootstrapping.key", "bkey")
+	input := writeTestFile(t, dir, "fib.enc", "fib")
+	opts := RunUntilDoneOptions{
+		RunOptions: RunOptions{
+			Cycles:           100,
+			BootstrappingKey: bkey,
+			Input:            input,
+			Output:           filepath.Join(dir, "result.enc"),
+			Snapshot:         filepath.Join(dir, "result.snapshot"),
+		},
+		SecretKey: writeTestFile(t, dir, "secret.key", "key"),
+		MaxCycles: 250,
+	}
+
+	tests := []struct {
+		haltAfter int
+		cycles    uint
+		finished  bool
+	}{
+		{1, 100, true},
+		{3, 250, true},
+		{4, 250, false},
+	}
+	for _, tt := range tests {
+		b := &fakeBackend{haltAfter: tt.haltAfter}
+		cycles, finished, err := RunUntilDone(context.Background(), b, opts, profile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cycles != tt.cycles || finished != tt.finished {
+			t.Errorf("haltAfter %d: RunUntilDone() = %d, %t; want %d, %t",
+				tt.haltAfter, cycles, finished, tt.cycles, tt.finished)
+		}
+
+		if got := argValue(b.calls[0], "-i"); got != input {
+			t.Errorf("first chunk reads %q", got)
+		}
+		for _, args := range b.calls[1:] {
+			if got := argValue(args, "--resume"); got != opts.Snapshot {
+				t.Errorf("chunk resumes from %q", got)
+			}
+		}
+		if got := argValue(b.calls[len(b.calls)-1], "-c"); len(b.calls) == 3 && got != "50" {
+			t.Errorf("last chunk runs %s cycles, want 50", got)
+		}
+		for _, file := range []string{opts.Output, opts.Snapshot} {
+			data, err := os.ReadFile(file)
+			if err != nil || len(data) != 1 || int(data[0]) != len(b.calls) {
+				t.Errorf("%s = %v, %v; want the last chunk's", file, data, err)
+			}
+			if _, err := os.Stat(file + ".next"); !os.IsNotExist(err) {
+				t.Errorf("%s.next is left behind", file)
+			}
+		}
+		info, err := ReadSnapshotInfo(opts.Snapshot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Cycles != cycles || info.Output != opts.Output || info.CPU != "ruby" || info.Backend != "fake" {
+			t.Errorf("snapshot metadata = %+v", info)
+		}
+	}
+}
+
+func argValue(args []string, name string) string {
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == name {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+func writeTestFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// interruptingBackend is fakeBackend whose evaluator is stopped by cancel in
+// its call number at.
+type interruptingBackend struct {
+	fakeBackend
+	at     int
+	cancel context.CancelCauseFunc
+}
+
+var errTestStop = errors.New("stopped by the test")
+
+func (b *interruptingBackend) RunTFHE(ctx context.Context, args []string) error {
+	if len(b.calls)+1 == b.at {
+		b.calls = append(b.calls, args)
+		b.cancel(errTestStop)
+		return errors.New("signal: terminated")
+	}
+	return b.fakeBackend.RunTFHE(ctx, args)
+}
+
+func TestRunInterrupted(t *testing.T) {
+	profile := testProfile(t, "ruby")
+	dir := t.TempDir()
+	opts := RunOptions{
+		Cycles:           30,
+		BootstrappingKey: writeTestFile(t, dir, "bootstrapping.key", "bkey"),
+		Input:            writeTestFile(t, dir, "fib.enc", "fib"),
+		Output:           filepath.Join(dir, "result.enc"),
+		Snapshot:         filepath.Join(dir, "result.snapshot"),
+		CheckpointEvery:  10,
+	}
+
+	for _, tc := range []struct {
+		at         int
+		cycles     uint
+		checkpoint string
+	}{
+		{1, 0, ""},
+		{2, 10, opts.Snapshot},
+	} {
+		ctx, cancel := context.WithCancelCause(context.Background())
+		b := &interruptingBackend{at: tc.at, cancel: cancel}
+		err := Run(ctx, b, opts, profile)
+		var interrupted *InterruptedError
+		if !errors.As(err, &interrupted) || !errors.Is(err, errTestStop) {
+			t.Fatalf("Run() = %v, want an *InterruptedError by errTestStop", err)
+		}
+		if interrupted.Cycles != tc.cycles || interrupted.Checkpoint != tc.checkpoint {
+			t.Errorf("interrupted at call %d: %+v", tc.at, interrupted)
+		}
+		if len(b.calls) != tc.at {
+			t.Errorf("%d calls after the interruption at call %d", len(b.calls), tc.at)
+		}
+		if _, err := os.Stat(opts.Snapshot + ".next"); !os.IsNotExist(err) {
+			t.Errorf("the snapshot of the interrupted chunk is left behind")
+		}
+	}
+}
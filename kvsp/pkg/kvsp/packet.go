@@ -0,0 +1,172 @@
+package kvsp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+type plainPacketTOML struct {
+	NumCycles *int                   `toml:"cycles,omitempty"`
+	Rom       []plainPacketEntryTOML `toml:"rom,omitempty"`
+	Ram       []plainPacketEntryTOML `toml:"ram"`
+	Bits      []plainPacketEntryTOML `toml:"bits"`
+}
+type plainPacketEntryTOML struct {
+	Name  string `toml:"name"`
+	Size  int    `toml:"size"`
+	Bytes []int  `toml:"bytes"`
+}
+
+// PlainPacket is the decoded state of the CPU: its cycle count, flags,
+// registers and RAM.
+type PlainPacket struct {
+	NumCycles int
+	Flags     map[string]bool
+	Regs      map[string]int
+	Ram       []int
+	// Variables are filled in by ReadVariables.
+	Variables []Variable
+}
+
+func bytesToLE(bytes []byte, bitWidth int) (int, error) {
+	byteWidth := bitWidth / 8
+	if bitWidth%8 != 0 || len(bytes) < byteWidth {
+		return 0, errors.New("Invalid result packet")
+	}
+	val := 0
+	for i := 0; i < byteWidth; i++ {
+		val |= int(bytes[i]) << (8 * i)
+	}
+	return val, nil
+}
+
+// LoadTOML loads the output of `iyokan-packet packet2toml` into pkt.
+func (pkt *PlainPacket) LoadTOML(src string, profile CPUProfile) error {
+	raw, err := ParsePlainPacketTOML(src)
+	if err != nil {
+		return err
+	}
+	return pkt.Load(raw, profile)
+}
+
+// Load decodes the result packet raw of profile into pkt.
+func (pkt *PlainPacket) Load(raw *RawPlainPacket, profile CPUProfile) error {
+	pkt.NumCycles = 0
+	if raw.NumCycles != nil {
+		pkt.NumCycles = *raw.NumCycles
+	}
+
+	// Load flags and registers
+	pkt.Flags = make(map[string]bool)
+	pkt.Regs = make(map[string]int)
+	for name, entry := range raw.Bits {
+		if entry.Size == 1 { // flag
+			if len(entry.Bytes) < 1 {
+				return errors.New("Invalid result packet")
+			}
+			pkt.Flags[name] = entry.Bytes[0] != 0
+		} else if entry.Size == profile.RegWidth { // register
+			val, err := bytesToLE(entry.Bytes, entry.Size)
+			if err != nil {
+				return err
+			}
+			pkt.Regs[name] = val
+		} else {
+			return fmt.Errorf("Invalid result packet: '%s' is %d bits wide but registers of CPU %q are %d bits wide",
+				name, entry.Size, profile.Name, profile.RegWidth)
+		}
+	}
+
+	// Load ram
+	pkt.Ram = nil
+	if entry, ok := raw.RAM["ram"]; ok {
+		if entry.Size%8 != 0 {
+			return errors.New("Invalid RAM data: size is not multiple of 8")
+		}
+		pkt.Ram = make([]int, entry.Size/8)
+		for addr := range pkt.Ram {
+			pkt.Ram[addr] = int(entry.Bytes[addr])
+		}
+	} else {
+		return errors.New("Invalid result packet: 'ram' not found")
+	}
+
+	// Check if the packet is correct
+	if _, ok := pkt.Flags["finflag"]; !ok {
+		return errors.New("Invalid result packet: 'finflag' not found")
+	}
+	for i := 0; i < profile.RegCount; i++ {
+		name := fmt.Sprintf("reg_x%d", i)
+		if _, ok := pkt.Regs[name]; !ok {
+			return errors.New("Invalid result packet: '" + name + "' not found")
+		}
+	}
+
+	return nil
+}
+
+// ExitValue returns the value main() returned, i.e. the return register of
+// profile as a signed integer. It is meaningful only if finflag is set.
+func (pkt *PlainPacket) ExitValue(profile CPUProfile) int {
+	val := pkt.Regs[fmt.Sprintf("reg_x%d", profile.ReturnRegister)]
+	shift := uint(64 - profile.RegWidth)
+	return int(int64(uint64(val)<<shift) >> shift)
+}
+
+// Print writes pkt to w in KVSP's tab-separated text layout.
+func (pkt *PlainPacket) Print(w io.Writer, profile CPUProfile) error {
+	fmt.Fprintf(w, "#cycle\t%d\n", pkt.NumCycles)
+	fmt.Fprintf(w, "\n")
+	fmt.Fprintf(w, "f0\t%t\n", pkt.Flags["finflag"])
+	fmt.Fprintf(w, "exit\t%d\n", pkt.ExitValue(profile))
+	fmt.Fprintf(w, "\n")
+	for i := 0; i < profile.RegCount; i++ {
+		name := fmt.Sprintf("reg_x%d", i)
+		fmt.Fprintf(w, "x%d\t%d\n", i, pkt.Regs[name])
+	}
+	fmt.Fprintf(w, "\n")
+	fmt.Fprintf(w, "      \t 0  1  2  3  4  5  6  7  8  9  a  b  c  d  e  f")
+	for addr := 0; addr < len(pkt.Ram); addr++ {
+		if addr%16 == 0 {
+			fmt.Fprintf(w, "\n%06x\t", addr)
+		}
+		fmt.Fprintf(w, "%02x ", pkt.Ram[addr])
+	}
+	fmt.Fprintf(w, "\n")
+	printVariables(w, pkt.Variables)
+
+	return nil
+}
+
+type plainPacketJSON struct {
+	Cycles    int            `json:"cycles"`
+	Finflag   bool           `json:"finflag"`
+	ExitValue int            `json:"exit_value"`
+	Registers map[string]int `json:"registers"`
+	Ram       []int          `json:"ram"`
+	Variables []Variable     `json:"variables,omitempty"`
+}
+
+// PrintJSON writes pkt to w as a JSON object. Registers are named x0, x1,
+// and so on as in Print, and RAM is an array of bytes.
+func (pkt *PlainPacket) PrintJSON(w io.Writer, profile CPUProfile) error {
+	out := plainPacketJSON{
+		Cycles:    pkt.NumCycles,
+		Finflag:   pkt.Flags["finflag"],
+		ExitValue: pkt.ExitValue(profile),
+		Registers: make(map[string]int, profile.RegCount),
+		Ram:       pkt.Ram,
+		Variables: pkt.Variables,
+	}
+	for i := 0; i < profile.RegCount; i++ {
+		out.Registers[fmt.Sprintf("x%d", i)] = pkt.Regs[fmt.Sprintf("reg_x%d", i)]
+	}
+	if out.Ram == nil {
+		out.Ram = []int{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
@@ -0,0 +1,146 @@
+package kvsp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// testResultPacket returns a result packet of profile with reg_xN = N.
+func testResultPacket(profile CPUProfile, finished bool) *RawPlainPacket {
+	numCycles := 42
+	fin := byte(0)
+	if finished {
+		fin = 1
+	}
+	pkt := &RawPlainPacket{
+		ROM:       map[string]PacketEntry{},
+		RAM:       map[string]PacketEntry{"ram": {Size: 8 * int(profile.RAMSize), Bytes: make([]byte, profile.RAMSize)}},
+		Bits:      map[string]PacketEntry{"finflag": {Size: 1, Bytes: []byte{fin}}},
+		NumCycles: &numCycles,
+	}
+	for i := 0; i < profile.RegCount; i++ {
+		reg := make([]byte, profile.RegWidth/8)
+		reg[0] = byte(i)
+		pkt.Bits[fmt.Sprintf("reg_x%d", i)] = PacketEntry{Size: profile.RegWidth, Bytes: reg}
+	}
+	pkt.RAM["ram"].Bytes[3] = 0xab
+	return pkt
+}
+
+func TestWritePlainPacketLayout(t *testing.T) {
+	pkt := &RawPlainPacket{
+		ROM:  map[string]PacketEntry{},
+		RAM:  map[string]PacketEntry{"ram": {Size: 3, Bytes: []byte{0x05}}},
+		Bits: map[string]PacketEntry{},
+	}
+	var buf bytes.Buffer
+	if err := WritePlainPacket(&buf, pkt); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{
+		1,                      // little endian
+		1, 0, 0, 0, 0, 0, 0, 0, // ram: 1 entry
+		3, 0, 0, 0, 0, 0, 0, 0, 'r', 'a', 'm',
+		3, 0, 0, 0, 0, 0, 0, 0, 1, 0, 1,
+		0, 0, 0, 0, 0, 0, 0, 0, // rom: empty
+		0, 0, 0, 0, 0, 0, 0, 0, // bits: empty
+		1, // no cycles
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("WritePlainPacket wrote\n% x\nwant\n% x", buf.Bytes(), want)
+	}
+}
+
+func TestPlainPacketRoundTrip(t *testing.T) {
+	profile := testProfile(t, "ruby")
+	pkt := testResultPacket(profile, true)
+
+	var buf bytes.Buffer
+	if err := WritePlainPacket(&buf, pkt); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadPlainPacket(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, pkt) {
+		t.Fatalf("ReadPlainPacket(WritePlainPacket(pkt)) = %+v, want %+v", got, pkt)
+	}
+
+	src, err := pkt.TOML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = ParsePlainPacketTOML(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, pkt) {
+		t.Fatalf("ParsePlainPacketTOML(pkt.TOML()) = %+v, want %+v", got, pkt)
+	}
+
+	var res PlainPacket
+	if err := res.LoadTOML(src, profile); err != nil {
+		t.Fatal(err)
+	}
+	if res.NumCycles != 42 || !res.Flags["finflag"] || res.Regs["reg_x8"] != 8 || res.Ram[3] != 0xab {
+		t.Fatalf("LoadTOML = %+v", res)
+	}
+}
+
+func TestPlainPacketLoadRejectsOtherCPU(t *testing.T) {
+	pkt := testResultPacket(testProfile(t, "alexandrite"), true)
+	var res PlainPacket
+	if err := res.Load(pkt, testProfile(t, "ruby")); err == nil {
+		t.Fatal("Load accepted 32-bit registers for ruby")
+	}
+}
+
+func TestPlainPacketPrintJSON(t *testing.T) {
+	profile := testProfile(t, "ruby")
+	var pkt PlainPacket
+	if err := pkt.Load(testResultPacket(profile, true), profile); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := pkt.PrintJSON(&buf, profile); err != nil {
+		t.Fatal(err)
+	}
+
+	var got struct {
+		Cycles    int            `json:"cycles"`
+		Finflag   bool           `json:"finflag"`
+		Registers map[string]int `json:"registers"`
+		Ram       []int          `json:"ram"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Cycles != 42 || !got.Finflag || len(got.Registers) != 16 || got.Registers["x15"] != 15 ||
+		len(got.Ram) != 512 || got.Ram[3] != 0xab {
+		t.Fatalf("PrintJSON wrote %s", buf.String())
+	}
+}
+
+func TestPlainPacketExitValue(t *testing.T) {
+	ruby := testProfile(t, "ruby")
+	alexandrite := testProfile(t, "alexandrite")
+	for _, tc := range []struct {
+		profile CPUProfile
+		regs    map[string]int
+		want    int
+	}{
+		{ruby, map[string]int{"reg_x8": 5, "reg_x10": 7}, 5},
+		{ruby, map[string]int{"reg_x8": 0xffff}, -1},
+		{alexandrite, map[string]int{"reg_x8": 5, "reg_x10": 7}, 7},
+		{alexandrite, map[string]int{"reg_x10": 0xfffffffe}, -2},
+	} {
+		pkt := PlainPacket{Regs: tc.regs}
+		if got := pkt.ExitValue(tc.profile); got != tc.want {
+			t.Errorf("ExitValue(%s, %v) = %d, want %d", tc.profile.Name, tc.regs, got, tc.want)
+		}
+	}
+}
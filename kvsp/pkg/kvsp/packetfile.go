@@ -0,0 +1,306 @@
+package kvsp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/BurntSushi/toml"
+)
+
+// PacketEntry is a named port or memory in a plain packet. Bytes holds Size
+// bits, least significant bit first.
+type PacketEntry struct {
+	Size  int
+	Bytes []byte
+}
+
+// RawPlainPacket is a plain packet as Iyokan stores it: the contents of ROM,
+// RAM and the other ports, and the number of cycles run if known.
+type RawPlainPacket struct {
+	ROM       map[string]PacketEntry
+	RAM       map[string]PacketEntry
+	Bits      map[string]PacketEntry
+	NumCycles *int
+}
+
+/*
+	Iyokan serializes its PlainPacket with cereal's PortableBinaryArchive:
+
+		uint8   1 if the rest is little endian, 0 if big endian
+		map     ram
+		map     rom
+		map     bits
+		uint8   1 if numCycles is empty (std::optional), 0 otherwise
+		int32   numCycles, only if not empty
+
+	where a map is a uint64 count followed by that many (string, bits)
+	pairs, a string is a uint64 length and that many bytes, and bits is a
+	uint64 length and that many bytes, each of which is 0 or 1.
+*/
+
+const maxPacketFieldLen = 1 << 30
+
+type packetReader struct {
+	r     *bufio.Reader
+	order binary.ByteOrder
+}
+
+func (pr *packetReader) read(data interface{}) error {
+	return binary.Read(pr.r, pr.order, data)
+}
+
+func (pr *packetReader) readLen() (int, error) {
+	var n uint64
+	if err := pr.read(&n); err != nil {
+		return 0, err
+	}
+	if n > maxPacketFieldLen {
+		return 0, fmt.Errorf("Invalid plain packet: length %d is too large", n)
+	}
+	return int(n), nil
+}
+
+func (pr *packetReader) readBytes() ([]byte, error) {
+	n, err := pr.readLen()
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(pr.r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (pr *packetReader) readMap() (map[string]PacketEntry, error) {
+	count, err := pr.readLen()
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]PacketEntry, count)
+	for i := 0; i < count; i++ {
+		name, err := pr.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		bits, err := pr.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		entry := PacketEntry{Size: len(bits), Bytes: make([]byte, (len(bits)+7)/8)}
+		for j, bit := range bits {
+			switch bit {
+			case 0:
+			case 1:
+				entry.Bytes[j/8] |= 1 << (j % 8)
+			default:
+				return nil, fmt.Errorf("Invalid plain packet: bit %d of %q is %d", j, name, bit)
+			}
+		}
+		entries[string(name)] = entry
+	}
+	return entries, nil
+}
+
+// ReadPlainPacket reads a plain packet in Iyokan's format from r.
+func ReadPlainPacket(r io.Reader) (*RawPlainPacket, error) {
+	pr := &packetReader{r: bufio.NewReader(r)}
+
+	endian, err := pr.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch endian {
+	case 0:
+		pr.order = binary.BigEndian
+	case 1:
+		pr.order = binary.LittleEndian
+	default:
+		return nil, errors.New("Invalid plain packet: bad header")
+	}
+
+	var pkt RawPlainPacket
+	if pkt.RAM, err = pr.readMap(); err != nil {
+		return nil, err
+	}
+	if pkt.ROM, err = pr.readMap(); err != nil {
+		return nil, err
+	}
+	if pkt.Bits, err = pr.readMap(); err != nil {
+		return nil, err
+	}
+	var nullopt uint8
+	if err := pr.read(&nullopt); err != nil {
+		return nil, err
+	}
+	if nullopt == 0 {
+		var numCycles int32
+		if err := pr.read(&numCycles); err != nil {
+			return nil, err
+		}
+		n := int(numCycles)
+		pkt.NumCycles = &n
+	}
+	return &pkt, nil
+}
+
+// ReadPlainPacketFile reads the plain packet in fileName.
+func ReadPlainPacketFile(fileName string) (*RawPlainPacket, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadPlainPacket(f)
+}
+
+func writePacketMap(w *bytes.Buffer, entries map[string]PacketEntry) error {
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	binary.Write(w, binary.LittleEndian, uint64(len(names)))
+	for _, name := range names {
+		entry := entries[name]
+		if entry.Size < 0 || entry.Size > 8*len(entry.Bytes) {
+			return fmt.Errorf("Invalid plain packet: %q has %d bits in %d bytes", name, entry.Size, len(entry.Bytes))
+		}
+		binary.Write(w, binary.LittleEndian, uint64(len(name)))
+		w.WriteString(name)
+		binary.Write(w, binary.LittleEndian, uint64(entry.Size))
+		for j := 0; j < entry.Size; j++ {
+			w.WriteByte((entry.Bytes[j/8] >> (j % 8)) & 1)
+		}
+	}
+	return nil
+}
+
+// WritePlainPacket writes pkt to w in Iyokan's format.
+func WritePlainPacket(w io.Writer, pkt *RawPlainPacket) error {
+	var buf bytes.Buffer
+	buf.WriteByte(1) // little endian
+	for _, entries := range []map[string]PacketEntry{pkt.RAM, pkt.ROM, pkt.Bits} {
+		if err := writePacketMap(&buf, entries); err != nil {
+			return err
+		}
+	}
+	if pkt.NumCycles == nil {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+		binary.Write(&buf, binary.LittleEndian, int32(*pkt.NumCycles))
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// WritePlainPacketFile writes pkt to fileName.
+func WritePlainPacketFile(fileName string, pkt *RawPlainPacket) error {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	if err := WritePlainPacket(f, pkt); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func packetEntriesToTOML(entries map[string]PacketEntry) []plainPacketEntryTOML {
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out := make([]plainPacketEntryTOML, 0, len(names))
+	for _, name := range names {
+		entry := entries[name]
+		ints := make([]int, len(entry.Bytes))
+		for i, b := range entry.Bytes {
+			ints[i] = int(b)
+		}
+		out = append(out, plainPacketEntryTOML{Name: name, Size: entry.Size, Bytes: ints})
+	}
+	return out
+}
+
+func packetEntriesFromTOML(src []plainPacketEntryTOML) (map[string]PacketEntry, error) {
+	entries := make(map[string]PacketEntry, len(src))
+	for _, entry := range src {
+		if _, exists := entries[entry.Name]; exists {
+			return nil, fmt.Errorf("Invalid TOML data: same entry name %q", entry.Name)
+		}
+		if entry.Size < 0 || entry.Size > 8*len(entry.Bytes) {
+			return nil, fmt.Errorf("Invalid TOML data: %q has %d bits in %d bytes", entry.Name, entry.Size, len(entry.Bytes))
+		}
+		bytes := make([]byte, len(entry.Bytes))
+		for i, b := range entry.Bytes {
+			if b < 0 || b > 0xff {
+				return nil, fmt.Errorf("Invalid TOML data: byte %d of %q is %d", i, entry.Name, b)
+			}
+			bytes[i] = byte(b)
+		}
+		entries[entry.Name] = PacketEntry{Size: entry.Size, Bytes: bytes}
+	}
+	return entries, nil
+}
+
+func (pkt *RawPlainPacket) toTOML() plainPacketTOML {
+	return plainPacketTOML{
+		NumCycles: pkt.NumCycles,
+		Rom:       packetEntriesToTOML(pkt.ROM),
+		Ram:       packetEntriesToTOML(pkt.RAM),
+		Bits:      packetEntriesToTOML(pkt.Bits),
+	}
+}
+
+// TOML returns pkt in the format of `iyokan-packet packet2toml`.
+func (pkt *RawPlainPacket) TOML() (string, error) {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(pkt.toTOML()); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// ParsePlainPacketTOML parses the format of `iyokan-packet packet2toml`.
+func ParsePlainPacketTOML(src string) (*RawPlainPacket, error) {
+	var pktTOML plainPacketTOML
+	if _, err := toml.Decode(src, &pktTOML); err != nil {
+		return nil, err
+	}
+
+	var pkt RawPlainPacket
+	var err error
+	pkt.NumCycles = pktTOML.NumCycles
+	if pkt.ROM, err = packetEntriesFromTOML(pktTOML.Rom); err != nil {
+		return nil, err
+	}
+	if pkt.RAM, err = packetEntriesFromTOML(pktTOML.Ram); err != nil {
+		return nil, err
+	}
+	if pkt.Bits, err = packetEntriesFromTOML(pktTOML.Bits); err != nil {
+		return nil, err
+	}
+	return &pkt, nil
+}
+
+// NewPlainPacket returns a plain packet that initializes ROM and RAM with
+// the images in img.
+func NewPlainPacket(img *Image) *RawPlainPacket {
+	return &RawPlainPacket{
+		ROM:  map[string]PacketEntry{"rom": {Size: 8 * len(img.ROM), Bytes: img.ROM}},
+		RAM:  map[string]PacketEntry{"ram": {Size: 8 * len(img.RAM), Bytes: img.RAM}},
+		Bits: map[string]PacketEntry{},
+	}
+}
@@ -0,0 +1,89 @@
+package kvsp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func getExecDir() (string, error) {
+	execPath, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Dir(execPath), nil
+}
+
+func prefixExecDir(path string) (string, error) {
+	execPath, err := getExecDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(execPath, path), nil
+}
+
+// GetPathOf resolves the path of the binary or data file known as name,
+// e.g. "CLANG" or "CAHP_SIM". KVSP_<NAME>_PATH overrides the default, which
+// is relative to the running executable. Evaluator binaries are resolved by
+// their Backend, and blueprints and runtimes by their CPUProfile, which
+// honours KVSP_IYOKAN_BLUEPRINT_<CPU>_PATH, KVSP_CAHP_RT_PATH and
+// KVSP_ALEXANDRITE_RT_PATH for the built-in CPUs.
+func GetPathOf(name string) (string, error) {
+	/*
+		Do heuristic approach, which assumes binaries are in the current
+		(this executable's) directory, and others are in ../share/kvsp.
+	*/
+	path := ""
+	switch name {
+	case "CAHP_SIM":
+		path = "cahp-sim"
+	case "CLANG":
+		path = "clang"
+	default:
+		return "", errors.New("Invalid name")
+	}
+	return lookupPath(name, path, "")
+}
+
+// lookupPath returns KVSP_<NAME>_PATH if it is set, and otherwise path
+// relative to this executable's directory, or fallback there if path does
+// not exist.
+func lookupPath(name, path, fallback string) (string, error) {
+	// Check if environment variable is set in KVSP_XXX.
+	if envPath := os.Getenv(pathEnvName(name)); envPath != "" {
+		if !fileExists(envPath) {
+			return "", fmt.Errorf("%s not found at %s", name, envPath)
+		}
+		return envPath, nil
+	}
+
+	newPath, err := prefixExecDir(path)
+	if err != nil {
+		return "", err
+	}
+	if fileExists(newPath) {
+		return newPath, nil
+	}
+	if fallback != "" {
+		fallbackPath, err := prefixExecDir(fallback)
+		if err != nil {
+			return "", err
+		}
+		if fileExists(fallbackPath) {
+			return fallbackPath, nil
+		}
+		return "", fmt.Errorf("%s not found at %s or %s", name, newPath, fallbackPath)
+	}
+	return "", fmt.Errorf("%s not found at %s", name, newPath)
+}
+
+func pathEnvName(name string) string {
+	return "KVSP_" + strings.Replace(name, "-", "_", -1) + "_PATH"
+}
@@ -0,0 +1,181 @@
+package kvsp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Progress is how far an encrypted run has got.
+type Progress struct {
+	// State is JobRunning, JobDone or JobFailed.
+	State string
+	// Cycles is the number of clocks done out of Total.
+	Cycles, Total uint
+	// Start is when the run started, and Last when the last clock was done.
+	Start, Last time.Time
+	// Warning, if not empty, tells why the clocks were not followed.
+	Warning string
+}
+
+// ETA returns the expected time at now to run the rest of the clocks at the
+// rate so far, or -1 if unknown.
+func (p Progress) ETA(now time.Time) time.Duration {
+	if p.Cycles == 0 || p.Cycles > p.Total {
+		return -1
+	}
+	perCycle := p.Last.Sub(p.Start) / time.Duration(p.Cycles)
+	eta := perCycle*time.Duration(p.Total-p.Cycles) - now.Sub(p.Last)
+	if eta < 0 {
+		eta = 0
+	}
+	return eta
+}
+
+// Line returns the progress at now in a line, e.g. "12/30 cycles (40%),
+// 1m2s elapsed, ETA 1m33s".
+func (p Progress) Line(now time.Time) string {
+	line := fmt.Sprintf("%d/%d cycles (%d%%), %s elapsed", p.Cycles, p.Total, p.percent(),
+		now.Sub(p.Start).Round(time.Second))
+	if eta := p.ETA(now); eta >= 0 && p.State == JobRunning {
+		line += fmt.Sprintf(", ETA %s", eta.Round(time.Second))
+	}
+	if p.State != JobRunning {
+		line += ", " + p.State
+	}
+	return line
+}
+
+func (p Progress) percent() uint {
+	if p.Total == 0 {
+		return 0
+	}
+	return p.Cycles * 100 / p.Total
+}
+
+type progressJSON struct {
+	State          string    `json:"state"`
+	Cycles         uint      `json:"cycles"`
+	Total          uint      `json:"total"`
+	Percent        uint      `json:"percent"`
+	Started        time.Time `json:"started"`
+	ElapsedSeconds float64   `json:"elapsed_seconds"`
+	ETASeconds     *float64  `json:"eta_seconds,omitempty"`
+	Warning        string    `json:"warning,omitempty"`
+}
+
+// MarshalJSON encodes p with its elapsed time and ETA as of now.
+func (p Progress) MarshalJSON() ([]byte, error) {
+	now := time.Now()
+	out := progressJSON{
+		State:          p.State,
+		Cycles:         p.Cycles,
+		Total:          p.Total,
+		Percent:        p.percent(),
+		Started:        p.Start,
+		ElapsedSeconds: now.Sub(p.Start).Seconds(),
+		Warning:        p.Warning,
+	}
+	if eta := p.ETA(now); eta >= 0 && p.State == JobRunning {
+		secs := eta.Seconds()
+		out.ETASeconds = &secs
+	}
+	return json.Marshal(out)
+}
+
+// Iyokan prints "#N" before each clock and "\tdone. (T us)" after it,
+// unless --quiet.
+var cycleLineRegexp = regexp.MustCompile(`#(\d+):?\s+done\b`)
+
+// noCycleLines is the Warning of a run whose evaluator printed no line which
+// cycleLineRegexp matches.
+const noCycleLines = `the evaluator printed no "#N done" lines, so that only the end of the run is known`
+
+// progressWriter passes the output of the evaluator to out, and reports the
+// lines of the clocks done to report. It drops those lines from out if hide,
+// e.g. because the progress is shown in their place.
+type progressWriter struct {
+	out    io.Writer
+	report func(Progress)
+	total  uint
+	start  time.Time
+	// watch is whether the output should have the lines of the clocks, i.e.
+	// the evaluator is not run with --quiet.
+	watch   bool
+	hide    bool
+	matched bool
+	// first is the number of the first clock in the output. A resumed run
+	// may count from the snapshot's clocks.
+	first uint64
+	// cycles is the number of clocks done so far.
+	cycles uint
+	buf    []byte
+}
+
+func newProgressWriter(out io.Writer, total uint, watch, hide bool, report func(Progress)) *progressWriter {
+	w := &progressWriter{out: out, report: report, total: total, start: time.Now(), watch: watch, hide: hide}
+	w.report(Progress{State: JobRunning, Total: total, Start: w.start, Last: w.start})
+	return w
+}
+
+func (w *progressWriter) Write(data []byte) (int, error) {
+	w.buf = append(w.buf, data...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if err := w.line(w.buf[:i+1]); err != nil {
+			return len(data), err
+		}
+		w.buf = w.buf[i+1:]
+	}
+	return len(data), nil
+}
+
+func (w *progressWriter) line(line []byte) error {
+	var n uint64
+	m := cycleLineRegexp.FindSubmatch(line)
+	if m != nil {
+		n, _ = strconv.ParseUint(string(m[1]), 10, 64)
+	}
+	if n == 0 || !w.hide {
+		if _, err := w.out.Write(line); err != nil || n == 0 {
+			return err
+		}
+	}
+	w.matched = true
+	if w.first == 0 || n < w.first {
+		w.first = n
+	}
+	w.cycles = uint(n - w.first + 1)
+	if w.cycles > w.total {
+		w.cycles = w.total
+	}
+	w.report(Progress{State: JobRunning, Cycles: w.cycles, Total: w.total, Start: w.start, Last: time.Now()})
+	return nil
+}
+
+// finish passes the rest of the output, and reports the end of the run with
+// err. It warns if the output should have had the lines of the clocks but
+// had none, e.g. because the evaluator prints them differently.
+func (w *progressWriter) finish(cycles uint, err error) {
+	if len(w.buf) > 0 {
+		w.line(w.buf)
+		w.buf = nil
+	}
+	p := Progress{State: JobDone, Cycles: cycles, Total: w.total, Start: w.start, Last: time.Now()}
+	if err != nil {
+		p.State = JobFailed
+	} else if w.watch && !w.matched && cycles > 0 {
+		p.Warning = noCycleLines
+		if Logger != nil {
+			Logger.Warn("progress", "warning", p.Warning)
+		}
+	}
+	w.report(p)
+}
@@ -0,0 +1,134 @@
+package kvsp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestProgressWriter(t *testing.T) {
+	var out bytes.Buffer
+	var reports []Progress
+	w := newProgressWriter(&out, 3, true, true, func(p Progress) { reports = append(reports, p) })
+	// A resumed run counts on from the snapshot's clocks, and a line may
+	// come in pieces.
+	for _, s := range []string{"Iyokan starts.\n#11 do", "ne. (10 us)\n[info] #12 done. (9 us)\n#cycle\t12\n", "#13 done."} {
+		if _, err := w.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.finish(3, nil)
+
+	if want := "Iyokan starts.\n#cycle\t12\n"; out.String() != want {
+		t.Errorf("output = %q, want %q", out.String(), want)
+	}
+	var got []uint
+	for _, p := range reports {
+		if p.Total != 3 {
+			t.Errorf("Total = %d", p.Total)
+		}
+		got = append(got, p.Cycles)
+	}
+	if want := []uint{0, 1, 2, 3, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("cycles = %v, want %v", got, want)
+	}
+	if reports[3].State != JobRunning || reports[4].State != JobDone {
+		t.Errorf("states = %q, %q", reports[3].State, reports[4].State)
+	}
+
+	// Unless hidden, the lines of the clocks are passed through as well.
+	out.Reset()
+	reports = nil
+	w = newProgressWriter(&out, 3, true, false, func(p Progress) { reports = append(reports, p) })
+	w.Write([]byte("Iyokan starts.\n#1\tdone. (10 us)\n#2"))
+	w.finish(2, nil)
+	if want := "Iyokan starts.\n#1\tdone. (10 us)\n#2"; out.String() != want {
+		t.Errorf("output = %q, want %q", out.String(), want)
+	}
+	if len(reports) != 3 || reports[1].Cycles != 1 {
+		t.Errorf("reports = %+v", reports)
+	}
+}
+
+// iyokanTFHEOutput is the output of "iyokan tfhe -c 3" in the format the demo
+// shows: Iyokan flushes "#N" before each clock and prints "\tdone. (T us)"
+// after it.
+var iyokanTFHEOutput = []string{
+	"Iyokan starts.\n",
+	"#1", "\tdone. (5046521 us)\n",
+	"#2", "\tdone. (4998310 us)\n",
+	"#3", "\tdone. (5012007 us)\n",
+}
+
+func TestProgressWriterIyokanOutput(t *testing.T) {
+	var out bytes.Buffer
+	var reports []Progress
+	w := newProgressWriter(&out, 3, true, true, func(p Progress) { reports = append(reports, p) })
+	for _, s := range iyokanTFHEOutput {
+		if _, err := w.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.finish(3, nil)
+
+	if want := "Iyokan starts.\n"; out.String() != want {
+		t.Errorf("output = %q, want %q", out.String(), want)
+	}
+	var got []uint
+	for _, p := range reports {
+		got = append(got, p.Cycles)
+	}
+	if want := []uint{0, 1, 2, 3, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("cycles = %v, want %v", got, want)
+	}
+	if last := reports[len(reports)-1]; last.Warning != "" {
+		t.Errorf("warning = %q", last.Warning)
+	}
+}
+
+func TestProgressWriterWarns(t *testing.T) {
+	for _, tc := range []struct {
+		watch bool
+		err   error
+		warn  bool
+	}{
+		{true, nil, true},
+		{false, nil, false},
+		{true, errors.New("failed"), false},
+	} {
+		var last Progress
+		w := newProgressWriter(io.Discard, 3, tc.watch, true, func(p Progress) { last = p })
+		w.Write([]byte("Cycle 1 finished\nCycle 2 finished\nCycle 3 finished\n"))
+		w.finish(3, tc.err)
+		if warned := last.Warning != ""; warned != tc.warn {
+			t.Errorf("watch %t, err %v: warning = %q", tc.watch, tc.err, last.Warning)
+		}
+	}
+}
+
+func TestProgressETA(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	p := Progress{State: JobRunning, Cycles: 10, Total: 30, Start: start, Last: start.Add(20 * time.Second)}
+	now := start.Add(25 * time.Second)
+	if eta := p.ETA(now); eta != 35*time.Second {
+		t.Errorf("ETA() = %s, want 35s", eta)
+	}
+	if got, want := p.Line(now), "10/30 cycles (33%), 25s elapsed, ETA 35s"; got != want {
+		t.Errorf("Line() = %q, want %q", got, want)
+	}
+	if eta := p.ETA(start.Add(time.Hour)); eta != 0 {
+		t.Errorf("ETA() = %s, want 0 when overdue", eta)
+	}
+
+	p = Progress{State: JobRunning, Total: 30, Start: start, Last: start}
+	if eta := p.ETA(now); eta != -1 {
+		t.Errorf("ETA() = %s, want unknown before the first clock", eta)
+	}
+	p.State = JobFailed
+	if got, want := p.Line(now), "0/30 cycles (0%), 25s elapsed, failed"; got != want {
+		t.Errorf("Line() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,560 @@
+package kvsp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// QueueJob is an encrypted run waiting in a Queue.
+type QueueJob struct {
+	ID    string `json:"id"`
+	State string `json:"state"`
+	// CPU is the CPU name, or CPUProfile the profile file, to run on.
+	CPU        string `json:"cpu,omitempty"`
+	CPUProfile string `json:"cpu_profile,omitempty"`
+	Backend    string `json:"backend"`
+
+	Cycles           uint     `json:"cycles"`
+	BootstrappingKey string   `json:"bkey"`
+	Input            string   `json:"input"`
+	Output           string   `json:"output"`
+	NumGPU           uint     `json:"num_gpu,omitempty"`
+	IyokanArgs       []string `json:"iyokan_args,omitempty"`
+	// Chunk, if not 0, is the number of clocks to run between snapshots, so
+	// that a retry loses at most Chunk clocks.
+	Chunk uint `json:"chunk,omitempty"`
+
+	// Done is the number of clocks saved in the job's snapshot.
+	Done     uint `json:"done"`
+	Attempts int  `json:"attempts"`
+	// PID is the process running the job, if any.
+	PID      int        `json:"pid,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// Queue is a persistent queue of encrypted runs kept in a directory. Each job
+// has its own directory in Dir/jobs with job.json, the log of its runs, and
+// its latest snapshot.
+type Queue struct {
+	Dir string
+}
+
+// OpenQueue opens the queue in dir, making it if it does not exist.
+func OpenQueue(dir string) (*Queue, error) {
+	// The commands which run the jobs may not run in the same directory.
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "jobs"), 0700); err != nil {
+		return nil, err
+	}
+	return &Queue{Dir: dir}, nil
+}
+
+func (q *Queue) jobFile(id, name string) string {
+	return filepath.Join(q.Dir, "jobs", id, name)
+}
+
+// LogFile returns the log file of the job id.
+func (q *Queue) LogFile(id string) string {
+	return q.jobFile(id, "log")
+}
+
+// SnapshotFile returns the latest snapshot file of the job id.
+func (q *Queue) SnapshotFile(id string) string {
+	return q.jobFile(id, "snapshot")
+}
+
+// lock locks the file name in the queue's directory exclusively. If wait is
+// false and someone else has the lock, it fails immediately.
+func (q *Queue) lock(name string, wait bool) (func(), error) {
+	f, err := os.OpenFile(filepath.Join(q.Dir, name), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_EX
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+func (q *Queue) readJob(id string) (*QueueJob, error) {
+	data, err := ioutil.ReadFile(q.jobFile(id, "job.json"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("no job %s in the queue", id)
+		}
+		return nil, err
+	}
+	var job QueueJob
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, fmt.Errorf("invalid job %s: %v", id, err)
+	}
+	return &job, nil
+}
+
+// saveJob writes job atomically, so that a crash leaves the old one.
+func (q *Queue) saveJob(job *QueueJob) error {
+	data, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := q.jobFile(job.ID, "job.json.tmp")
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.jobFile(job.ID, "job.json"))
+}
+
+// Add puts job in the queue, and returns it with its ID.
+func (q *Queue) Add(job QueueJob) (*QueueJob, error) {
+	if job.Cycles == 0 || job.BootstrappingKey == "" || job.Input == "" || job.Output == "" {
+		return nil, errors.New("Specify -c, -bkey, -i, and -o options properly")
+	}
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, err
+	}
+	job.ID = hex.EncodeToString(idBytes)
+	job.State = JobQueued
+	job.Done, job.Attempts, job.PID, job.Error = 0, 0, 0, ""
+	job.Created = time.Now().UTC()
+	job.Started, job.Finished = nil, nil
+
+	unlock, err := q.lock("lock", true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if err := os.Mkdir(filepath.Join(q.Dir, "jobs", job.ID), 0700); err != nil {
+		return nil, err
+	}
+	if err := q.saveJob(&job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Job returns the job id.
+func (q *Queue) Job(id string) (*QueueJob, error) {
+	unlock, err := q.lock("lock", true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return q.readJob(id)
+}
+
+// Jobs returns all jobs in the queue, oldest first.
+func (q *Queue) Jobs() ([]QueueJob, error) {
+	unlock, err := q.lock("lock", true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return q.jobs()
+}
+
+func (q *Queue) jobs() ([]QueueJob, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(q.Dir, "jobs"))
+	if err != nil {
+		return nil, err
+	}
+	var jobs []QueueJob
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		job, err := q.readJob(entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, *job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Created.Before(jobs[j].Created) })
+	return jobs, nil
+}
+
+// update changes the job id by fn and saves it.
+func (q *Queue) update(id string, fn func(job *QueueJob) error) (*QueueJob, error) {
+	unlock, err := q.lock("lock", true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	job, err := q.readJob(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := fn(job); err != nil {
+		return nil, err
+	}
+	if err := q.saveJob(job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// Cancel cancels the job id. A running job is sent SIGTERM.
+func (q *Queue) Cancel(id string) error {
+	job, err := q.update(id, func(job *QueueJob) error {
+		if job.State != JobQueued && job.State != JobRunning {
+			return fmt.Errorf("job %s is already %s", job.ID, job.State)
+		}
+		job.State = JobCanceled
+		now := time.Now().UTC()
+		job.Finished = &now
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if job.PID != 0 {
+		if err := syscall.Kill(job.PID, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+			return err
+		}
+	}
+	return nil
+}
+
+// QueueRunOptions configures Queue.Run.
+type QueueRunOptions struct {
+	// Concurrency is the number of jobs to run at once.
+	Concurrency int
+	// NumGPU is the number of GPUs of this host. Jobs which use GPUs get
+	// their own ones through CUDA_VISIBLE_DEVICES.
+	NumGPU int
+	// MaxRetries is the number of times to retry a failed job from its
+	// latest snapshot.
+	MaxRetries int
+	// Command returns the command which runs opts of job, i.e. kvsp run, or
+	// kvsp resume if resume. Its output goes to the job's log.
+	Command func(job QueueJob, opts RunOptions, resume bool) *exec.Cmd
+	// Log, if not nil, receives a line when a job starts or ends.
+	Log io.Writer
+}
+
+// QueueSummary is the result of Queue.Run.
+type QueueSummary struct {
+	// Jobs are the jobs which Run took, in the order they ended.
+	Jobs    []QueueJob
+	Elapsed time.Duration
+}
+
+// Count returns the number of the jobs in state.
+func (s *QueueSummary) Count(state string) int {
+	n := 0
+	for _, job := range s.Jobs {
+		if job.State == state {
+			n++
+		}
+	}
+	return n
+}
+
+// QueueConcurrency returns the number of jobs to run at once on a host with
+// numCPU cores and numGPU GPUs: each job which uses GPUs takes its own, and
+// the others take cpusPerJob cores.
+func QueueConcurrency(jobs []QueueJob, numCPU, cpusPerJob, numGPU int) int {
+	maxGPU := 0
+	for _, job := range jobs {
+		if (job.State == JobQueued || job.State == JobRunning) && int(job.NumGPU) > maxGPU {
+			maxGPU = int(job.NumGPU)
+		}
+	}
+	n := 1
+	switch {
+	case maxGPU > 0 && numGPU > 0:
+		n = numGPU / maxGPU
+	case cpusPerJob > 0:
+		n = numCPU / cpusPerJob
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// Run runs the queued jobs until none is left or ctx is done, and returns
+// what happened to them. When ctx is done, the running jobs are sent SIGTERM
+// and queued again once they stop. Jobs left running by a crashed Run are
+// retried from their latest snapshot. Only one Run may use a queue at a time.
+func (q *Queue) Run(ctx context.Context, opts QueueRunOptions) (*QueueSummary, error) {
+	if opts.Command == nil {
+		return nil, errors.New("no command to run jobs")
+	}
+	unlock, err := q.lock("run.lock", false)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot lock the queue %s; is another kvsp queue run using it? (%v)", q.Dir, err)
+	}
+	defer unlock()
+	if err := q.recover(); err != nil {
+		return nil, err
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	start := time.Now()
+	summary := &QueueSummary{}
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+	)
+	for worker := 0; worker < concurrency; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				job, err := q.claim()
+				if err == nil && job == nil {
+					return
+				}
+				if err == nil {
+					job, err = q.runJob(ctx, job, worker, opts)
+				}
+				mu.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					return
+				}
+				summary.Jobs = append(summary.Jobs, *job)
+				mu.Unlock()
+			}
+		}(worker)
+	}
+	wg.Wait()
+	summary.Elapsed = time.Since(start)
+	return summary, firstErr
+}
+
+// recover requeues the jobs left running by a crashed Run.
+func (q *Queue) recover() error {
+	jobs, err := q.Jobs()
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		if job.State != JobRunning {
+			continue
+		}
+		_, err := q.update(job.ID, func(job *QueueJob) error {
+			if job.State == JobRunning {
+				job.State = JobQueued
+				job.PID = 0
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claim marks the oldest queued job as running and returns it, or nil if
+// there is none.
+func (q *Queue) claim() (*QueueJob, error) {
+	unlock, err := q.lock("lock", true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	jobs, err := q.jobs()
+	if err != nil {
+		return nil, err
+	}
+	for _, job := range jobs {
+		if job.State != JobQueued {
+			continue
+		}
+		now := time.Now().UTC()
+		job.State = JobRunning
+		if job.Started == nil {
+			job.Started = &now
+		}
+		if err := q.saveJob(&job); err != nil {
+			return nil, err
+		}
+		return &job, nil
+	}
+	return nil, nil
+}
+
+// runJob runs job, which is claimed by worker, until it is done, canceled,
+// or fails more than opts.MaxRetries times, or queues it again if ctx is
+// done, and returns its final state. The error is about the queue itself,
+// not the job.
+func (q *Queue) runJob(ctx context.Context, job *QueueJob, worker int, opts QueueRunOptions) (*QueueJob, error) {
+	logFile, err := os.OpenFile(q.LogFile(job.ID), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer logFile.Close()
+	if opts.Log != nil {
+		fmt.Fprintf(opts.Log, "Job %s started\n", job.ID)
+	}
+
+	var env []string
+	if job.NumGPU > 0 && opts.NumGPU > 0 {
+		devices := make([]string, job.NumGPU)
+		for i := range devices {
+			devices[i] = strconv.Itoa((worker*int(job.NumGPU) + i) % opts.NumGPU)
+		}
+		env = append(os.Environ(), "CUDA_VISIBLE_DEVICES="+strings.Join(devices, ","))
+	}
+
+	for {
+		runErr := q.runChunk(ctx, job, logFile, env, opts)
+		final, err := q.update(job.ID, func(saved *QueueJob) error {
+			saved.PID = 0
+			saved.Done = job.Done
+			if saved.State == JobCanceled {
+				return nil
+			}
+			now := time.Now().UTC()
+			switch {
+			case ctx.Err() != nil && saved.Done < saved.Cycles:
+				saved.State = JobQueued
+			case runErr == nil && saved.Done >= saved.Cycles:
+				saved.State = JobDone
+				saved.Error = ""
+				saved.Finished = &now
+			case runErr != nil:
+				saved.Attempts++
+				saved.Error = runErr.Error()
+				if saved.Attempts > opts.MaxRetries {
+					saved.State = JobFailed
+					saved.Finished = &now
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if runErr != nil && final.State == JobRunning {
+			fmt.Fprintf(logFile, "kvsp queue: %v; retrying from cycle %d\n", runErr, final.Done)
+		}
+		if final.State == JobQueued {
+			fmt.Fprintf(logFile, "kvsp queue: stopped; queued again to run from cycle %d\n", final.Done)
+		}
+		if final.State != JobRunning {
+			if opts.Log != nil {
+				fmt.Fprintf(opts.Log, "Job %s %s\n", final.ID, final.State)
+			}
+			return final, nil
+		}
+		*job = *final
+	}
+}
+
+// runChunk runs job for Chunk clocks, or all the rest, from its latest
+// snapshot, and advances job.Done if it succeeds. The command is sent
+// SIGTERM when ctx is done.
+func (q *Queue) runChunk(ctx context.Context, job *QueueJob, logFile io.Writer, env []string, opts QueueRunOptions) error {
+	snapshot := q.SnapshotFile(job.ID)
+	// The snapshot's metadata knows better if a crash lost the last update.
+	if info, err := ReadSnapshotInfo(snapshot); err == nil && info.Cycles > job.Done {
+		job.Done = info.Cycles
+	}
+	resume := job.Done > 0 && fileExists(snapshot)
+	if !resume {
+		job.Done = 0
+	}
+	if job.Done >= job.Cycles {
+		return nil
+	}
+
+	cycles := job.Cycles - job.Done
+	if job.Chunk > 0 && job.Chunk < cycles {
+		cycles = job.Chunk
+	}
+	runOpts := RunOptions{
+		Cycles:           cycles,
+		BootstrappingKey: job.BootstrappingKey,
+		Input:            job.Input,
+		Output:           job.Output,
+		Snapshot:         snapshot + ".next",
+		NumGPU:           job.NumGPU,
+		Quiet:            true,
+		IyokanArgs:       job.IyokanArgs,
+	}
+	if resume {
+		runOpts.Input = snapshot
+	}
+	cmd := opts.Command(*job, runOpts, resume)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	if env != nil {
+		cmd.Env = env
+	}
+	// Signals sent to the process group of the queue, e.g. by Ctrl-C, reach
+	// the command only through ctx, after which the job is queued again.
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = childSysProcAttr()
+	}
+	fmt.Fprintf(logFile, "kvsp queue: %s\n", strings.Join(cmd.Args, " "))
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	_, err := q.update(job.ID, func(saved *QueueJob) error {
+		saved.PID = cmd.Process.Pid
+		if saved.State == JobCanceled {
+			cmd.Process.Signal(syscall.SIGTERM)
+		}
+		return nil
+	})
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	stopCmd := context.AfterFunc(ctx, func() {
+		cmd.Process.Signal(syscall.SIGTERM)
+	})
+	err = cmd.Wait()
+	stopCmd()
+	if err != nil {
+		removeWithMeta(runOpts.Snapshot)
+		return err
+	}
+
+	if err := renameWithMeta(runOpts.Snapshot, snapshot); err != nil {
+		return err
+	}
+	job.Done += cycles
+	return nil
+}
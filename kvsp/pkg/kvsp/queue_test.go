@@ -0,0 +1,251 @@
+package kvsp
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeQueueCommand returns a Command for Queue.Run which writes the output
+// and the snapshot like kvsp run, and fails the first run of the jobs whose
+// input contains "flaky" and every run of those with "broken".
+func fakeQueueCommand(calls *[]string) func(QueueJob, RunOptions, bool) *exec.Cmd {
+	var mu sync.Mutex
+	failed := map[string]bool{}
+	return func(job QueueJob, opts RunOptions, resume bool) *exec.Cmd {
+		mu.Lock()
+		defer mu.Unlock()
+		*calls = append(*calls, fmt.Sprintf("%s resume=%t c=%d", filepath.Base(job.Input), resume, opts.Cycles))
+		if strings.Contains(job.Input, "broken") || (strings.Contains(job.Input, "flaky") && !failed[job.ID]) {
+			failed[job.ID] = true
+			return exec.Command("sh", "-c", "echo crashed; exit 1")
+		}
+		return exec.Command("sh", "-c", `echo "$1" >"$2" && echo "$1" >"$3"`,
+			"sh", opts.Input, opts.Output, opts.Snapshot)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	dir := t.TempDir()
+	q, err := OpenQueue(filepath.Join(dir, "queue"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	add := func(input string, cycles, chunk uint) *QueueJob {
+		job, err := q.Add(QueueJob{
+			CPU:              "ruby",
+			Backend:          "tangor",
+			Cycles:           cycles,
+			BootstrappingKey: filepath.Join(dir, "bootstrapping.key"),
+			Input:            filepath.Join(dir, input),
+			Output:           filepath.Join(dir, input+".res"),
+			Chunk:            chunk,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return job
+	}
+	chunked := add("chunked.enc", 25, 10)
+	flaky := add("flaky.enc", 5, 0)
+	broken := add("broken.enc", 5, 0)
+	canceled := add("canceled.enc", 5, 0)
+	if err := q.Cancel(canceled.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Cancel(canceled.ID); err == nil {
+		t.Fatal("Cancel() canceled a job twice")
+	}
+	if _, err := q.Add(QueueJob{Cycles: 5}); err == nil {
+		t.Fatal("Add() accepted a job without files")
+	}
+
+	var calls []string
+	summary, err := q.Run(context.Background(), QueueRunOptions{
+		Concurrency: 2,
+		MaxRetries:  1,
+		Command:     fakeQueueCommand(&calls),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summary.Jobs) != 3 || summary.Count(JobDone) != 2 || summary.Count(JobFailed) != 1 {
+		t.Fatalf("summary = %+v", summary)
+	}
+
+	want := map[string]string{
+		chunked.ID:  JobDone,
+		flaky.ID:    JobDone,
+		broken.ID:   JobFailed,
+		canceled.ID: JobCanceled,
+	}
+	jobs, err := q.Jobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, job := range jobs {
+		if job.State != want[job.ID] {
+			t.Errorf("job %s is %s, want %s", job.Input, job.State, want[job.ID])
+		}
+		if job.PID != 0 {
+			t.Errorf("job %s keeps PID %d", job.Input, job.PID)
+		}
+	}
+	if job, _ := q.Job(flaky.ID); job.Attempts != 1 || job.Done != 5 {
+		t.Errorf("flaky job = %+v", job)
+	}
+	if job, _ := q.Job(broken.ID); job.Attempts != 2 || !strings.Contains(job.Error, "exit status 1") {
+		t.Errorf("broken job = %+v", job)
+	}
+	if log, err := os.ReadFile(q.LogFile(broken.ID)); err != nil || strings.Count(string(log), "\ncrashed\n") != 2 {
+		t.Errorf("log of broken job = %q, %v", log, err)
+	}
+
+	got := map[string]bool{}
+	for _, call := range calls {
+		got[call] = true
+	}
+	for _, call := range []string{
+		"chunked.enc resume=false c=10",
+		"chunked.enc resume=true c=10",
+		"chunked.enc resume=true c=5",
+	} {
+		if !got[call] {
+			t.Errorf("%q not run; calls = %q", call, calls)
+		}
+	}
+	if got["canceled.enc resume=false c=5"] {
+		t.Error("canceled job was run")
+	}
+}
+
+func TestQueueRecover(t *testing.T) {
+	dir := t.TempDir()
+	q, err := OpenQueue(filepath.Join(dir, "queue"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := q.Add(QueueJob{
+		Cycles:           30,
+		BootstrappingKey: filepath.Join(dir, "bootstrapping.key"),
+		Input:            filepath.Join(dir, "fib.enc"),
+		Output:           filepath.Join(dir, "result.enc"),
+		Chunk:            10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Pretend that a Run crashed after the first chunk.
+	writeTestFile(t, filepath.Dir(q.SnapshotFile(job.ID)), "snapshot", "snapshot")
+	if err := writeSnapshotInfo(q.SnapshotFile(job.ID), &SnapshotInfo{Kind: "snapshot", Cycles: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.update(job.ID, func(job *QueueJob) error {
+		job.State = JobRunning
+		job.PID = 1
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	unlock, err := q.lock("run.lock", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls []string
+	if _, err := q.Run(context.Background(), QueueRunOptions{Command: fakeQueueCommand(&calls)}); err == nil {
+		t.Fatal("Run() ran a queue which another Run uses")
+	}
+	unlock()
+
+	summary, err := q.Run(context.Background(), QueueRunOptions{Command: fakeQueueCommand(&calls)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Count(JobDone) != 1 {
+		t.Fatalf("summary = %+v", summary)
+	}
+	if want := []string{"fib.enc resume=true c=10", "fib.enc resume=true c=10"}; strings.Join(calls, ",") != strings.Join(want, ",") {
+		t.Fatalf("calls = %q, want %q", calls, want)
+	}
+}
+
+func TestQueueRunStops(t *testing.T) {
+	dir := t.TempDir()
+	q, err := OpenQueue(filepath.Join(dir, "queue"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := q.Add(QueueJob{
+		Cycles:           30,
+		BootstrappingKey: filepath.Join(dir, "bootstrapping.key"),
+		Input:            filepath.Join(dir, "fib.enc"),
+		Output:           filepath.Join(dir, "result.enc"),
+		Chunk:            10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Stop the queue while the second chunk runs.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var calls []string
+	command := fakeQueueCommand(&calls)
+	summary, err := q.Run(ctx, QueueRunOptions{Command: func(job QueueJob, opts RunOptions, resume bool) *exec.Cmd {
+		cmd := command(job, opts, resume)
+		if resume {
+			cancel()
+			return exec.Command("sleep", "60")
+		}
+		return cmd
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Count(JobQueued) != 1 {
+		t.Fatalf("summary = %+v", summary)
+	}
+	if job, _ := q.Job(job.ID); job.State != JobQueued || job.Done != 10 || job.PID != 0 || job.Attempts != 0 {
+		t.Fatalf("stopped job = %+v", job)
+	}
+
+	calls = nil
+	if _, err := q.Run(context.Background(), QueueRunOptions{Command: fakeQueueCommand(&calls)}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"fib.enc resume=true c=10", "fib.enc resume=true c=10"}; strings.Join(calls, ",") != strings.Join(want, ",") {
+		t.Fatalf("calls = %q, want %q", calls, want)
+	}
+	if job, _ := q.Job(job.ID); job.State != JobDone || job.Done != 30 {
+		t.Errorf("job = %+v", job)
+	}
+}
+
+func TestQueueConcurrency(t *testing.T) {
+	cpuJobs := []QueueJob{{State: JobQueued}}
+	gpuJobs := []QueueJob{{State: JobQueued, NumGPU: 2}, {State: JobDone, NumGPU: 4}}
+	for _, tc := range []struct {
+		jobs                       []QueueJob
+		numCPU, cpusPerJob, numGPU int
+		want                       int
+	}{
+		{cpuJobs, 16, 16, 0, 1},
+		{cpuJobs, 16, 4, 0, 4},
+		{cpuJobs, 16, 0, 0, 1},
+		{cpuJobs, 2, 4, 0, 1},
+		{gpuJobs, 16, 16, 4, 2},
+		{gpuJobs, 16, 4, 0, 4},
+		{gpuJobs, 16, 16, 1, 1},
+	} {
+		if got := QueueConcurrency(tc.jobs, tc.numCPU, tc.cpusPerJob, tc.numGPU); got != tc.want {
+			t.Errorf("QueueConcurrency(%d, %d, %d) = %d, want %d", tc.numCPU, tc.cpusPerJob, tc.numGPU, got, tc.want)
+		}
+	}
+}
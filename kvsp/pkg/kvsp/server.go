@@ -0,0 +1,477 @@
+package kvsp
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// States of a Job.
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+	// JobCanceled is only used by Queue.
+	JobCanceled = "canceled"
+)
+
+// Job is an encrypted run submitted to a Server.
+type Job struct {
+	ID    string `json:"id"`
+	State string `json:"state"`
+	// Key is the ID of the bootstrapping key, i.e. its SHA-256 in hex.
+	Key    string `json:"key"`
+	CPU    string `json:"cpu"`
+	Cycles uint   `json:"cycles"`
+	// ResumeOf is the job whose snapshot this job resumes from, if any.
+	ResumeOf       string     `json:"resume_of,omitempty"`
+	KeyFingerprint string     `json:"key_fingerprint,omitempty"`
+	Error          string     `json:"error,omitempty"`
+	Created        time.Time  `json:"created"`
+	Started        *time.Time `json:"started,omitempty"`
+	Finished       *time.Time `json:"finished,omitempty"`
+}
+
+// Header which carries the key fingerprint of an uploaded file.
+const keyFingerprintHeader = "X-Kvsp-Key-Fingerprint"
+
+var (
+	keyIDRegexp = regexp.MustCompile(`^[0-9a-f]{64}$`)
+	jobIDRegexp = regexp.MustCompile(`^[0-9a-f]{16}$`)
+)
+
+// Server is an HTTP API to run encrypted programs on this host. Clients
+// upload bootstrapping keys by PUT /keys/ID, where ID is the SHA-256 of the
+// key, submit encrypted packets by POST /jobs?key=ID&cycles=N&cpu=NAME, or
+// continue a finished job by POST /jobs?resume=JOB&cycles=N, poll
+// GET /jobs/JOB, and download GET /jobs/JOB/result and /jobs/JOB/snapshot.
+// Jobs run one by one, and are kept in Dir across restarts. Close stops
+// them.
+type Server struct {
+	// Dir holds the keys and jobs.
+	Dir     string
+	Backend Backend
+	// NumGPU is the number of GPUs for each job.
+	NumGPU uint
+	// Token, if not empty, is required as "Authorization: Bearer TOKEN".
+	Token string
+
+	mu    sync.Mutex
+	jobs  map[string]*Job
+	queue chan string
+	// ctx is canceled by Close, and done is closed when the worker returns.
+	ctx  context.Context
+	stop context.CancelFunc
+	done chan struct{}
+}
+
+// NewServer returns a server keeping its files in dir, and starts running
+// the jobs left queued in it.
+func NewServer(dir string, b Backend) (*Server, error) {
+	s := &Server{
+		Dir:     dir,
+		Backend: b,
+		jobs:    make(map[string]*Job),
+		queue:   make(chan string, 4096),
+		done:    make(chan struct{}),
+	}
+	s.ctx, s.stop = context.WithCancel(context.Background())
+	for _, sub := range []string{"keys", "jobs"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	// Load the jobs, and requeue those which did not finish.
+	entries, err := ioutil.ReadDir(filepath.Join(dir, "jobs"))
+	if err != nil {
+		return nil, err
+	}
+	var pending []*Job
+	for _, entry := range entries {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "jobs", entry.Name(), "job.json"))
+		if err != nil {
+			continue
+		}
+		var job Job
+		if err := json.Unmarshal(data, &job); err != nil {
+			return nil, fmt.Errorf("invalid job %s: %v", entry.Name(), err)
+		}
+		s.jobs[job.ID] = &job
+		if job.State == JobQueued || job.State == JobRunning {
+			job.State = JobQueued
+			job.Started = nil
+			pending = append(pending, &job)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Created.Before(pending[j].Created) })
+
+	// The worker runs them before the queue, which may be smaller.
+	go s.worker(pending)
+	return s, nil
+}
+
+func (s *Server) keyFile(id string) string {
+	return filepath.Join(s.Dir, "keys", id)
+}
+
+func (s *Server) jobFile(id, name string) string {
+	return filepath.Join(s.Dir, "jobs", id, name)
+}
+
+// saveJob writes job in its directory; s.mu must be held.
+func (s *Server) saveJob(job *Job) error {
+	data, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.jobFile(job.ID, "job.json"), data, 0600)
+}
+
+func (s *Server) setJobState(job *Job, state string, jobErr error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	job.State = state
+	switch state {
+	case JobQueued:
+		job.Started = nil
+	case JobRunning:
+		job.Started = &now
+	case JobDone, JobFailed:
+		job.Finished = &now
+	}
+	if jobErr != nil {
+		job.Error = jobErr.Error()
+	}
+	if err := s.saveJob(job); err != nil && Logger != nil {
+		Logger.Error("save job", "job", job.ID, "error", err.Error())
+	}
+}
+
+// Close stops the running job and waits for it to stop. The job is queued
+// again, to run from the start when the server is restarted. Jobs submitted
+// after Close stay queued likewise.
+func (s *Server) Close() {
+	s.stop()
+	<-s.done
+}
+
+// worker runs the jobs in pending, and then those in the queue, until Close.
+func (s *Server) worker(pending []*Job) {
+	defer close(s.done)
+	for _, job := range pending {
+		if s.ctx.Err() != nil {
+			return
+		}
+		s.work(job)
+	}
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case id := <-s.queue:
+			s.mu.Lock()
+			job := s.jobs[id]
+			s.mu.Unlock()
+			s.work(job)
+		}
+	}
+}
+
+func (s *Server) work(job *Job) {
+	s.setJobState(job, JobRunning, nil)
+	if Logger != nil {
+		Logger.Info("job started", "job", job.ID)
+	}
+	start := time.Now()
+	err := s.runJob(job)
+	switch {
+	case err != nil && s.ctx.Err() != nil:
+		s.setJobState(job, JobQueued, nil)
+		if Logger != nil {
+			Logger.Info("job stopped; queued again", "job", job.ID)
+		}
+		return
+	case err != nil:
+		s.setJobState(job, JobFailed, err)
+	default:
+		s.setJobState(job, JobDone, nil)
+	}
+	logStep("job", start, err, "job", job.ID, "cycles", job.Cycles)
+}
+
+func (s *Server) runJob(job *Job) error {
+	opts := RunOptions{
+		Cycles:           job.Cycles,
+		BootstrappingKey: s.keyFile(job.Key),
+		Input:            s.jobFile(job.ID, "input.enc"),
+		Output:           s.jobFile(job.ID, "result.enc"),
+		Snapshot:         s.jobFile(job.ID, "snapshot"),
+		NumGPU:           s.NumGPU,
+		Quiet:            true,
+	}
+	if job.ResumeOf != "" {
+		opts.Input = s.jobFile(job.ResumeOf, "snapshot")
+		return Resume(s.ctx, s.Backend, opts)
+	}
+	profile, err := GetCPUProfile(job.CPU)
+	if err != nil {
+		return err
+	}
+	return Run(s.ctx, s.Backend, opts, profile)
+}
+
+// ServeHTTP serves the API.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.Token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+s.Token)) != 1 {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(path) == 2 && path[0] == "keys":
+		s.handleKey(w, r, path[1])
+	case len(path) == 1 && path[0] == "jobs":
+		s.handleJobs(w, r)
+	case len(path) == 2 && path[0] == "jobs":
+		s.handleJob(w, r, path[1])
+	case len(path) == 3 && path[0] == "jobs" && (path[2] == "result" || path[2] == "snapshot"):
+		s.handleJobFile(w, r, path[1], path[2])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) handleKey(w http.ResponseWriter, r *http.Request, id string) {
+	if !keyIDRegexp.MatchString(id) {
+		http.Error(w, "invalid key ID", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if !fileExists(s.keyFile(id)) {
+			http.NotFound(w, r)
+		}
+	case http.MethodPut:
+		if err := s.putKey(id, r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// putKey stores the bootstrapping key in the body of r as id, which must be
+// its SHA-256.
+func (s *Server) putKey(id string, r *http.Request) error {
+	f, err := ioutil.TempFile(filepath.Join(s.Dir, "keys"), ".upload-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), r.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != id {
+		return fmt.Errorf("the key has SHA-256 %s, not %s", sum, id)
+	}
+	if err := os.Rename(f.Name(), s.keyFile(id)); err != nil {
+		return err
+	}
+	return writeFileMeta(s.keyFile(id), "bootstrapping-key", r.Header.Get(keyFingerprintHeader))
+}
+
+func (s *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.mu.Lock()
+		jobs := make([]Job, 0, len(s.jobs))
+		for _, job := range s.jobs {
+			jobs = append(jobs, *job)
+		}
+		s.mu.Unlock()
+		sort.Slice(jobs, func(i, j int) bool { return jobs[i].Created.Before(jobs[j].Created) })
+		writeJSON(w, http.StatusOK, jobs)
+	case http.MethodPost:
+		job, status, err := s.submit(r)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, http.StatusCreated, job)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// submit makes a job of r and queues it. The status tells why on error.
+func (s *Server) submit(r *http.Request) (*Job, int, error) {
+	query := r.URL.Query()
+	cycles, err := strconv.ParseUint(query.Get("cycles"), 10, 0)
+	if err != nil || cycles == 0 {
+		return nil, http.StatusBadRequest, errors.New("invalid cycles")
+	}
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	job := &Job{
+		ID:      hex.EncodeToString(idBytes),
+		State:   JobQueued,
+		Cycles:  uint(cycles),
+		Created: time.Now().UTC(),
+	}
+
+	if resumeOf := query.Get("resume"); resumeOf != "" {
+		s.mu.Lock()
+		prev, ok := s.jobs[resumeOf]
+		var prevJob Job
+		if ok {
+			prevJob = *prev
+		}
+		s.mu.Unlock()
+		if !ok {
+			return nil, http.StatusNotFound, fmt.Errorf("no job %s", resumeOf)
+		}
+		if prevJob.State != JobDone {
+			return nil, http.StatusConflict, fmt.Errorf("job %s is %s", resumeOf, prevJob.State)
+		}
+		job.ResumeOf = resumeOf
+		job.Key = prevJob.Key
+		job.CPU = prevJob.CPU
+		job.KeyFingerprint = prevJob.KeyFingerprint
+	} else {
+		job.Key = query.Get("key")
+		job.CPU = strings.ToLower(query.Get("cpu"))
+		if job.CPU == "" {
+			job.CPU = "ruby"
+		}
+		if !keyIDRegexp.MatchString(job.Key) || !fileExists(s.keyFile(job.Key)) {
+			return nil, http.StatusBadRequest, fmt.Errorf("no bootstrapping key %q; upload it first", job.Key)
+		}
+		if _, err := GetCPUProfile(job.CPU); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		fingerprint, err := recordedFingerprint(s.keyFile(job.Key))
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		job.KeyFingerprint = fingerprint
+	}
+
+	if err := os.MkdirAll(filepath.Join(s.Dir, "jobs", job.ID), 0700); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if job.ResumeOf == "" {
+		input := s.jobFile(job.ID, "input.enc")
+		f, err := os.OpenFile(input, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		_, err = io.Copy(f, r.Body)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		if fingerprint := r.Header.Get(keyFingerprintHeader); fingerprint != "" {
+			if err := writeFileMeta(input, "ciphertext", fingerprint); err != nil {
+				return nil, http.StatusInternalServerError, err
+			}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.saveJob(job); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	select {
+	case s.queue <- job.ID:
+	default:
+		os.RemoveAll(filepath.Join(s.Dir, "jobs", job.ID))
+		return nil, http.StatusServiceUnavailable, errors.New("too many jobs in the queue")
+	}
+	s.jobs[job.ID] = job
+	copied := *job
+	return &copied, 0, nil
+}
+
+func (s *Server) lookupJob(w http.ResponseWriter, r *http.Request, id string) (Job, bool) {
+	if !jobIDRegexp.MatchString(id) {
+		http.Error(w, "invalid job ID", http.StatusBadRequest)
+		return Job{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		http.NotFound(w, r)
+		return Job{}, false
+	}
+	return *job, true
+}
+
+func (s *Server) handleJob(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if job, ok := s.lookupJob(w, r, id); ok {
+		writeJSON(w, http.StatusOK, job)
+	}
+}
+
+func (s *Server) handleJobFile(w http.ResponseWriter, r *http.Request, id, name string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	job, ok := s.lookupJob(w, r, id)
+	if !ok {
+		return
+	}
+	if job.State != JobDone {
+		http.Error(w, fmt.Sprintf("job %s is %s", id, job.State), http.StatusConflict)
+		return
+	}
+	fileName := "result.enc"
+	if name == "snapshot" {
+		fileName = "snapshot"
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeFile(w, r, s.jobFile(id, fileName))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
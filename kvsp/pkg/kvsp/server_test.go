@@ -0,0 +1,206 @@
+package kvsp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func waitJob(t *testing.T, c *Client, id string) *Job {
+	t.Helper()
+	for i := 0; i < 500; i++ {
+		job, err := c.Job(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.State == JobDone || job.State == JobFailed {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s does not finish", id)
+	return nil
+}
+
+func TestServer(t *testing.T) {
+	t.Setenv("KVSP_CPU_PROFILES_PATH", testCPUProfilesDir)
+	dir := t.TempDir()
+	server, err := NewServer(filepath.Join(dir, "server"), &fakeBackend{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Token = "token"
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	c := &Client{URL: ts.URL, Token: "token"}
+
+	bkey := writeTestFile(t, dir, "bootstrapping.key", "bkey")
+	input := writeTestFile(t, dir, "fib.enc", "fib")
+	if err := writeFileMeta(bkey, "bootstrapping-key", "0123"); err != nil {
+		t.Fatal(err)
+	}
+	keyID, err := c.UploadKey(bkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := c.UploadKey(bkey); err != nil || again != keyID {
+		t.Fatalf("UploadKey() again = %s, %v", again, err)
+	}
+
+	job, err := c.Submit(keyID, input, 30, "ruby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job = waitJob(t, c, job.ID); job.State != JobDone {
+		t.Fatalf("job = %+v", job)
+	}
+	if job.KeyFingerprint != "0123" {
+		t.Errorf("job key fingerprint = %q", job.KeyFingerprint)
+	}
+
+	resumed, err := c.SubmitResume(job.ID, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed = waitJob(t, c, resumed.ID); resumed.State != JobDone {
+		t.Fatalf("resumed job = %+v", resumed)
+	}
+
+	result := filepath.Join(dir, "result.enc")
+	snapshot := filepath.Join(dir, "result.snapshot")
+	if err := c.Fetch(resumed.ID, result, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{result, snapshot} {
+		if data, err := os.ReadFile(file); err != nil || len(data) != 1 {
+			t.Errorf("%s = %v, %v", file, data, err)
+		}
+	}
+	if fingerprint, err := recordedFingerprint(result); err != nil || fingerprint != "0123" {
+		t.Errorf("fingerprint of the fetched result = %q, %v", fingerprint, err)
+	}
+
+	if jobs, err := c.Jobs(); err != nil || len(jobs) != 2 {
+		t.Errorf("Jobs() = %v, %v", jobs, err)
+	}
+	if _, err := c.Submit(strings.Repeat("0", 64), input, 30, "ruby"); err == nil {
+		t.Error("Submit accepted an unknown key")
+	}
+	if _, err := (&Client{URL: ts.URL}).Jobs(); err == nil {
+		t.Error("the server accepted a request without the token")
+	}
+}
+
+func TestServerRequeuesManyJobs(t *testing.T) {
+	dir := t.TempDir()
+	const n = 5000 // More than the queue holds.
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("%016x", i)
+		job := Job{ID: id, State: JobRunning, ResumeOf: "missing", Cycles: 1, Created: time.Unix(int64(i), 0)}
+		data, err := json.Marshal(job)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Join(dir, "jobs", id), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "jobs", id, "job.json"), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	created := make(chan *Server)
+	go func() {
+		server, err := NewServer(dir, &fakeBackend{})
+		if err != nil {
+			t.Error(err)
+		}
+		created <- server
+	}()
+	var server *Server
+	select {
+	case server = <-created:
+	case <-time.After(10 * time.Second):
+		t.Fatal("NewServer blocks")
+	}
+	if server == nil {
+		return
+	}
+
+	// The missing snapshot fails every job, the last one after the others.
+	last := fmt.Sprintf("%016x", n-1)
+	for i := 0; ; i++ {
+		server.mu.Lock()
+		state := server.jobs[last].State
+		server.mu.Unlock()
+		if state == JobFailed {
+			break
+		}
+		if i == 1000 {
+			t.Fatalf("job %s is %s", last, state)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// blockingBackend is fakeBackend whose evaluator runs until it is stopped,
+// and tells started when it starts.
+type blockingBackend struct {
+	fakeBackend
+	started chan struct{}
+}
+
+func (b *blockingBackend) RunTFHE(ctx context.Context, args []string) error {
+	b.started <- struct{}{}
+	<-ctx.Done()
+	return errors.New("signal: terminated")
+}
+
+func TestServerClose(t *testing.T) {
+	t.Setenv("KVSP_CPU_PROFILES_PATH", testCPUProfilesDir)
+	dir := t.TempDir()
+	b := &blockingBackend{started: make(chan struct{}, 1)}
+	server, err := NewServer(filepath.Join(dir, "server"), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	c := &Client{URL: ts.URL}
+	keyID, err := c.UploadKey(writeTestFile(t, dir, "bootstrapping.key", "bkey"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := c.Submit(keyID, writeTestFile(t, dir, "fib.enc", "fib"), 30, "ruby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-b.started:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the job does not start")
+	}
+
+	// The stopped job is queued again, and runs when the server restarts.
+	server.Close()
+	if job, err = c.Job(job.ID); err != nil || job.State != JobQueued || job.Started != nil {
+		t.Fatalf("job after Close = %+v, %v", job, err)
+	}
+	server, err = NewServer(filepath.Join(dir, "server"), &fakeBackend{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ts2 := httptest.NewServer(server)
+	defer ts2.Close()
+	if job = waitJob(t, &Client{URL: ts2.URL}, job.ID); job.State != JobDone {
+		t.Errorf("job after the restart = %+v", job)
+	}
+}
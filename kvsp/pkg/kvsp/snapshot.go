@@ -0,0 +1,309 @@
+package kvsp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Version is the version of KVSP recorded in metadata files. The kvsp
+// command sets it.
+var Version = "unk"
+
+// SnapshotInfo is the metadata that Run and Resume write next to each
+// snapshot, in the file named by SnapshotInfoFile.
+type SnapshotInfo struct {
+	// Kind is always "snapshot".
+	Kind string `toml:"kind"`
+	// KeyFingerprint is the KeyFingerprint of the secret key which the
+	// bootstrapping key was made from, if known.
+	KeyFingerprint string `toml:"key_fingerprint,omitempty"`
+	// Cycles is the number of clocks run since the start of the program, as
+	// far as the chain of snapshots with metadata tells.
+	Cycles    uint   `toml:"cycles"`
+	CPU       string `toml:"cpu,omitempty"`
+	Blueprint string `toml:"blueprint,omitempty"`
+	// BlueprintSHA256 is the hash of Blueprint, which CheckBlueprint passed
+	// against the CPU profile when the run started.
+	BlueprintSHA256 string `toml:"blueprint_sha256,omitempty"`
+	Backend         string `toml:"backend"`
+	// BootstrappingKey and Input are absolute paths.
+	BootstrappingKey       string `toml:"bootstrapping_key"`
+	BootstrappingKeySHA256 string `toml:"bootstrapping_key_sha256"`
+	Input                  string `toml:"input,omitempty"`
+	InputSHA256            string `toml:"input_sha256,omitempty"`
+	// Output is the absolute path of the encrypted result written together
+	// with the snapshot.
+	Output string `toml:"output"`
+	// ResumedFrom is the snapshot that this one continues, if any.
+	ResumedFrom string    `toml:"resumed_from,omitempty"`
+	KVSPVersion string    `toml:"kvsp_version"`
+	Created     time.Time `toml:"created"`
+}
+
+// SnapshotInfoFile returns the name of the metadata file of snapshot.
+func SnapshotInfoFile(snapshot string) string {
+	return MetaFile(snapshot)
+}
+
+// ReadSnapshotInfo reads the metadata of snapshot. The error satisfies
+// errors.Is(err, fs.ErrNotExist) if snapshot has none.
+func ReadSnapshotInfo(snapshot string) (*SnapshotInfo, error) {
+	var info SnapshotInfo
+	if _, err := toml.DecodeFile(SnapshotInfoFile(snapshot), &info); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("invalid snapshot metadata %s: %v", SnapshotInfoFile(snapshot), err)
+	}
+	if info.Kind != "snapshot" {
+		return nil, fmt.Errorf("%s is not the metadata of a snapshot", SnapshotInfoFile(snapshot))
+	}
+	return &info, nil
+}
+
+func writeSnapshotInfo(snapshot string, info *SnapshotInfo) error {
+	f, err := os.Create(SnapshotInfoFile(snapshot))
+	if err != nil {
+		return err
+	}
+	if err := toml.NewEncoder(f).Encode(info); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Print writes info to w as tab-separated lines.
+func (info *SnapshotInfo) Print(w io.Writer) error {
+	fmt.Fprintf(w, "cycles\t%d\n", info.Cycles)
+	fmt.Fprintf(w, "cpu\t%s\n", info.CPU)
+	fmt.Fprintf(w, "blueprint\t%s\n", info.Blueprint)
+	fmt.Fprintf(w, "blueprint-sha256\t%s\n", info.BlueprintSHA256)
+	fmt.Fprintf(w, "backend\t%s\n", info.Backend)
+	fmt.Fprintf(w, "bkey\t%s\n", info.BootstrappingKey)
+	fmt.Fprintf(w, "bkey-sha256\t%s\n", info.BootstrappingKeySHA256)
+	fmt.Fprintf(w, "key\t%s\n", info.KeyFingerprint)
+	fmt.Fprintf(w, "input\t%s\n", info.Input)
+	fmt.Fprintf(w, "input-sha256\t%s\n", info.InputSHA256)
+	fmt.Fprintf(w, "output\t%s\n", info.Output)
+	fmt.Fprintf(w, "resumed-from\t%s\n", info.ResumedFrom)
+	fmt.Fprintf(w, "kvsp\t%s\n", info.KVSPVersion)
+	fmt.Fprintf(w, "created\t%s\n", info.Created.Format(time.RFC3339))
+	return nil
+}
+
+// newSnapshotInfo returns the metadata of a snapshot taken by a run of b
+// from the beginning, or from the snapshot opts.Input if resume.
+func newSnapshotInfo(b Backend, opts RunOptions, resume bool) (*SnapshotInfo, error) {
+	info := &SnapshotInfo{Kind: "snapshot"}
+	if resume {
+		prev, err := ReadSnapshotInfo(opts.Input)
+		if err == nil {
+			*info = *prev
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		info.ResumedFrom, err = filepath.Abs(opts.Input)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if info.Input, err = filepath.Abs(opts.Input); err != nil {
+			return nil, err
+		}
+		if info.InputSHA256, err = fileSHA256(opts.Input); err != nil {
+			return nil, err
+		}
+	}
+
+	bkey, err := filepath.Abs(opts.BootstrappingKey)
+	if err != nil {
+		return nil, err
+	}
+	bkeySHA256, err := fileSHA256(opts.BootstrappingKey)
+	if err != nil {
+		return nil, err
+	}
+	fingerprint, err := recordedFingerprint(opts.BootstrappingKey)
+	if err != nil {
+		return nil, err
+	}
+	if resume {
+		if err := info.check(b, bkeySHA256, fingerprint); err != nil {
+			return nil, fmt.Errorf("Cannot resume from %s: %v", opts.Input, err)
+		}
+	} else {
+		if err := checkFingerprints(opts.BootstrappingKey, fingerprint, opts.Input); err != nil {
+			return nil, err
+		}
+		if info.KeyFingerprint, err = recordedFingerprint(opts.Input); err != nil {
+			return nil, err
+		}
+	}
+	if fingerprint != "" {
+		info.KeyFingerprint = fingerprint
+	}
+	info.Backend = b.Name()
+	info.BootstrappingKey = bkey
+	info.BootstrappingKeySHA256 = bkeySHA256
+	if info.Output, err = filepath.Abs(opts.Output); err != nil {
+		return nil, err
+	}
+	info.Cycles += opts.Cycles
+	info.KVSPVersion = Version
+	info.Created = time.Now().UTC().Truncate(time.Second)
+	return info, nil
+}
+
+// check returns an error if the snapshot of info cannot be resumed by b with
+// the bootstrapping key whose hash is bkeySHA256 and whose key fingerprint is
+// fingerprint.
+func (info *SnapshotInfo) check(b Backend, bkeySHA256, fingerprint string) error {
+	if info.Backend != "" && !strings.EqualFold(info.Backend, b.Name()) {
+		return fmt.Errorf("it was taken with backend %s, not %s", info.Backend, b.Name())
+	}
+	if info.KeyFingerprint != "" && fingerprint != "" && info.KeyFingerprint != fingerprint {
+		return fmt.Errorf("it belongs to the key %s, but the bootstrapping key belongs to the key %s",
+			info.KeyFingerprint, fingerprint)
+	}
+	if info.BootstrappingKeySHA256 != "" && info.BootstrappingKeySHA256 != bkeySHA256 {
+		return fmt.Errorf("it was taken with another bootstrapping key (%s)", info.BootstrappingKey)
+	}
+	// The evaluator reads the blueprint again; it must still be the one
+	// checked against the CPU profile.
+	if info.BlueprintSHA256 != "" {
+		blueprintSHA256, err := fileSHA256(info.Blueprint)
+		if err != nil {
+			return fmt.Errorf("its blueprint cannot be read: %v", err)
+		}
+		if blueprintSHA256 != info.BlueprintSHA256 {
+			return fmt.Errorf("its blueprint %s has changed since the run started", info.Blueprint)
+		}
+	}
+	return nil
+}
+
+// setSnapshotOutput records output as the result written with snapshot.
+func setSnapshotOutput(snapshot, output string) error {
+	info, err := ReadSnapshotInfo(snapshot)
+	if err != nil {
+		return err
+	}
+	if info.Output, err = filepath.Abs(output); err != nil {
+		return err
+	}
+	return writeSnapshotInfo(snapshot, info)
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// SnapshotEntry is a snapshot found by ListSnapshots.
+type SnapshotEntry struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+	// Info is nil if the snapshot has no metadata.
+	Info *SnapshotInfo
+}
+
+// ListSnapshots returns the snapshots in dir, i.e. the files named *.snapshot
+// and those with metadata, from the oldest to the newest.
+func ListSnapshots(dir string) ([]SnapshotEntry, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasSuffix(name, ".snapshot") {
+			names[name] = true
+		} else if strings.HasSuffix(name, ".kvsp.toml") {
+			snapshot := strings.TrimSuffix(name, ".kvsp.toml")
+			if _, err := ReadSnapshotInfo(filepath.Join(dir, snapshot)); err == nil {
+				names[snapshot] = true
+			}
+		}
+	}
+
+	entries := make([]SnapshotEntry, 0, len(names))
+	for name := range names {
+		path := filepath.Join(dir, name)
+		entry := SnapshotEntry{Path: path}
+		if st, err := os.Stat(path); err == nil {
+			entry.Size = st.Size()
+			entry.ModTime = st.ModTime()
+		}
+		if info, err := ReadSnapshotInfo(path); err == nil {
+			entry.Info = info
+			entry.ModTime = info.Created
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].ModTime.Equal(entries[j].ModTime) {
+			return entries[i].ModTime.Before(entries[j].ModTime)
+		}
+		return entries[i].Path < entries[j].Path
+	})
+	return entries, nil
+}
+
+// PruneSnapshots removes the snapshots in dir with metadata but the newest
+// keep of each run, i.e. of each input, and the metadata of snapshots that no
+// longer exist. Snapshots without metadata are left alone. It returns the
+// removed snapshots; nothing is removed if dryRun.
+func PruneSnapshots(dir string, keep int, dryRun bool) ([]string, error) {
+	entries, err := ListSnapshots(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	kept := make(map[string]int)
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if entry.Info == nil {
+			continue
+		}
+		if _, err := os.Stat(entry.Path); err == nil {
+			run := entry.Info.InputSHA256
+			if run == "" {
+				run = entry.Path
+			}
+			if kept[run] < keep {
+				kept[run]++
+				continue
+			}
+		}
+		removed = append(removed, entry.Path)
+		if !dryRun {
+			if err := removeWithMeta(entry.Path); err != nil {
+				return removed, err
+			}
+		}
+	}
+	return removed, nil
+}
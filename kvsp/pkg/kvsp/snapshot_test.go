@@ -0,0 +1,108 @@
+package kvsp
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResumeChecksSnapshotInfo(t *testing.T) {
+	profile := testProfile(t, "ruby")
+	dir := t.TempDir()
+	blueprint, err := os.ReadFile(profile.Blueprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blueprintFile := writeTestFile(t, dir, "ruby.toml", string(blueprint))
+	t.Setenv("KVSP_IYOKAN_BLUEPRINT_RUBY_PATH", blueprintFile)
+	bkey := writeTestFile(t, dir, "bootstrapping.key", "bkey")
+	opts := RunOptions{
+		Cycles:           30,
+		BootstrappingKey: bkey,
+		Input:            writeTestFile(t, dir, "fib.enc", "fib"),
+		Output:           filepath.Join(dir, "result.enc"),
+		Snapshot:         filepath.Join(dir, "1.snapshot"),
+	}
+	if err := Run(context.Background(), &fakeBackend{}, opts, profile); err != nil {
+		t.Fatal(err)
+	}
+
+	resume := opts
+	resume.Input = opts.Snapshot
+	resume.Snapshot = filepath.Join(dir, "2.snapshot")
+	if err := Resume(context.Background(), &fakeBackend{}, resume); err != nil {
+		t.Fatal(err)
+	}
+	info, err := ReadSnapshotInfo(resume.Snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Cycles != 60 || info.ResumedFrom != opts.Snapshot || info.Input != opts.Input || info.BlueprintSHA256 == "" {
+		t.Fatalf("resumed snapshot metadata = %+v", info)
+	}
+
+	other := resume
+	other.BootstrappingKey = writeTestFile(t, dir, "other.key", "other")
+	if err := Resume(context.Background(), &fakeBackend{}, other); err == nil || !strings.Contains(err.Error(), "bootstrapping key") {
+		t.Errorf("Resume with another key: %v", err)
+	}
+	b := NewIyokanCompatibleBackend("iyokan", "iyokan", "iyokan-packet")
+	if err := Resume(context.Background(), b, resume); err == nil || !strings.Contains(err.Error(), "backend") {
+		t.Errorf("Resume with another backend: %v", err)
+	}
+
+	writeTestFile(t, dir, "ruby.toml", string(blueprint)+"\n# edited\n")
+	if err := Resume(context.Background(), &fakeBackend{}, resume); err == nil || !strings.Contains(err.Error(), "blueprint") {
+		t.Errorf("Resume with an edited blueprint: %v", err)
+	}
+}
+
+func TestPruneSnapshots(t *testing.T) {
+	profile := testProfile(t, "ruby")
+	dir := t.TempDir()
+	opts := RunOptions{
+		Cycles:           30,
+		BootstrappingKey: writeTestFile(t, dir, "bootstrapping.key", "bkey"),
+		Input:            writeTestFile(t, dir, "fib.enc", "fib"),
+		Output:           filepath.Join(dir, "result.enc"),
+		Snapshot:         filepath.Join(dir, "a.snapshot"),
+	}
+	if err := Run(context.Background(), &fakeBackend{}, opts, profile); err != nil {
+		t.Fatal(err)
+	}
+	opts.Input = opts.Snapshot
+	opts.Snapshot = filepath.Join(dir, "b.snapshot")
+	if err := Resume(context.Background(), &fakeBackend{}, opts); err != nil {
+		t.Fatal(err)
+	}
+	unknown := writeTestFile(t, dir, "old.snapshot", "old")
+
+	entries, err := ListSnapshots(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("ListSnapshots() = %+v", entries)
+	}
+
+	removed, err := PruneSnapshots(dir, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Join(dir, "a.snapshot")
+	if len(removed) != 1 || removed[0] != want {
+		t.Fatalf("PruneSnapshots() = %v, want [%s]", removed, want)
+	}
+	for _, path := range []string{want, SnapshotInfoFile(want)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s is not removed", path)
+		}
+	}
+	for _, path := range []string{opts.Snapshot, unknown} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s is removed", path)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package kvsp
+
+import (
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// VarSpec names a C global variable to read from the result RAM.
+type VarSpec struct {
+	Name string
+	// Count is the number of elements; 0 means as many as the symbol's
+	// size holds.
+	Count int
+	// Type is "int" (a signed integer as wide as the CPU's registers),
+	// "i8", "u8", "i16", "u16", "i32", "u32", or "str" (a C string).
+	Type string
+}
+
+var varTypeWidths = map[string]int{
+	"i8": 1, "u8": 1, "i16": 2, "u16": 2, "i32": 4, "u32": 4, "str": 1,
+}
+
+// ParseVarSpec parses NAME[:COUNT][:TYPE], e.g. "result", "buf:16",
+// "buf:16:u8", or "msg:str".
+func ParseVarSpec(src string) (VarSpec, error) {
+	fields := strings.Split(src, ":")
+	spec := VarSpec{Name: fields[0], Type: "int"}
+	if spec.Name == "" || len(fields) > 3 {
+		return VarSpec{}, fmt.Errorf("invalid variable %q (expected NAME[:COUNT][:TYPE])", src)
+	}
+	for _, field := range fields[1:] {
+		if n, err := strconv.Atoi(field); err == nil {
+			if n <= 0 || spec.Count != 0 {
+				return VarSpec{}, fmt.Errorf("invalid count in variable %q", src)
+			}
+			spec.Count = n
+			continue
+		}
+		if _, ok := varTypeWidths[field]; !ok && field != "int" {
+			return VarSpec{}, fmt.Errorf("invalid type %q in variable %q", field, src)
+		}
+		spec.Type = field
+	}
+	return spec, nil
+}
+
+// Variable is a C global variable decoded from the result RAM.
+type Variable struct {
+	Name   string  `json:"name"`
+	Addr   uint64  `json:"address"`
+	Type   string  `json:"type"`
+	Values []int64 `json:"values,omitempty"`
+	String *string `json:"string,omitempty"`
+}
+
+func (spec VarSpec) width(profile CPUProfile) int {
+	if spec.Type == "int" {
+		return profile.RegWidth / 8
+	}
+	return varTypeWidths[spec.Type]
+}
+
+func findSymbol(syms []elf.Symbol, name string) (elf.Symbol, error) {
+	var found []elf.Symbol
+	for _, sym := range syms {
+		if sym.Name == name && elf.ST_TYPE(sym.Info) != elf.STT_SECTION && elf.ST_TYPE(sym.Info) != elf.STT_FILE {
+			found = append(found, sym)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return elf.Symbol{}, fmt.Errorf("symbol %q not found", name)
+	case 1:
+		return found[0], nil
+	default:
+		return elf.Symbol{}, fmt.Errorf("symbol %q is ambiguous: %d symbols have that name", name, len(found))
+	}
+}
+
+// ReadVariables decodes the variables in specs from pkt.Ram using the
+// symbol table of the ELF file elfFileName, and stores them in
+// pkt.Variables.
+func (pkt *PlainPacket) ReadVariables(elfFileName string, specs []VarSpec, profile CPUProfile) error {
+	input, err := elf.Open(elfFileName)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	syms, err := input.Symbols()
+	if err != nil {
+		if errors.Is(err, elf.ErrNoSymbols) {
+			return fmt.Errorf("%s has no symbol table; do not strip it", elfFileName)
+		}
+		return err
+	}
+
+	pkt.Variables = nil
+	for _, spec := range specs {
+		sym, err := findSymbol(syms, spec.Name)
+		if err != nil {
+			return err
+		}
+		if sym.Value < RAMBaseAddr {
+			return fmt.Errorf("symbol %q at 0x%x is in ROM, which is not in the result", spec.Name, sym.Value)
+		}
+		offset := sym.Value - RAMBaseAddr
+		if offset >= uint64(len(pkt.Ram)) {
+			return fmt.Errorf("symbol %q at 0x%x is outside RAM", spec.Name, sym.Value)
+		}
+
+		width := spec.width(profile)
+		count := spec.Count
+		if count == 0 && spec.Type == "str" {
+			count = len(pkt.Ram) - int(offset)
+			if sym.Size > 0 && int(sym.Size) < count {
+				count = int(sym.Size)
+			}
+		} else if count == 0 {
+			count = int(sym.Size) / width
+			if count == 0 {
+				count = 1
+			}
+		}
+		if offset+uint64(count*width) > uint64(len(pkt.Ram)) {
+			return fmt.Errorf("variable %q at 0x%x with %d elements of %d bytes runs past the end of RAM",
+				spec.Name, sym.Value, count, width)
+		}
+
+		v := Variable{Name: spec.Name, Addr: sym.Value, Type: spec.Type}
+		mem := pkt.Ram[offset : offset+uint64(count*width)]
+		if spec.Type == "str" {
+			var sb strings.Builder
+			for _, b := range mem {
+				if b == 0 {
+					break
+				}
+				sb.WriteByte(byte(b))
+			}
+			str := sb.String()
+			v.String = &str
+		} else {
+			signed := spec.Type == "int" || spec.Type[0] == 'i'
+			for i := 0; i < count; i++ {
+				var val uint64
+				for j := 0; j < width; j++ {
+					val |= uint64(mem[i*width+j]) << (8 * j)
+				}
+				if signed {
+					shift := uint(64 - 8*width)
+					v.Values = append(v.Values, int64(val<<shift)>>shift)
+				} else {
+					v.Values = append(v.Values, int64(val))
+				}
+			}
+		}
+		pkt.Variables = append(pkt.Variables, v)
+	}
+	return nil
+}
+
+func printVariables(w io.Writer, vars []Variable) {
+	if len(vars) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "\n")
+	for _, v := range vars {
+		if v.String != nil {
+			fmt.Fprintf(w, "%s\t%q\n", v.Name, *v.String)
+			continue
+		}
+		vals := make([]string, len(v.Values))
+		for i, val := range v.Values {
+			vals[i] = strconv.FormatInt(val, 10)
+		}
+		fmt.Fprintf(w, "%s\t%s\n", v.Name, strings.Join(vals, " "))
+	}
+}
@@ -0,0 +1,72 @@
+package kvsp
+
+import (
+	"debug/elf"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseVarSpec(t *testing.T) {
+	for src, want := range map[string]VarSpec{
+		"result":     {Name: "result", Type: "int"},
+		"buf:16":     {Name: "buf", Count: 16, Type: "int"},
+		"buf:16:u8":  {Name: "buf", Count: 16, Type: "u8"},
+		"msg:str":    {Name: "msg", Type: "str"},
+		"msg:str:10": {Name: "msg", Count: 10, Type: "str"},
+	} {
+		got, err := ParseVarSpec(src)
+		if err != nil || got != want {
+			t.Errorf("ParseVarSpec(%q) = %+v, %v; want %+v", src, got, err, want)
+		}
+	}
+	for _, src := range []string{"", "buf:0", "buf:f32", "a:1:2:3"} {
+		if _, err := ParseVarSpec(src); err == nil {
+			t.Errorf("ParseVarSpec(%q) succeeded", src)
+		}
+	}
+}
+
+func TestReadVariables(t *testing.T) {
+	profile := testProfile(t, "ruby")
+	fileName := writeTestELFWithSymbols(t, elf.EM_NONE, nil, []testSymbol{
+		{"result", RAMBaseAddr + 0x10, 4},
+		{"msg", RAMBaseAddr + 0x20, 8},
+		{"table", 0x40, 4},
+	})
+
+	var pkt PlainPacket
+	if err := pkt.Load(testResultPacket(profile, true), profile); err != nil {
+		t.Fatal(err)
+	}
+	copy(pkt.Ram[0x10:], []int{0x01, 0x00, 0xff, 0xff})
+	copy(pkt.Ram[0x20:], []int{'h', 'i', 0, 'x'})
+
+	specs := []VarSpec{{Name: "result", Type: "int"}, {Name: "result", Count: 4, Type: "u8"}, {Name: "msg", Type: "str"}}
+	if err := pkt.ReadVariables(fileName, specs, profile); err != nil {
+		t.Fatal(err)
+	}
+	if got := pkt.Variables[0].Values; !reflect.DeepEqual(got, []int64{1, -1}) {
+		t.Errorf("result = %v", got)
+	}
+	if got := pkt.Variables[1].Values; !reflect.DeepEqual(got, []int64{1, 0, 255, 255}) {
+		t.Errorf("result:4:u8 = %v", got)
+	}
+	if got := pkt.Variables[2].String; got == nil || *got != "hi" {
+		t.Errorf("msg = %v", got)
+	}
+
+	for _, tc := range []struct {
+		spec VarSpec
+		want string
+	}{
+		{VarSpec{Name: "missing", Type: "int"}, "not found"},
+		{VarSpec{Name: "table", Type: "int"}, "is in ROM"},
+		{VarSpec{Name: "result", Count: 1000, Type: "int"}, "runs past the end of RAM"},
+	} {
+		err := pkt.ReadVariables(fileName, []VarSpec{tc.spec}, profile)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("ReadVariables(%+v): err = %v, want %q", tc.spec, err, tc.want)
+		}
+	}
+}
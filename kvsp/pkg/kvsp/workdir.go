@@ -0,0 +1,125 @@
+package kvsp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// WorkDir is the directory in which KVSP makes its private working directory
+// for the plaintext temporary files, e.g. packed programs, decrypted results
+// and unwrapped keys. If empty, KVSP_TMPDIR or the system default is used.
+var WorkDir string
+
+// Shred makes KVSP overwrite temporary files with zeros before removing them.
+var Shred bool
+
+var (
+	workDirMu   sync.Mutex
+	privateDir  string
+	shredBufLen = 64 * 1024
+)
+
+// privateWorkDir returns the working directory of this process, making it
+// with mode 0700 on the first call.
+func privateWorkDir() (string, error) {
+	workDirMu.Lock()
+	defer workDirMu.Unlock()
+	if privateDir != "" {
+		return privateDir, nil
+	}
+
+	base := WorkDir
+	if base == "" {
+		base = os.Getenv("KVSP_TMPDIR")
+	}
+	if base != "" {
+		if err := os.MkdirAll(base, 0700); err != nil {
+			return "", err
+		}
+	}
+	dir, err := ioutil.TempDir(base, "kvsp-")
+	if err != nil {
+		return "", err
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		os.Remove(dir)
+		return "", err
+	}
+	privateDir = dir
+	return dir, nil
+}
+
+// tempFileName creates an empty temporary file with mode 0600 in the working
+// directory and returns its name. Remove it by removeTemp.
+func tempFileName() (string, error) {
+	dir, err := privateWorkDir()
+	if err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile(dir, "")
+	if err != nil {
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// removeTemp removes the temporary file name, shredding it if Shred.
+func removeTemp(name string) {
+	if Shred {
+		shredFile(name)
+	}
+	os.Remove(name)
+}
+
+// shredFile overwrites the file name with zeros. File systems which copy on
+// write or SSDs may keep the old blocks, though.
+func shredFile(name string) error {
+	f, err := os.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	zeros := make([]byte, shredBufLen)
+	for left := st.Size(); left > 0; {
+		n := int64(len(zeros))
+		if left < n {
+			n = left
+		}
+		if _, err := f.Write(zeros[:n]); err != nil {
+			return err
+		}
+		left -= n
+	}
+	return f.Sync()
+}
+
+// CleanupWorkDir removes the working directory and the files left in it,
+// shredding them if Shred. The next temporary file makes a new one.
+func CleanupWorkDir() error {
+	workDirMu.Lock()
+	defer workDirMu.Unlock()
+	if privateDir == "" {
+		return nil
+	}
+	if Shred {
+		filepath.Walk(privateDir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() {
+				shredFile(path)
+			}
+			return nil
+		})
+	}
+	err := os.RemoveAll(privateDir)
+	privateDir = ""
+	return err
+}
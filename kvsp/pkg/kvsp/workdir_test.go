@@ -0,0 +1,60 @@
+package kvsp
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPrivateWorkDir(t *testing.T) {
+	// Start afresh; other tests may have made the working directory.
+	if err := CleanupWorkDir(); err != nil {
+		t.Fatal(err)
+	}
+	base := t.TempDir()
+	t.Setenv("KVSP_TMPDIR", filepath.Join(base, "tmp"))
+	t.Cleanup(func() { CleanupWorkDir() })
+
+	name, err := tempFileName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Dir(name)
+	if filepath.Dir(dir) != filepath.Join(base, "tmp") {
+		t.Fatalf("temporary file %s is not under $KVSP_TMPDIR", name)
+	}
+	st, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode().Perm() != 0700 {
+		t.Errorf("working directory has mode %v", st.Mode().Perm())
+	}
+	if st, err := os.Stat(name); err != nil || st.Mode().Perm() != 0600 {
+		t.Errorf("temporary file: %v, %v", st, err)
+	}
+
+	if err := CleanupWorkDir(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("working directory %s is left behind", dir)
+	}
+}
+
+func TestShredFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "plain")
+	if err := os.WriteFile(name, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := shredFile(name); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "\x00\x00\x00\x00\x00\x00" {
+		t.Fatalf("shredded file = %q", data)
+	}
+}
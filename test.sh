@@ -14,19 +14,31 @@ KVSP_RUN_OPTIONS="$@"
 # Check if KVSP is correct
 [ -x "$KVSP" ] || failwith "Invalid executable of kvsp"
 
+# Keys and file names shared by the commands below
+cat <<EOS > _test.toml
+[defaults]
+keys = "test"
+snapshot = "_test.snapshot"
+
+[keys.test]
+secret = "_test.sk"
+bootstrapping = "_test.bk"
+EOS
+export KVSP_CONFIG=_test.toml
+
 # Prepare keys
-[ -f _test.sk ] || "$KVSP" genkey -o _test.sk
-[ -f _test.bk ] || "$KVSP" genbkey -i _test.sk -o _test.bk
+[ -f _test.sk ] || "$KVSP" genkey
+[ -f _test.bk ] || "$KVSP" genbkey
 
 letstest() {
     cmdargs="$1"
     expected="$2"
     "$KVSP" cc _test.c -o _test.exe
     ncycles=$("$KVSP" emu _test.exe $cmdargs | grep "#cycle" | cut -f2)
-    "$KVSP" enc -k _test.sk -i _test.exe -o _test.enc $cmdargs
-    "$KVSP" run -bkey _test.bk -i _test.enc -o _test.res -c 1 -snapshot _test.snapshot $KVSP_RUN_OPTIONS
-    "$KVSP" resume -bkey _test.bk -i _test.snapshot -o _test.res -snapshot _test.snapshot -c $ncycles
-    result=$("$KVSP" dec -k _test.sk -i _test.res | grep x8 | cut -f2)
+    "$KVSP" enc -i _test.exe -o _test.enc $cmdargs
+    "$KVSP" run -i _test.enc -o _test.res -c 1 $KVSP_RUN_OPTIONS
+    "$KVSP" resume -i _test.snapshot -o _test.res -c $ncycles
+    result=$("$KVSP" dec -i _test.res | grep x8 | cut -f2)
     [ $result -eq $expected ] || failwith "test failed"
 }
 
@@ -117,7 +117,11 @@ case "$1" in
                 share/kvsp/cahp-rt/cahp.lds \
                 share/kvsp/cahp-rt/crt0.o \
                 share/kvsp/cahp-rt/libc.a \
+                share/kvsp/cpus/alexandrite.toml \
+                share/kvsp/cpus/pearl.toml \
+                share/kvsp/cpus/ruby.toml \
                 share/kvsp/pearl-core.json \
+                share/kvsp/throughput.toml \
                 share/kvsp/ruby-core.json \
                 lib/libstarpu-1.4.so \
                 ; do